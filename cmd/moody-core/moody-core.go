@@ -7,11 +7,14 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/akamensky/argparse"
 	"github.com/antima/moody-core/pkg/api"
+	"github.com/antima/moody-core/pkg/history"
 	"github.com/antima/moody-core/pkg/http"
 	"github.com/antima/moody-core/pkg/mqtt"
+	"github.com/antima/moody-core/pkg/rules"
 )
 
 const (
@@ -22,12 +25,43 @@ const (
 	defaultBrokerString = "tcp://localhost:1883"
 	defaultServiceDir   = "./services"
 	defaultApiPort      = ":8080"
+	defaultHistoryDir   = ""
+	defaultRuleDir      = ""
+	defaultNamespace    = mqtt.DefaultNamespace
+	defaultEmbeddedAddr = "127.0.0.1:1883"
 
 	versionHelp    = "Print out the current version"
 	brokerHelp     = "Pass the broker connection string in the <scheme>://<host>:<port> format"
 	apiPortHelp    = "Start the HTTP API server on the specified port, in the :<port> format"
 	serviceDirHelp = "Pass the directory from where to load the services"
 	configHelp     = "Pass the location of a file specifying the needed configurations in json format"
+	historyDirHelp = "Pass the directory where the topic history is stored, the history is disabled if empty"
+	ruleDirHelp    = "Pass the directory from where to load the automation rules, the rule engine is disabled if empty"
+	namespaceHelp  = "Pass the root of the topics that the services subscribe to"
+	topicRootHelp  = "Pass a topic filter to subscribe to on the broker, can be repeated, defaults to every topic under the namespace"
+	clientIdHelp   = "Pass the MQTT client id, defaults to one derived from the host name"
+	usernameHelp   = "Pass the username used to authenticate with the broker"
+	passwordHelp   = "Pass the password used to authenticate with the broker"
+	keepAliveHelp  = "Pass the MQTT keepalive interval as a duration, e.g. 30s"
+	noCleanHelp    = "Resume the previous MQTT session instead of starting a clean one"
+	caFileHelp     = "Pass the CA certificate file used to verify the broker, requires a TLS broker scheme: ssl, tls, mqtts, tcps or wss"
+	certFileHelp   = "Pass the client certificate file used to authenticate with the broker, requires a TLS broker scheme"
+	keyFileHelp    = "Pass the key file of the client certificate"
+	insecureHelp   = "Skip the verification of the broker certificate, requires a TLS broker scheme"
+	willTopicHelp  = "Pass the topic of the last will message published when the core disconnects"
+	willMsgHelp    = "Pass the payload of the last will message"
+	willQosHelp    = "Pass the QoS level of the last will message"
+	willRetainHelp = "Publish the last will message as a retained message"
+	embeddedHelp   = "Run an embedded MQTT broker instead of connecting to an external one"
+	embAddressHelp = "Pass the address the embedded MQTT broker listens on, in the <host>:<port> format, a non-loopback address requires the broker credentials"
+	embUserHelp    = "Pass the username required by the embedded MQTT broker from its clients"
+	embPassHelp    = "Pass the password required by the embedded MQTT broker from its clients"
+	hashPassHelp   = "Print the hash of the passed password, to be stored in the configuration of an API user"
+	newTokenHelp   = "Print a new random API token along with the hash to be stored in the configuration"
+	apiCertHelp    = "Pass the certificate file of the API server, enabling HTTPS"
+	apiKeyHelp     = "Pass the key file of the API server certificate"
+	selfSignedHelp = "Generate a self-signed certificate in the API certificate and key files if they do not exist, renewing it before it expires"
+	redirectHelp   = "Pass the address of a plain HTTP server redirecting to the HTTPS API, in the :<port> format"
 
 	antimaLogo = `
                -/////////////////:                
@@ -56,10 +90,258 @@ O:            -.    -//.,,.//                   0-
                ./////////////////:                `
 )
 
+type HistoryConfig struct {
+	Dir                string `json:"dir"`
+	Retention          string `json:"retention"`
+	DownsampleAfter    string `json:"downsampleAfter"`
+	DownsampleInterval string `json:"downsampleInterval"`
+}
+
+type MqttTlsConfig struct {
+	Ca                 string `json:"ca"`
+	Cert               string `json:"cert"`
+	Key                string `json:"key"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+type MqttWillConfig struct {
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	Qos      byte   `json:"qos"`
+	Retained bool   `json:"retained"`
+}
+
+type MqttEmbeddedConfig struct {
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type MqttPolicyConfig struct {
+	Filter string `json:"filter"`
+	Qos    *byte  `json:"qos"`
+	Retain *bool  `json:"retain"`
+}
+
+type MqttConnectionConfig struct {
+	Name         string              `json:"name"`
+	Roots        []string            `json:"roots"`
+	Aliases      map[string]string   `json:"aliases"`
+	ClientId     string              `json:"clientId"`
+	Username     string              `json:"username"`
+	Password     string              `json:"password"`
+	KeepAlive    string              `json:"keepAlive"`
+	CleanSession *bool               `json:"cleanSession"`
+	Tls          *MqttTlsConfig      `json:"tls"`
+	Will         *MqttWillConfig     `json:"will"`
+	Embedded     *MqttEmbeddedConfig `json:"embedded"`
+	Policies     []MqttPolicyConfig  `json:"policies"`
+}
+
+type MqttBrokerConfig struct {
+	Broker string `json:"broker"`
+	MqttConnectionConfig
+}
+
+type MqttForwardConfig struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Filter string `json:"filter"`
+	Target string `json:"target"`
+}
+
+type MqttConfig struct {
+	Namespace string `json:"namespace"`
+	MqttConnectionConfig
+	Brokers  []MqttBrokerConfig  `json:"brokers"`
+	Forwards []MqttForwardConfig `json:"forwards"`
+}
+
+type ApiTokenConfig struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+	Role string `json:"role"`
+}
+
+type ApiUserConfig struct {
+	Username string `json:"username"`
+	Hash     string `json:"hash"`
+	Role     string `json:"role"`
+}
+
+type AuthConfig struct {
+	Tokens []ApiTokenConfig `json:"tokens"`
+	Users  []ApiUserConfig  `json:"users"`
+}
+
+type ApiTlsConfig struct {
+	Cert         string `json:"cert"`
+	Key          string `json:"key"`
+	SelfSigned   bool   `json:"selfSigned"`
+	RedirectAddr string `json:"redirectAddr"`
+}
+
 type Config struct {
-	BrokerString string `json:"brokerString"`
-	ApiPort      string `json:"apiPort"`
-	ServiceDir   string `json:"serviceDir"`
+	BrokerString   string                        `json:"brokerString"`
+	ApiPort        string                        `json:"apiPort"`
+	Tls            *ApiTlsConfig                 `json:"tls"`
+	Auth           *AuthConfig                   `json:"auth"`
+	ServiceDir     string                        `json:"serviceDir"`
+	ServiceInstall bool                          `json:"serviceInstall"`
+	RuleDir        string                        `json:"ruleDir"`
+	History        HistoryConfig                 `json:"history"`
+	Mqtt           MqttConfig                    `json:"mqtt"`
+	Services       map[string]mqtt.ServiceConfig `json:"services"`
+}
+
+// policy parses the durations of the history configuration,
+// an empty string is interpreted as a zero duration
+func (config *HistoryConfig) policy() (history.Policy, error) {
+	var policy history.Policy
+	durations := []struct {
+		value string
+		dest  *time.Duration
+	}{
+		{config.Retention, &policy.Retention},
+		{config.DownsampleAfter, &policy.DownsampleAfter},
+		{config.DownsampleInterval, &policy.DownsampleInterval},
+	}
+
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(duration.value)
+		if err != nil {
+			return policy, err
+		}
+		*duration.dest = parsed
+	}
+	return policy, nil
+}
+
+// bridge builds the options of the main broker and of the bridged ones, along
+// with the forwards between them, the brokers without roots subscribe to
+// every topic under the namespace
+func (config *MqttConfig) bridge(broker string, namespace string) ([]mqtt.Options, []mqtt.ForwardOptions, error) {
+	var brokers []mqtt.Options
+	connections := []MqttBrokerConfig{{Broker: broker, MqttConnectionConfig: config.MqttConnectionConfig}}
+	for _, connection := range append(connections, config.Brokers...) {
+		roots := connection.Roots
+		if len(roots) == 0 {
+			roots = []string{mqtt.NamespaceRoot(namespace)}
+		}
+
+		options, err := connection.options(connection.Broker, roots)
+		if err != nil {
+			return nil, nil, err
+		}
+		brokers = append(brokers, options)
+	}
+
+	var forwards []mqtt.ForwardOptions
+	for _, forward := range config.Forwards {
+		forwards = append(forwards, mqtt.ForwardOptions{
+			From:   forward.From,
+			To:     forward.To,
+			Filter: forward.Filter,
+			Target: forward.Target,
+		})
+	}
+	return brokers, forwards, mqtt.ValidateBridge(brokers, forwards)
+}
+
+// options builds the options of the connection to a broker, the
+// keepalive is parsed as a duration string
+func (config *MqttConnectionConfig) options(broker string, roots []string) (mqtt.Options, error) {
+	options := mqtt.Options{
+		Name:         config.Name,
+		Broker:       broker,
+		ClientId:     config.ClientId,
+		Username:     config.Username,
+		Password:     config.Password,
+		CleanSession: config.CleanSession,
+		Roots:        roots,
+		Aliases:      config.Aliases,
+	}
+
+	if config.KeepAlive != "" {
+		keepAlive, err := time.ParseDuration(config.KeepAlive)
+		if err != nil {
+			return options, err
+		}
+		options.KeepAlive = keepAlive
+	}
+
+	if config.Tls != nil {
+		options.Tls = &mqtt.TlsOptions{
+			CaFile:             config.Tls.Ca,
+			CertFile:           config.Tls.Cert,
+			KeyFile:            config.Tls.Key,
+			InsecureSkipVerify: config.Tls.InsecureSkipVerify,
+		}
+	}
+
+	if config.Will != nil {
+		options.Will = &mqtt.WillOptions{
+			Topic:    config.Will.Topic,
+			Payload:  config.Will.Payload,
+			Qos:      config.Will.Qos,
+			Retained: config.Will.Retained,
+		}
+	}
+
+	for _, policy := range config.Policies {
+		options.Policies = append(options.Policies, mqtt.TopicPolicy{
+			Filter: policy.Filter,
+			Qos:    policy.Qos,
+			Retain: policy.Retain,
+		})
+	}
+
+	if config.Embedded != nil {
+		options.Embedded = &mqtt.EmbeddedOptions{
+			Address:  config.Embedded.Address,
+			Username: config.Embedded.Username,
+			Password: config.Embedded.Password,
+		}
+	}
+	return options, options.Validate()
+}
+
+// authenticator builds the authenticator of the API from the configured
+// tokens and users, the API is not authenticated if there are none
+func (config *AuthConfig) authenticator() (*api.Authenticator, error) {
+	if config == nil || (len(config.Tokens) == 0 && len(config.Users) == 0) {
+		return nil, nil
+	}
+
+	var tokens []api.ApiToken
+	for _, token := range config.Tokens {
+		tokens = append(tokens, api.ApiToken{Name: token.Name, Hash: token.Hash, Role: api.Role(token.Role)})
+	}
+
+	var users []api.ApiUser
+	for _, user := range config.Users {
+		users = append(users, api.ApiUser{Username: user.Username, Hash: user.Hash, Role: api.Role(user.Role)})
+	}
+	return api.NewAuthenticator(tokens, users)
+}
+
+// options builds the TLS options of the API server, HTTPS is disabled
+// if no certificate is configured
+func (config *ApiTlsConfig) options() (*api.TlsOptions, error) {
+	if config == nil || (config.Cert == "" && config.Key == "") {
+		return nil, nil
+	}
+
+	options := &api.TlsOptions{
+		CertFile:     config.Cert,
+		KeyFile:      config.Key,
+		SelfSigned:   config.SelfSigned,
+		RedirectAddr: config.RedirectAddr,
+	}
+	return options, options.Validate()
 }
 
 func fromConfigFile(configFilePath string) (*Config, error) {
@@ -76,8 +358,8 @@ func fromConfigFile(configFilePath string) (*Config, error) {
 	return &config, nil
 }
 
-func startCore(brokerString string, serviceDir string, apiPort string) {
-	quit := make(chan os.Signal)
+func startCore(config *Config) {
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	fmt.Printf("%s\n\n", antimaLogo)
 	fmt.Printf("\tmoody-core v%s - Powered by Antima.it\n", version)
@@ -86,17 +368,86 @@ func startCore(brokerString string, serviceDir string, apiPort string) {
 	dataTable := mqtt.NewDataTable()
 	serviceMap := mqtt.NewServiceMap()
 
-	apiServer := api.StartMoodyApi(deviceTable, serviceMap, apiPort)
+	var historyStore *history.Store
+	if config.History.Dir != "" {
+		policy, err := config.History.policy()
+		if err != nil {
+			log.Fatal(err)
+		}
+		historyStore, err = history.NewStore(config.History.Dir, policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dataTable.SetRecorder(historyStore)
+		historyStore.Start()
+	}
+
+	authenticator, err := config.Auth.authenticator()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if authenticator == nil {
+		log.Println("warning: no API tokens or users are configured, the API is not authenticated")
+	}
+
+	tlsOptions, err := config.Tls.options()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	monitor := http.NewMonitor(deviceTable)
-	mqttManager := mqtt.StartMqttManager(brokerString, dataTable)
-	mqtt.StartServiceManager(serviceDir, serviceMap, dataTable)
+	namespace := config.Mqtt.Namespace
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	mqtt.SetServiceNamespace(namespace)
+
+	brokers, forwards, err := config.Mqtt.bridge(config.BrokerString, namespace)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mqttManager := mqtt.StartMqttBridge(brokers, forwards, dataTable)
+
+	var ruleEngine *rules.Engine
+	if config.RuleDir != "" {
+		var err error
+		ruleEngine, err = rules.NewEngine(config.RuleDir, dataTable, deviceTable, mqttManager)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ruleEngine.Start()
+	}
+
+	serviceManager := mqtt.NewServiceManager(config.ServiceDir, serviceMap, dataTable, mqttManager, deviceTable, config.Services)
+	serviceManager.SetInstallEnabled(config.ServiceInstall)
+	serviceManager.Start()
+	apiServer := api.StartMoodyApi(api.Options{
+		Addr:           config.ApiPort,
+		Devices:        deviceTable,
+		RetryQueue:     monitor.NotSynced,
+		Services:       serviceMap,
+		ServiceManager: serviceManager,
+		Mqtt:           mqttManager,
+		DataTable:      dataTable,
+		History:        historyStore,
+		Rules:          ruleEngine,
+		Authenticator:  authenticator,
+		Tls:            tlsOptions,
+	})
 	monitor.Start()
 
 	<-quit
 	fmt.Println("moody-core - stopping")
+	if ruleEngine != nil {
+		ruleEngine.Stop()
+	}
 	monitor.Stop()
+	serviceManager.Stop()
 	mqttManager.StopMqttManager()
 	api.StopMoodyApi(apiServer)
+	if historyStore != nil {
+		historyStore.Stop()
+	}
 	fmt.Println("Bye!")
 }
 
@@ -126,6 +477,119 @@ func main() {
 		Help: configHelp,
 	})
 
+	historyDir := parser.String("d", "history-dir", &argparse.Options{
+		Help:    historyDirHelp,
+		Default: defaultHistoryDir,
+	})
+
+	ruleDir := parser.String("r", "rule-dir", &argparse.Options{
+		Help:    ruleDirHelp,
+		Default: defaultRuleDir,
+	})
+
+	namespace := parser.String("n", "namespace", &argparse.Options{
+		Help:    namespaceHelp,
+		Default: defaultNamespace,
+	})
+
+	topicRoots := parser.StringList("t", "topic-root", &argparse.Options{
+		Help: topicRootHelp,
+	})
+
+	clientId := parser.String("", "client-id", &argparse.Options{
+		Help: clientIdHelp,
+	})
+
+	username := parser.String("u", "username", &argparse.Options{
+		Help: usernameHelp,
+	})
+
+	password := parser.String("", "password", &argparse.Options{
+		Help: passwordHelp,
+	})
+
+	keepAlive := parser.String("", "keepalive", &argparse.Options{
+		Help: keepAliveHelp,
+	})
+
+	noCleanSession := parser.Flag("", "no-clean-session", &argparse.Options{
+		Help: noCleanHelp,
+	})
+
+	caFile := parser.String("", "ca-file", &argparse.Options{
+		Help: caFileHelp,
+	})
+
+	certFile := parser.String("", "cert-file", &argparse.Options{
+		Help: certFileHelp,
+	})
+
+	keyFile := parser.String("", "key-file", &argparse.Options{
+		Help: keyFileHelp,
+	})
+
+	tlsInsecure := parser.Flag("", "tls-insecure", &argparse.Options{
+		Help: insecureHelp,
+	})
+
+	willTopic := parser.String("", "will-topic", &argparse.Options{
+		Help: willTopicHelp,
+	})
+
+	willPayload := parser.String("", "will-payload", &argparse.Options{
+		Help: willMsgHelp,
+	})
+
+	willQos := parser.Int("", "will-qos", &argparse.Options{
+		Help:    willQosHelp,
+		Default: 0,
+	})
+
+	willRetain := parser.Flag("", "will-retain", &argparse.Options{
+		Help: willRetainHelp,
+	})
+
+	embeddedBroker := parser.Flag("", "embedded-broker", &argparse.Options{
+		Help: embeddedHelp,
+	})
+
+	embeddedAddress := parser.String("", "embedded-address", &argparse.Options{
+		Help:    embAddressHelp,
+		Default: defaultEmbeddedAddr,
+	})
+
+	embeddedUsername := parser.String("", "embedded-username", &argparse.Options{
+		Help: embUserHelp,
+	})
+
+	embeddedPassword := parser.String("", "embedded-password", &argparse.Options{
+		Help: embPassHelp,
+	})
+
+	hashPassword := parser.String("", "hash-password", &argparse.Options{
+		Help: hashPassHelp,
+	})
+
+	newToken := parser.Flag("", "new-token", &argparse.Options{
+		Help: newTokenHelp,
+	})
+
+	apiCert := parser.String("", "api-cert", &argparse.Options{
+		Help: apiCertHelp,
+	})
+
+	apiKey := parser.String("", "api-key", &argparse.Options{
+		Help: apiKeyHelp,
+	})
+
+	selfSigned := parser.Flag("", "api-self-signed", &argparse.Options{
+		Help: selfSignedHelp,
+	})
+
+	redirectAddr := parser.String("", "api-redirect", &argparse.Options{
+		Help: redirectHelp,
+	})
+
 	err := parser.Parse(os.Args)
 	if err != nil {
 		log.Fatal(parser.Usage(err))
@@ -136,15 +600,88 @@ func main() {
 		return
 	}
 
+	if *hashPassword != "" {
+		hash, err := api.HashPassword(*hashPassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	if *newToken {
+		token, hash, err := api.NewToken()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("token: %s\nhash: %s\n", token, hash)
+		return
+	}
+
+	config := &Config{
+		BrokerString: *brokerString,
+		ApiPort:      *apiPort,
+		ServiceDir:   *serviceDir,
+		RuleDir:      *ruleDir,
+		History:      HistoryConfig{Dir: *historyDir},
+		Mqtt: MqttConfig{
+			Namespace: *namespace,
+			MqttConnectionConfig: MqttConnectionConfig{
+				Roots:     *topicRoots,
+				ClientId:  *clientId,
+				Username:  *username,
+				Password:  *password,
+				KeepAlive: *keepAlive,
+			},
+		},
+	}
+
+	if *noCleanSession {
+		cleanSession := false
+		config.Mqtt.CleanSession = &cleanSession
+	}
+
+	if *caFile != "" || *certFile != "" || *keyFile != "" || *tlsInsecure {
+		config.Mqtt.Tls = &MqttTlsConfig{
+			Ca:                 *caFile,
+			Cert:               *certFile,
+			Key:                *keyFile,
+			InsecureSkipVerify: *tlsInsecure,
+		}
+	}
+
+	if *willTopic != "" {
+		config.Mqtt.Will = &MqttWillConfig{
+			Topic:    *willTopic,
+			Payload:  *willPayload,
+			Qos:      byte(*willQos),
+			Retained: *willRetain,
+		}
+	}
+
+	if *apiCert != "" || *apiKey != "" {
+		config.Tls = &ApiTlsConfig{
+			Cert:         *apiCert,
+			Key:          *apiKey,
+			SelfSigned:   *selfSigned,
+			RedirectAddr: *redirectAddr,
+		}
+	}
+
+	if *embeddedBroker {
+		config.Mqtt.Embedded = &MqttEmbeddedConfig{
+			Address:  *embeddedAddress,
+			Username: *embeddedUsername,
+			Password: *embeddedPassword,
+		}
+	}
+
 	if *configFile != "" {
-		config, err := fromConfigFile(*configFile)
+		config, err = fromConfigFile(*configFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		*brokerString = config.BrokerString
-		*serviceDir = config.ServiceDir
-		*apiPort = config.ApiPort
 	}
 
-	startCore(*brokerString, *serviceDir, *apiPort)
+	startCore(config)
 }
@@ -5,6 +5,12 @@ go 1.16
 require (
 	github.com/akamensky/argparse v1.3.1
 	github.com/eclipse/paho.mqtt.golang v1.3.5
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/koron/go-ssdp v0.0.2
+	github.com/mochi-co/mqtt v1.3.2
+	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	gopkg.in/yaml.v3 v3.0.1
 )
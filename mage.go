@@ -45,6 +45,10 @@ func Install() error {
 		return err
 	}
 
+	if err := os.MkdirAll("/var/lib/moody", 0755); err != nil {
+		return err
+	}
+
 	if err := copyFile("./config/conf.json", "/etc/moody/conf.json"); err != nil {
 		return err
 	}
@@ -64,6 +68,7 @@ func Install() error {
 	return command("systemctl", "start", "moody").Run()
 }
 
+// Uninstall the application, the data in /var/lib/moody is kept, see Purge
 func Uninstall() error {
 	if err := command("systemctl", "disable", "moody").Run(); err != nil {
 		return err
@@ -84,6 +89,11 @@ func Uninstall() error {
 	return os.Remove("/usr/local/bin/moody-core")
 }
 
+// Purge removes the data of the application, such as the topic history
+func Purge() error {
+	return os.RemoveAll("/var/lib/moody")
+}
+
 // Test the application by running go test in each sub-directory
 func Test() error {
 	return command("go", "test", "./...").Run()
@@ -2,11 +2,18 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"log"
 	"net/http"
+	"time"
 
+	"github.com/antima/moody-core/pkg/history"
 	httpIfc "github.com/antima/moody-core/pkg/http"
 	"github.com/antima/moody-core/pkg/mqtt"
+	"github.com/antima/moody-core/pkg/rules"
+	"github.com/antima/moody-core/pkg/schema"
+	"github.com/antima/moody-core/pkg/value"
 	"github.com/gorilla/mux"
 )
 
@@ -14,32 +21,146 @@ type DevicesResp struct {
 	Devices []string `json:"devices"`
 }
 
-type DeviceResp struct {
-	httpIfc.Node
-	Type string `json:"type"`
+type PendingResp struct {
+	Devices []httpIfc.PendingDevice `json:"devices"`
 }
 
-func StartMoodyApi(deviceList *httpIfc.DeviceList, serviceMap *mqtt.ServiceMap, port string) *http.Server {
-	if deviceList == nil {
+type RulesResp struct {
+	Rules []rules.Rule `json:"rules"`
+}
+
+type ServiceConfigResp struct {
+	Config mqtt.ServiceConfig `json:"config"`
+	Schema *schema.Schema     `json:"schema,omitempty"`
+}
+
+type TopicsResp struct {
+	Topics []string `json:"topics"`
+}
+
+type TopicResp struct {
+	Topic    string      `json:"topic"`
+	Broker   string      `json:"broker,omitempty"`
+	State    string      `json:"state"`
+	Value    value.Value `json:"value"`
+	Received time.Time   `json:"received"`
+	Retained bool        `json:"retained"`
+}
+
+type HealthResp struct {
+	Status string              `json:"status"`
+	Mqtt   []mqtt.BrokerHealth `json:"mqtt,omitempty"`
+}
+
+type HistoryResp struct {
+	Topic   string           `json:"topic"`
+	Samples []history.Sample `json:"samples"`
+}
+
+// Options are the address the API listens on and the components it serves,
+// Devices and DataTable are required while the endpoints of a nil
+// ServiceManager, History or Rules answer that they are not enabled
+type Options struct {
+	Addr           string
+	Devices        *httpIfc.DeviceList
+	RetryQueue     *httpIfc.RetryQueue
+	Services       *mqtt.ServiceMap
+	ServiceManager *mqtt.ServiceManager
+	Mqtt           *mqtt.MqttManager
+	DataTable      *mqtt.DataTable
+	History        *history.Store
+	Rules          *rules.Engine
+	// Authenticator restricts the API to the authenticated requests, if set
+	Authenticator *Authenticator
+	// Tls serves the API over HTTPS, if set
+	Tls *TlsOptions
+}
+
+// StartMoodyApi starts serving the API in the background
+func StartMoodyApi(options Options) *http.Server {
+	if options.Devices == nil {
 		panic("MoodyApi: device list can't be nil")
 	}
 
+	if options.DataTable == nil {
+		panic("MoodyApi: data table can't be nil")
+	}
+
 	router := mux.NewRouter()
-	router.HandleFunc("/api/device", getDevices(deviceList)).Methods("GET")
-	router.HandleFunc("/api/device/{url}", getDevice(deviceList)).Methods("GET")
-	router.HandleFunc("/api/sensor/{url}", getSensorData(deviceList)).Methods("GET")
-	router.HandleFunc("/api/actuator/{url}", getActuatorData(deviceList)).Methods("GET")
-	router.HandleFunc("/api/actuator/{url}", putActuatorData(deviceList)).Methods("PUT")
-	router.HandleFunc("/api/service", getServices(serviceMap)).Methods("GET")
-
-	log.Printf("starting the API server on port %s\n", port)
-	server := &http.Server{Addr: port, Handler: router}
-	go func(server *http.Server) {
-		log.Fatal(server.ListenAndServe())
-	}(server)
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	router.HandleFunc("/api/health", authorize(options.Authenticator, RoleReadOnly, getHealth(options.Mqtt))).Methods("GET")
+	router.HandleFunc("/api/device", authorize(options.Authenticator, RoleReadOnly, getDevices(options.Devices))).Methods("GET")
+	router.HandleFunc("/api/device/pending", authorize(options.Authenticator, RoleReadOnly, getPendingDevices(options.RetryQueue))).Methods("GET")
+	router.HandleFunc("/api/device/{url}", authorize(options.Authenticator, RoleReadOnly, getDevice(options.Devices))).Methods("GET")
+	router.HandleFunc("/api/sensor/{url}", authorize(options.Authenticator, RoleReadOnly, getSensorData(options.Devices))).Methods("GET")
+	router.HandleFunc("/api/actuator/{url}", authorize(options.Authenticator, RoleReadOnly, getActuatorData(options.Devices))).Methods("GET")
+	router.HandleFunc("/api/actuator/{url}", authorize(options.Authenticator, RoleActuate, putActuatorData(options.Devices))).Methods("PUT")
+	router.HandleFunc("/api/service", authorize(options.Authenticator, RoleReadOnly, getServices(options.ServiceManager))).Methods("GET")
+	router.HandleFunc("/api/service", authorize(options.Authenticator, RoleAdmin, postService(options.ServiceManager))).Methods("POST")
+	router.HandleFunc("/api/service/{name}", authorize(options.Authenticator, RoleReadOnly, getService(options.ServiceManager))).Methods("GET")
+	router.HandleFunc("/api/service/{name}", authorize(options.Authenticator, RoleAdmin, deleteService(options.ServiceManager))).Methods("DELETE")
+	router.HandleFunc("/api/service/{name}/config", authorize(options.Authenticator, RoleReadOnly, getServiceConfig(options.ServiceManager))).Methods("GET")
+	router.HandleFunc("/api/service/{name}/config", authorize(options.Authenticator, RoleAdmin, putServiceConfig(options.ServiceManager))).Methods("PUT")
+	router.HandleFunc("/api/service/{name}/{action}", authorize(options.Authenticator, RoleAdmin, controlService(options.ServiceManager))).Methods("POST")
+	router.HandleFunc("/api/topic", authorize(options.Authenticator, RoleReadOnly, getTopics(options.DataTable))).Methods("GET")
+	router.HandleFunc("/api/topic/{topic:.+}", authorize(options.Authenticator, RoleReadOnly, getTopic(options.DataTable))).Methods("GET")
+	router.HandleFunc("/api/history/{topic:.+}", authorize(options.Authenticator, RoleReadOnly, getTopicHistory(options.History))).Methods("GET")
+	router.HandleFunc("/api/rule", authorize(options.Authenticator, RoleReadOnly, getRules(options.Rules))).Methods("GET")
+	router.HandleFunc("/api/rule", authorize(options.Authenticator, RoleAdmin, postRule(options.Rules))).Methods("POST")
+	router.HandleFunc("/api/rule/{name}", authorize(options.Authenticator, RoleReadOnly, getRule(options.Rules))).Methods("GET")
+	router.HandleFunc("/api/rule/{name}", authorize(options.Authenticator, RoleAdmin, putRule(options.Rules))).Methods("PUT")
+	router.HandleFunc("/api/rule/{name}", authorize(options.Authenticator, RoleAdmin, deleteRule(options.Rules))).Methods("DELETE")
+
+	hub := startEventHub(options.Devices, options.Services, options.DataTable)
+	router.HandleFunc("/api/events/sse", authorize(options.Authenticator, RoleReadOnly, streamSse(hub))).Methods("GET")
+	router.HandleFunc("/api/events/ws", authorize(options.Authenticator, RoleReadOnly, streamWebSocket(hub))).Methods("GET")
+
+	if options.Authenticator == nil && !isLoopback(options.Addr) {
+		log.Printf("WARNING: the API on %s is not authenticated, anyone on the network can read the data and control the devices, services and rules; configure the API tokens or users, or listen on a loopback address\n", options.Addr)
+	}
+
+	server := &http.Server{Addr: options.Addr, Handler: router}
+	server.RegisterOnShutdown(hub.stop)
+	if options.Tls == nil {
+		log.Printf("starting the API server on options.Addr %s\n", options.Addr)
+		go serve(server.ListenAndServe)
+		return server
+	}
+
+	certFile, keyFile := options.Tls.CertFile, options.Tls.KeyFile
+	if options.Tls.SelfSigned {
+		certificate := &selfSignedCertificate{options: options.Tls}
+		if _, err := certificate.get(nil); err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certificate.get}
+		certFile, keyFile = "", ""
+	}
+
+	log.Printf("starting the HTTPS API server on options.Addr %s\n", options.Addr)
+	go serve(func() error {
+		return server.ListenAndServeTLS(certFile, keyFile)
+	})
+
+	if options.Tls.RedirectAddr != "" {
+		log.Printf("redirecting the HTTP requests on %s to HTTPS\n", options.Tls.RedirectAddr)
+		redirect := &http.Server{Addr: options.Tls.RedirectAddr, Handler: redirectToHttps(options.Addr)}
+		server.RegisterOnShutdown(func() {
+			_ = redirect.Shutdown(context.TODO())
+		})
+		go serve(redirect.ListenAndServe)
+	}
 	return server
 }
 
+// serve runs a server until it is shut down, any other error is fatal
+func serve(listenAndServe func() error) {
+	if err := listenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
 func StopMoodyApi(server *http.Server) {
 	log.Println("stopping the API server")
 	if err := server.Shutdown(context.TODO()); err != nil {
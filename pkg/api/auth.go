@@ -0,0 +1,254 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	authRealm        = "moody"
+	tokenBytes       = 32
+	tokenQueryParam  = "access_token"
+	bearerAuthScheme = "Bearer "
+)
+
+// simpleContentTypes are the content types that another site can send to the
+// API from a browser without a preflight request, see sameSite
+var simpleContentTypes = map[string]bool{
+	"":                                  true,
+	"application/x-www-form-urlencoded": true,
+	"multipart/form-data":               true,
+	"text/plain":                        true,
+}
+
+var (
+	ErrInvalidRole       = fmt.Errorf("the role must be readonly, actuate or admin")
+	ErrInvalidSecretHash = fmt.Errorf("the secret hash is not valid")
+	ErrDuplicateUser     = fmt.Errorf("the user or token is declared more than once")
+)
+
+// Role is the set of permissions granted to an API client, each
+// role includes the permissions of the previous ones
+type Role string
+
+const (
+	// RoleReadOnly can read the state of the devices, services and topics
+	RoleReadOnly Role = "readonly"
+	// RoleActuate can also actuate the devices
+	RoleActuate Role = "actuate"
+	// RoleAdmin can also manage the services and rules
+	RoleAdmin Role = "admin"
+)
+
+var roleLevels = map[Role]int{
+	RoleReadOnly: 1,
+	RoleActuate:  2,
+	RoleAdmin:    3,
+}
+
+// includes reports whether the role grants the permissions of the other one
+func (role Role) includes(other Role) bool {
+	return roleLevels[role] >= roleLevels[other]
+}
+
+// ApiToken is a token accepted as a bearer credential, the Hash is the hex
+// encoded SHA-256 hash of the token, that is random and long enough not to
+// need a slow hash function
+type ApiToken struct {
+	Name string
+	Hash string
+	Role Role
+}
+
+// ApiUser is a user authenticating with the HTTP basic scheme, the Hash
+// is the bcrypt hash of the password
+type ApiUser struct {
+	Username string
+	Hash     string
+	Role     Role
+}
+
+// Authenticator checks the credentials of the API requests and the
+// role they are granted
+type Authenticator struct {
+	tokens map[string]ApiToken
+	users  map[string]ApiUser
+}
+
+// NewAuthenticator creates an authenticator accepting the passed tokens and users
+func NewAuthenticator(tokens []ApiToken, users []ApiUser) (*Authenticator, error) {
+	authenticator := &Authenticator{
+		tokens: make(map[string]ApiToken),
+		users:  make(map[string]ApiUser),
+	}
+
+	for _, token := range tokens {
+		if _, isRole := roleLevels[token.Role]; !isRole {
+			return nil, fmt.Errorf("%w: token %s", ErrInvalidRole, token.Name)
+		}
+
+		hash := strings.ToLower(token.Hash)
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("%w: token %s", ErrInvalidSecretHash, token.Name)
+		}
+
+		if _, isPresent := authenticator.tokens[hash]; isPresent {
+			return nil, fmt.Errorf("%w: token %s", ErrDuplicateUser, token.Name)
+		}
+		authenticator.tokens[hash] = token
+	}
+
+	for _, user := range users {
+		if _, isRole := roleLevels[user.Role]; !isRole {
+			return nil, fmt.Errorf("%w: user %s", ErrInvalidRole, user.Username)
+		}
+
+		if _, err := bcrypt.Cost([]byte(user.Hash)); err != nil {
+			return nil, fmt.Errorf("%w: user %s", ErrInvalidSecretHash, user.Username)
+		}
+
+		if _, isPresent := authenticator.users[user.Username]; isPresent {
+			return nil, fmt.Errorf("%w: user %s", ErrDuplicateUser, user.Username)
+		}
+		authenticator.users[user.Username] = user
+	}
+	return authenticator, nil
+}
+
+// HashPassword returns the bcrypt hash of a password, to be stored
+// in the configuration of an API user
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// NewToken generates a random API token, returning it along with the
+// hash to be stored in the configuration
+func NewToken() (string, string, error) {
+	secret := make([]byte, tokenBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+
+	token := hex.EncodeToString(secret)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate returns the role granted to the request, the second return
+// value is false if the request has no valid credentials. The token can be
+// passed in the Authorization header or, for the clients that can't set
+// it like the browser event streams, in the access_token query parameter.
+func (authenticator *Authenticator) authenticate(r *http.Request) (Role, bool) {
+	if username, password, isBasic := r.BasicAuth(); isBasic {
+		user, isPresent := authenticator.users[username]
+		if !isPresent || bcrypt.CompareHashAndPassword([]byte(user.Hash), []byte(password)) != nil {
+			return "", false
+		}
+		return user.Role, true
+	}
+
+	token := r.URL.Query().Get(tokenQueryParam)
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, bearerAuthScheme) {
+		token = strings.TrimPrefix(header, bearerAuthScheme)
+	}
+
+	if token == "" {
+		return "", false
+	}
+
+	apiToken, isPresent := authenticator.tokens[hashToken(token)]
+	if !isPresent {
+		return "", false
+	}
+	return apiToken.Role, true
+}
+
+// isLoopback reports whether the API listening on the address can only
+// be reached from the local machine, an address without a host listens
+// on every interface
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// sameSite reports whether a request can't have been forged by another site
+// in the browser of a user, that attaches the basic credentials to any request
+// to the API. The requests that change the state must either come from the
+// same origin or set a header that another site can't set without a preflight
+// request, that is not allowed by the API: X-Requested-With or a content type
+// that is not one of the simple ones, such as application/json.
+func sameSite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		originUrl, err := url.Parse(origin)
+		return err == nil && originUrl.Host == r.Host
+	}
+
+	if r.Header.Get("X-Requested-With") != "" {
+		return true
+	}
+
+	mediaType := r.Header.Get("Content-Type")
+	if mediaType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(mediaType); err != nil {
+			return false
+		}
+	}
+	return !simpleContentTypes[mediaType]
+}
+
+// authorize wraps a handler so that it is only served to the requests
+// granted at least the passed role, answering 401 to the requests without
+// valid credentials and 403 to the ones with an insufficient role or that
+// may be forged by another site. A nil authenticator serves every request.
+func authorize(authenticator *Authenticator, role Role, handler http.HandlerFunc) http.HandlerFunc {
+	if authenticator == nil {
+		return handler
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		granted, isAuthenticated := authenticator.authenticate(r)
+		if !isAuthenticated {
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", authRealm))
+			writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "the request has no valid credentials")
+			return
+		}
+
+		if !granted.includes(role) {
+			writeError(w, r, http.StatusForbidden, CodeForbidden, fmt.Sprintf("the %s role is required", role))
+			return
+		}
+
+		// the tokens are never attached by the browser on behalf of another site
+		if _, _, isBasic := r.BasicAuth(); isBasic && !sameSite(r) {
+			writeError(w, r, http.StatusForbidden, CodeForbidden, "the request must come from the same origin, or set the X-Requested-With header or a JSON content type")
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestNewAuthenticator(t *testing.T) {
+	_, tokenHash, _ := NewToken()
+	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	testCases := []struct {
+		Tokens   []ApiToken
+		Users    []ApiUser
+		Expected error
+	}{
+		{[]ApiToken{{Name: "dashboard", Hash: tokenHash, Role: RoleReadOnly}}, []ApiUser{{Username: "admin", Hash: string(passwordHash), Role: RoleAdmin}}, nil},
+		{[]ApiToken{{Name: "dashboard", Hash: tokenHash, Role: "owner"}}, nil, ErrInvalidRole},
+		{[]ApiToken{{Name: "dashboard", Hash: "secret", Role: RoleReadOnly}}, nil, ErrInvalidSecretHash},
+		{[]ApiToken{{Name: "dashboard", Hash: tokenHash, Role: RoleReadOnly}, {Name: "copy", Hash: tokenHash, Role: RoleAdmin}}, nil, ErrDuplicateUser},
+		{nil, []ApiUser{{Username: "admin", Hash: "secret", Role: RoleAdmin}}, ErrInvalidSecretHash},
+		{nil, []ApiUser{{Username: "admin", Hash: string(passwordHash)}}, ErrInvalidRole},
+	}
+
+	for _, test := range testCases {
+		if _, err := NewAuthenticator(test.Tokens, test.Users); !errors.Is(err, test.Expected) {
+			t.Errorf("expected %v, got %v", test.Expected, err)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	readToken, readHash, _ := NewToken()
+	actuateToken, actuateHash, _ := NewToken()
+	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	authenticator, err := NewAuthenticator(
+		[]ApiToken{{Name: "dashboard", Hash: readHash, Role: RoleReadOnly}, {Name: "relay", Hash: actuateHash, Role: RoleActuate}},
+		[]ApiUser{{Username: "admin", Hash: string(passwordHash), Role: RoleAdmin}},
+	)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	handler := authorize(authenticator, RoleActuate, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	testCases := []struct {
+		Name     string
+		Prepare  func(r *http.Request)
+		Expected int
+	}{
+		{"no credentials", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"unknown token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer unknown") }, http.StatusUnauthorized},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{"readonly token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+readToken) }, http.StatusForbidden},
+		{"actuate token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+actuateToken) }, http.StatusNoContent},
+		{"query token", func(r *http.Request) { r.URL.RawQuery = tokenQueryParam + "=" + actuateToken }, http.StatusNoContent},
+		{"admin user", func(r *http.Request) {
+			r.SetBasicAuth("admin", "secret")
+			r.Header.Set("Content-Type", "application/json")
+		}, http.StatusNoContent},
+		{"admin user without content type", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusForbidden},
+		{"admin user with a form", func(r *http.Request) {
+			r.SetBasicAuth("admin", "secret")
+			r.Header.Set("Content-Type", "multipart/form-data; boundary=moody")
+		}, http.StatusForbidden},
+		{"admin user from another site", func(r *http.Request) {
+			r.SetBasicAuth("admin", "secret")
+			r.Header.Set("Origin", "https://evil.example.com")
+			r.Header.Set("Content-Type", "application/json")
+		}, http.StatusForbidden},
+		{"admin user from the same origin", func(r *http.Request) {
+			r.SetBasicAuth("admin", "secret")
+			r.Header.Set("Origin", "http://"+r.Host)
+			r.Header.Set("Content-Type", "text/plain")
+		}, http.StatusNoContent},
+		{"admin user with a form and X-Requested-With", func(r *http.Request) {
+			r.SetBasicAuth("admin", "secret")
+			r.Header.Set("Content-Type", "multipart/form-data; boundary=moody")
+			r.Header.Set("X-Requested-With", "XMLHttpRequest")
+		}, http.StatusNoContent},
+		{"admin user reading", func(r *http.Request) {
+			r.SetBasicAuth("admin", "secret")
+			r.Method = http.MethodGet
+		}, http.StatusNoContent},
+		{"actuate token with a form", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+actuateToken)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}, http.StatusNoContent},
+	}
+
+	for _, test := range testCases {
+		r := httptest.NewRequest("PUT", "/api/actuator/192.168.1.10", nil)
+		test.Prepare(r)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.Expected {
+			t.Errorf("%s: expected %d, got %d", test.Name, test.Expected, w.Code)
+		}
+
+		if w.Code == http.StatusUnauthorized && len(w.Header().Values("WWW-Authenticate")) == 0 {
+			t.Errorf("%s: expected a WWW-Authenticate challenge", test.Name)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	testCases := []struct {
+		addr     string
+		expected bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{"localhost:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"192.168.1.10:8080", false},
+		{"8080", false},
+	}
+
+	for _, testCase := range testCases {
+		if loopback := isLoopback(testCase.addr); loopback != testCase.expected {
+			t.Errorf("%s: expected %v, got %v", testCase.addr, testCase.expected, loopback)
+		}
+	}
+}
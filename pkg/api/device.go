@@ -10,98 +10,69 @@ import (
 
 func getDevices(devices *httpIfc.DeviceList) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, _ *http.Request) {
-		w.Header().Set("Content-type", "application/json")
 		devs := DevicesResp{Devices: devices.ConnectedIPs()}
-		if err := json.NewEncoder(w).Encode(devs); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+		writeJson(w, http.StatusOK, &devs)
 	}
 }
+
+func getPendingDevices(retryQueue *httpIfc.RetryQueue) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		pending := PendingResp{Devices: retryQueue.Pending()}
+		writeJson(w, http.StatusOK, &pending)
+	}
+}
+
 func getDevice(devices *httpIfc.DeviceList) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-type", "application/json")
 		vars := mux.Vars(r)
 		dev, exists := devices.Get(vars["url"])
 		if dev == nil || !exists {
-			w.WriteHeader(http.StatusNotFound)
+			writeDeviceError(w, r, vars["url"], httpIfc.UnknownDeviceError)
 			return
 		}
-
-		var devResp DeviceResp
-		switch dev.(type) {
-		case *httpIfc.Sensor:
-			devResp = DeviceResp{Node: dev.(*httpIfc.Sensor).Node}
-			devResp.Type = "sensor"
-		case *httpIfc.Actuator:
-			devResp = DeviceResp{Node: dev.(*httpIfc.Actuator).Node}
-			devResp.Type = "actuator"
-		default:
-			break
-		}
-
-		if err := json.NewEncoder(w).Encode(&devResp); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+		writeJson(w, http.StatusOK, dev)
 	}
 }
 
 func getSensorData(devices *httpIfc.DeviceList) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-
-		w.Header().Set("Content-type", "application/json")
 		vars := mux.Vars(r)
-		dev, exists := devices.Get(vars["url"])
-		if dev == nil || !exists {
-			w.WriteHeader(http.StatusNotFound)
+		data, err := devices.Read(vars["url"])
+		if err != nil {
+			writeDeviceError(w, r, vars["url"], err)
 			return
 		}
 
-		sensor, isSensor := dev.(*httpIfc.Sensor)
-		if !isSensor {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-
-		data := sensor.Read()
 		dataResp := httpIfc.DataPacket{Payload: data}
-		if err := json.NewEncoder(w).Encode(&dataResp); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+		writeJson(w, http.StatusOK, &dataResp)
 	}
 }
 
 func getActuatorData(devices *httpIfc.DeviceList) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-
-		w.Header().Set("Content-type", "application/json")
 		vars := mux.Vars(r)
 		dev, exists := devices.Get(vars["url"])
 		if dev == nil || !exists {
-			w.WriteHeader(http.StatusNotFound)
+			writeDeviceError(w, r, vars["url"], httpIfc.UnknownDeviceError)
 			return
 		}
 
-		actuator, isActuator := dev.(*httpIfc.Actuator)
+		actuator, isActuator := dev.(httpIfc.ActuatorDevice)
 		if !isActuator {
-			w.WriteHeader(http.StatusNotFound)
+			writeDeviceError(w, r, vars["url"], httpIfc.NotActuatorError)
 			return
 		}
-		state := actuator.State()
-		dataResp := httpIfc.DataPacket{Payload: state}
-		if err := json.NewEncoder(w).Encode(&dataResp); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+
+		dataResp := httpIfc.DataPacket{Payload: actuator.State()}
+		writeJson(w, http.StatusOK, &dataResp)
 	}
 }
 
 func putActuatorData(devices *httpIfc.DeviceList) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-
-		w.Header().Set("Content-type", "application/json")
 		vars := mux.Vars(r)
-		dev, exists := devices.Get(vars["url"])
-		if dev == nil || !exists {
-			w.WriteHeader(http.StatusNotFound)
+		if _, exists := devices.Get(vars["url"]); !exists {
+			writeDeviceError(w, r, vars["url"], httpIfc.UnknownDeviceError)
 			return
 		}
 
@@ -109,19 +80,14 @@ func putActuatorData(devices *httpIfc.DeviceList) func(http.ResponseWriter, *htt
 		decoder := json.NewDecoder(r.Body)
 		decoder.DisallowUnknownFields()
 		if err := decoder.Decode(&data); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
 			return
 		}
 
-		actuator, isActuator := dev.(*httpIfc.Actuator)
-		if !isActuator {
-			w.WriteHeader(http.StatusNotFound)
+		if err := devices.Actuate(vars["url"], data.Payload); err != nil {
+			writeDeviceError(w, r, vars["url"], err)
 			return
 		}
-
-		actuator.Actuate(data.Payload)
-		if err := json.NewEncoder(w).Encode(&data); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+		writeJson(w, http.StatusOK, &data)
 	}
 }
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	httpIfc "github.com/antima/moody-core/pkg/http"
+)
+
+// ErrorCode identifies the kind of error of a failed API request
+type ErrorCode string
+
+const (
+	CodeInvalidRequest   ErrorCode = "invalid_request"
+	CodeNotFound         ErrorCode = "not_found"
+	CodeNotEnabled       ErrorCode = "not_enabled"
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	CodeConflict         ErrorCode = "conflict"
+	CodeUnauthorized     ErrorCode = "unauthorized"
+	CodeForbidden        ErrorCode = "forbidden"
+	CodeInternal         ErrorCode = "internal_error"
+	CodeUnknownDevice    ErrorCode = "unknown_device"
+	CodeNotSensor        ErrorCode = "not_sensor"
+	CodeNotActuator      ErrorCode = "not_actuator"
+	CodeNodeUnreachable  ErrorCode = "node_unreachable"
+	CodeUnsupportedNode  ErrorCode = "unsupported_node"
+)
+
+// ErrorResp is the body of every failed API request, Device is the device
+// the request failed on, if any, and Url the path of the request
+type ErrorResp struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Device  string    `json:"device,omitempty"`
+	Url     string    `json:"url"`
+}
+
+// deviceErrors maps the errors of the HTTP devices to their status and code
+var deviceErrors = []struct {
+	err    error
+	status int
+	code   ErrorCode
+}{
+	{httpIfc.UnknownDeviceError, http.StatusNotFound, CodeUnknownDevice},
+	{httpIfc.NotSensorError, http.StatusNotFound, CodeNotSensor},
+	{httpIfc.NotActuatorError, http.StatusNotFound, CodeNotActuator},
+	{httpIfc.NodeConnectionError, http.StatusBadGateway, CodeNodeUnreachable},
+	{httpIfc.UnsupportedNodeError, http.StatusBadGateway, CodeUnsupportedNode},
+}
+
+// writeJson answers with the passed status and body, the body is encoded
+// before writing the status so that an encoding error can still be reported
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("error: could not encode the API response, %v\n", err)
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(&ErrorResp{Code: CodeInternal, Message: err.Error()})
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(data, '\n'))
+}
+
+// writeError answers with the error envelope
+func writeError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, message string) {
+	writeJson(w, status, &ErrorResp{Code: code, Message: message, Url: r.URL.Path})
+}
+
+// writeDeviceError answers with the error envelope of an error returned
+// while handling the passed device, unknown errors are internal ones
+func writeDeviceError(w http.ResponseWriter, r *http.Request, device string, err error) {
+	errResp := &ErrorResp{Code: CodeInternal, Message: err.Error(), Device: device, Url: r.URL.Path}
+	status := http.StatusInternalServerError
+	for _, deviceErr := range deviceErrors {
+		if errors.Is(err, deviceErr.err) {
+			status, errResp.Code = deviceErr.status, deviceErr.code
+			break
+		}
+	}
+	writeJson(w, status, errResp)
+}
+
+// writeNotEnabled answers to the requests for a component that is disabled
+func writeNotEnabled(w http.ResponseWriter, r *http.Request, component string) {
+	writeError(w, r, http.StatusNotFound, CodeNotEnabled, "the "+component+" is not enabled")
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, CodeNotFound, "no such API endpoint")
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "the method is not allowed on this API endpoint")
+}
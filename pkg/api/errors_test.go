@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	httpIfc "github.com/antima/moody-core/pkg/http"
+	"github.com/gorilla/mux"
+)
+
+func TestWriteJson(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeJson(recorder, http.StatusCreated, map[string]string{"status": "ok"})
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-type"); contentType != "application/json" {
+		t.Errorf("expected a json content type, got %s", contentType)
+	}
+
+	recorder = httptest.NewRecorder()
+	writeJson(recorder, http.StatusOK, map[string]interface{}{"invalid": make(chan int)})
+	errResp := ErrorResp{}
+	if err := json.NewDecoder(recorder.Body).Decode(&errResp); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusInternalServerError || errResp.Code != CodeInternal {
+		t.Errorf("expected an internal error, got %d %s", recorder.Code, errResp.Code)
+	}
+}
+
+func TestDeviceErrors(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	unreachable := strings.TrimPrefix(closed.URL, "http://")
+	closed.Close()
+
+	devices := httpIfc.NewDeviceList()
+	devices.Add(unreachable, &httpIfc.Sensor{Node: httpIfc.Node{IpAddress: unreachable}})
+	devices.Add("10.0.0.2", &httpIfc.Actuator{Node: httpIfc.Node{IpAddress: "10.0.0.2"}})
+
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	router.HandleFunc("/api/device/{url}", getDevice(devices)).Methods("GET")
+	router.HandleFunc("/api/sensor/{url}", getSensorData(devices)).Methods("GET")
+	router.HandleFunc("/api/actuator/{url}", getActuatorData(devices)).Methods("GET")
+	router.HandleFunc("/api/actuator/{url}", putActuatorData(devices)).Methods("PUT")
+
+	testCases := []struct {
+		Method string
+		Path   string
+		Body   string
+		Status int
+		Code   ErrorCode
+		Device string
+	}{
+		{"GET", "/api/device/10.0.0.1", "", http.StatusNotFound, CodeUnknownDevice, "10.0.0.1"},
+		{"GET", "/api/sensor/10.0.0.1", "", http.StatusNotFound, CodeUnknownDevice, "10.0.0.1"},
+		{"GET", "/api/sensor/10.0.0.2", "", http.StatusNotFound, CodeNotSensor, "10.0.0.2"},
+		{"GET", "/api/sensor/" + unreachable, "", http.StatusBadGateway, CodeNodeUnreachable, unreachable},
+		{"GET", "/api/actuator/" + unreachable, "", http.StatusNotFound, CodeNotActuator, unreachable},
+		{"PUT", "/api/actuator/" + unreachable, `{"payload": 1}`, http.StatusNotFound, CodeNotActuator, unreachable},
+		{"PUT", "/api/actuator/10.0.0.2", `{"state": 1}`, http.StatusBadRequest, CodeInvalidRequest, ""},
+		{"DELETE", "/api/sensor/10.0.0.2", "", http.StatusMethodNotAllowed, CodeMethodNotAllowed, ""},
+		{"GET", "/api/unknown", "", http.StatusNotFound, CodeNotFound, ""},
+	}
+
+	for _, test := range testCases {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(test.Method, test.Path, strings.NewReader(test.Body)))
+
+		errResp := ErrorResp{}
+		if err := json.NewDecoder(recorder.Body).Decode(&errResp); err != nil {
+			t.Errorf("%s %s: could not decode the error, %v", test.Method, test.Path, err)
+			continue
+		}
+
+		expected := ErrorResp{Code: test.Code, Device: test.Device, Url: test.Path}
+		errResp.Message = ""
+		if recorder.Code != test.Status || errResp != expected {
+			t.Errorf("%s %s: expected %d %v, got %d %v", test.Method, test.Path, test.Status, expected, recorder.Code, errResp)
+		}
+	}
+}
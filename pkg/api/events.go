@@ -0,0 +1,300 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	httpIfc "github.com/antima/moody-core/pkg/http"
+	"github.com/antima/moody-core/pkg/mqtt"
+	"github.com/antima/moody-core/pkg/value"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	clientBufferSize  = 64
+	hubQueueSize      = 256
+	heartbeatInterval = 15 * time.Second
+	writeTimeout      = 5 * time.Second
+)
+
+type EventKind string
+
+const (
+	TopicEvent   EventKind = "topic"
+	DeviceEvent  EventKind = "device"
+	ServiceEvent EventKind = "service"
+)
+
+// An Event is pushed to the clients of the event streams every time
+// a topic, device or service changes
+type Event struct {
+	Kind     EventKind      `json:"kind"`
+	Time     time.Time      `json:"time"`
+	Action   string         `json:"action,omitempty"`
+	Topic    string         `json:"topic,omitempty"`
+	Broker   string         `json:"broker,omitempty"`
+	State    string         `json:"state,omitempty"`
+	Value    *value.Value   `json:"value,omitempty"`
+	Retained bool           `json:"retained,omitempty"`
+	Device   httpIfc.Device `json:"device,omitempty"`
+	Service  string         `json:"service,omitempty"`
+}
+
+// eventFilter selects the events a client is interested in, an empty
+// list of kinds or topics lets every event through
+type eventFilter struct {
+	kinds  map[EventKind]bool
+	topics []string
+}
+
+func newEventFilter(r *http.Request) *eventFilter {
+	filter := &eventFilter{kinds: make(map[EventKind]bool)}
+	values := r.URL.Query()
+	for _, kinds := range values["kind"] {
+		for _, kind := range strings.Split(kinds, ",") {
+			if kind != "" {
+				filter.kinds[EventKind(kind)] = true
+			}
+		}
+	}
+	filter.topics = values["topic"]
+	return filter
+}
+
+func (filter *eventFilter) accepts(event *Event) bool {
+	if len(filter.kinds) > 0 && !filter.kinds[event.Kind] {
+		return false
+	}
+
+	if event.Kind != TopicEvent || len(filter.topics) == 0 {
+		return true
+	}
+
+	for _, topicFilter := range filter.topics {
+		if mqtt.TopicMatches(topicFilter, event.Topic) {
+			return true
+		}
+	}
+	return false
+}
+
+type eventClient struct {
+	events chan *Event
+	filter *eventFilter
+}
+
+// eventHub collects the events from the device list, the data table
+// and the service map and fans them out to the connected clients
+type eventHub struct {
+	mutex       sync.Mutex
+	clients     map[*eventClient]bool
+	deviceList  *httpIfc.DeviceList
+	serviceMap  *mqtt.ServiceMap
+	dataTable   *mqtt.DataTable
+	deviceChan  chan httpIfc.DeviceMsg
+	serviceChan chan mqtt.ServiceMsg
+	stateChan   chan mqtt.StateTuple
+	stopChan    chan bool
+}
+
+func startEventHub(deviceList *httpIfc.DeviceList, serviceMap *mqtt.ServiceMap, dataTable *mqtt.DataTable) *eventHub {
+	hub := &eventHub{
+		clients:     make(map[*eventClient]bool),
+		deviceList:  deviceList,
+		serviceMap:  serviceMap,
+		dataTable:   dataTable,
+		deviceChan:  make(chan httpIfc.DeviceMsg, hubQueueSize),
+		serviceChan: make(chan mqtt.ServiceMsg, hubQueueSize),
+		stateChan:   make(chan mqtt.StateTuple),
+		stopChan:    make(chan bool),
+	}
+
+	deviceList.Attach(hub.deviceChan)
+	dataTable.Attach(hub.stateChan)
+	if serviceMap != nil {
+		serviceMap.Attach(hub.serviceChan)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-hub.stopChan:
+				return
+			case msg := <-hub.deviceChan:
+				hub.broadcast(newDeviceEvent(msg))
+			case msg := <-hub.serviceChan:
+				hub.broadcast(newServiceEvent(msg))
+			case tuple := <-hub.stateChan:
+				tupleValue := tuple.Value()
+				hub.broadcast(&Event{
+					Kind:     TopicEvent,
+					Time:     time.Now(),
+					Action:   "updated",
+					Topic:    tuple.Topic(),
+					Broker:   tuple.Source(),
+					State:    tuple.State(),
+					Value:    &tupleValue,
+					Retained: tuple.Retained(),
+				})
+			}
+		}
+	}()
+	return hub
+}
+
+// stop detaches the hub from its sources and terminates it
+func (hub *eventHub) stop() {
+	hub.deviceList.Detach(hub.deviceChan)
+	hub.dataTable.Detach(hub.stateChan)
+	if hub.serviceMap != nil {
+		hub.serviceMap.Detach(hub.serviceChan)
+	}
+	close(hub.stopChan)
+}
+
+func newDeviceEvent(msg httpIfc.DeviceMsg) *Event {
+	event := &Event{Kind: DeviceEvent, Time: time.Now(), Device: msg.Device}
+	switch msg.Event {
+	case httpIfc.EventAdded:
+		event.Action = "added"
+	case httpIfc.EventRemoved:
+		event.Action = "removed"
+	}
+	return event
+}
+
+func newServiceEvent(msg mqtt.ServiceMsg) *Event {
+	event := &Event{Kind: ServiceEvent, Time: time.Now(), Service: msg.Name}
+	switch msg.Event {
+	case mqtt.ServiceLoaded:
+		event.Action = "loaded"
+	case mqtt.ServiceUnloaded:
+		event.Action = "unloaded"
+	}
+	return event
+}
+
+func (hub *eventHub) subscribe(filter *eventFilter) *eventClient {
+	client := &eventClient{
+		events: make(chan *Event, clientBufferSize),
+		filter: filter,
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.clients[client] = true
+	return client
+}
+
+func (hub *eventHub) unsubscribe(client *eventClient) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	delete(hub.clients, client)
+}
+
+// broadcast never blocks, the events are dropped for the clients
+// that are not keeping up with the stream
+func (hub *eventHub) broadcast(event *Event) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for client := range hub.clients {
+		if !client.filter.accepts(event) {
+			continue
+		}
+		select {
+		case client.events <- event:
+		default:
+			log.Printf("dropping a %s event for a slow client\n", event.Kind)
+		}
+	}
+}
+
+func streamSse(hub *eventHub) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, isFlusher := w.(http.Flusher)
+		if !isFlusher {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "the connection does not support streaming")
+			return
+		}
+
+		// the client is subscribed before answering, so that it receives
+		// every event that happens after the stream is opened
+		client := hub.subscribe(newEventFilter(r))
+		defer hub.unsubscribe(client)
+
+		w.Header().Set("Content-type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(heartbeatInterval):
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			case event := <-client.events:
+				data, err := json.Marshal(event)
+				if err != nil {
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Kind, data); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func streamWebSocket(hub *eventHub) func(http.ResponseWriter, *http.Request) {
+	upgrader := websocket.Upgrader{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := hub.subscribe(newEventFilter(r))
+		defer hub.unsubscribe(client)
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader already replied with an error status
+			return
+		}
+		defer func(conn *websocket.Conn) { _ = conn.Close() }(conn)
+
+		// the stream is one-way, incoming messages are discarded
+		// and only used to detect a closed connection
+		closed := make(chan bool)
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		for {
+			select {
+			case <-closed:
+				return
+			case <-time.After(heartbeatInterval):
+				deadline := time.Now().Add(writeTimeout)
+				if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+					return
+				}
+			case event := <-client.events:
+				_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+				if err := conn.WriteJSON(event); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
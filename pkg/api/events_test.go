@@ -0,0 +1,155 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	httpIfc "github.com/antima/moody-core/pkg/http"
+	"github.com/antima/moody-core/pkg/mqtt"
+	"github.com/gorilla/websocket"
+)
+
+// receivedEvent is an Event as decoded by a client,
+// the devices are not decoded
+type receivedEvent struct {
+	Kind   EventKind `json:"kind"`
+	Action string    `json:"action"`
+	Topic  string    `json:"topic"`
+	State  string    `json:"state"`
+}
+
+func startTestHub(t *testing.T) (*eventHub, *httpIfc.DeviceList, *mqtt.DataTable) {
+	deviceList := httpIfc.NewDeviceList()
+	dataTable := mqtt.NewDataTable()
+	hub := startEventHub(deviceList, mqtt.NewServiceMap(), dataTable)
+	t.Cleanup(hub.stop)
+	return hub, deviceList, dataTable
+}
+
+// publishEvents adds a device and updates two topics, only the
+// second topic matches the filter of the tests
+func publishEvents(deviceList *httpIfc.DeviceList, dataTable *mqtt.DataTable) {
+	deviceList.Add("10.0.0.1", &httpIfc.Sensor{Node: httpIfc.Node{IpAddress: "10.0.0.1"}})
+	dataTable.Add("moody/device/garden/temp", "12")
+	dataTable.Add("moody/device/kitchen/temp", "21")
+}
+
+func TestStreamSse(t *testing.T) {
+	hub, deviceList, dataTable := startTestHub(t)
+	server := httptest.NewServer(http.HandlerFunc(streamSse(hub)))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?kind=topic&topic=moody/device/kitchen/%23")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer resp.Body.Close()
+
+	if contentType := resp.Header.Get("Content-type"); contentType != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %s", contentType)
+	}
+
+	publishEvents(deviceList, dataTable)
+
+	events := make(chan receivedEvent, 1)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+				event := receivedEvent{}
+				_ = json.Unmarshal([]byte(data), &event)
+				events <- event
+				return
+			}
+		}
+	}()
+
+	select {
+	case event := <-events:
+		if event.Kind != TopicEvent || event.Topic != "moody/device/kitchen/temp" || event.State != "21" {
+			t.Errorf("expected the kitchen update, got %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected an event")
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	hub, deviceList, dataTable := startTestHub(t)
+	server := httptest.NewServer(http.HandlerFunc(streamWebSocket(hub)))
+	defer server.Close()
+
+	testCases := []struct {
+		Query    string
+		Expected receivedEvent
+	}{
+		{"?kind=device", receivedEvent{Kind: DeviceEvent, Action: "added"}},
+		{"?topic=moody/device/kitchen/%23", receivedEvent{Kind: DeviceEvent, Action: "added"}},
+		{"?kind=topic&topic=moody/device/kitchen/%23", receivedEvent{Kind: TopicEvent, Action: "updated", Topic: "moody/device/kitchen/temp"}},
+		{"?kind=topic,service&topic=moody/device/%2B/temp", receivedEvent{Kind: TopicEvent, Action: "updated", Topic: "moody/device/garden/temp"}},
+	}
+
+	for _, test := range testCases {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + test.Query
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		publishEvents(deviceList, dataTable)
+		deviceList.Remove("10.0.0.1")
+
+		event := receivedEvent{}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Errorf("%s: expected nil error, got %v", test.Query, err)
+		} else if event.Kind != test.Expected.Kind || event.Action != test.Expected.Action || event.Topic != test.Expected.Topic {
+			t.Errorf("%s: expected %+v, got %+v", test.Query, test.Expected, event)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestEventHub_stop(t *testing.T) {
+	deviceList := httpIfc.NewDeviceList()
+	dataTable := mqtt.NewDataTable()
+	hub := startEventHub(deviceList, nil, dataTable)
+	client := hub.subscribe(newEventFilter(httptest.NewRequest("GET", "/", nil)))
+
+	// the data table must not wait on a hub whose clients are not reading
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for idx := 0; idx < 4*hubQueueSize; idx++ {
+			dataTable.Add("moody/device/kitchen/temp", "21")
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the data table not to be stalled by the hub")
+	}
+
+	hub.stop()
+	dataTable.Add("moody/device/kitchen/temp", "22")
+	deviceList.Add("10.0.0.1", &httpIfc.Sensor{Node: httpIfc.Node{IpAddress: "10.0.0.1"}})
+
+	// the updates queued before stopping may still be delivered
+	timeout := time.After(100 * time.Millisecond)
+	for {
+		select {
+		case event := <-client.events:
+			if event.Kind != TopicEvent || event.State != "21" {
+				t.Errorf("expected no event after stopping the hub, got %+v", event)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
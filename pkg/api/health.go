@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/antima/moody-core/pkg/mqtt"
+)
+
+const (
+	healthOk       = "ok"
+	healthDegraded = "degraded"
+)
+
+// getHealth reports the state of the core, that is degraded while the
+// connection to any MQTT broker is down: the HTTP devices keep working
+// but the MQTT services receive no updates from that broker
+func getHealth(mqttManager *mqtt.MqttManager) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		health := HealthResp{Status: healthOk}
+		if mqttManager != nil {
+			health.Mqtt = mqttManager.Health()
+			for _, brokerHealth := range health.Mqtt {
+				if brokerHealth.State != mqtt.BrokerConnected {
+					health.Status = healthDegraded
+				}
+			}
+		}
+
+		status := http.StatusOK
+		if health.Status != healthOk {
+			status = http.StatusServiceUnavailable
+		}
+		writeJson(w, status, &health)
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/antima/moody-core/pkg/rules"
+	"github.com/gorilla/mux"
+)
+
+const ruleEngineComponent = "rule engine"
+
+// yamlMediaTypes are the content types of the rules written in yaml
+var yamlMediaTypes = map[string]bool{
+	"application/yaml":   true,
+	"application/x-yaml": true,
+	"text/yaml":          true,
+}
+
+func getRules(engine *rules.Engine) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if engine == nil {
+			writeNotEnabled(w, r, ruleEngineComponent)
+			return
+		}
+
+		ruleList := RulesResp{Rules: engine.Rules()}
+		writeJson(w, http.StatusOK, &ruleList)
+	}
+}
+
+func getRule(engine *rules.Engine) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if engine == nil {
+			writeNotEnabled(w, r, ruleEngineComponent)
+			return
+		}
+
+		vars := mux.Vars(r)
+		rule, exists := engine.Get(vars["name"])
+		if !exists {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, rules.ErrRuleNotFound.Error())
+			return
+		}
+		writeJson(w, http.StatusOK, &rule)
+	}
+}
+
+// decodeRule reads the rule in the body of the request, written in json or,
+// with a yaml content type, in yaml. The name in the url takes precedence
+// over the one in the body, if any.
+func decodeRule(r *http.Request) (rules.Rule, error) {
+	rule := rules.Rule{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return rule, err
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); yamlMediaTypes[mediaType] {
+		if body, err = rules.YamlToJson(body); err != nil {
+			return rule, err
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rule); err != nil {
+		return rule, err
+	}
+
+	if name, hasName := mux.Vars(r)["name"]; hasName {
+		rule.Name = name
+	}
+	return rule, rule.Validate()
+}
+
+// postRule creates a rule, failing if a rule with the same name exists
+func postRule(engine *rules.Engine) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if engine == nil {
+			writeNotEnabled(w, r, ruleEngineComponent)
+			return
+		}
+
+		rule, err := decodeRule(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+
+		if err := engine.Create(rule); err == rules.ErrRuleExists {
+			writeError(w, r, http.StatusConflict, CodeConflict, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, err.Error())
+			return
+		}
+		writeJson(w, http.StatusCreated, &rule)
+	}
+}
+
+// putRule creates or replaces the rule named in the url
+func putRule(engine *rules.Engine) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if engine == nil {
+			writeNotEnabled(w, r, ruleEngineComponent)
+			return
+		}
+
+		rule, err := decodeRule(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+
+		if err := engine.Put(rule); err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, err.Error())
+			return
+		}
+		writeJson(w, http.StatusOK, &rule)
+	}
+}
+
+func deleteRule(engine *rules.Engine) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if engine == nil {
+			writeNotEnabled(w, r, ruleEngineComponent)
+			return
+		}
+
+		vars := mux.Vars(r)
+		if err := engine.Delete(vars["name"]); err == rules.ErrRuleNotFound {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
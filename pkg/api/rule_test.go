@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	httpIfc "github.com/antima/moody-core/pkg/http"
+	"github.com/antima/moody-core/pkg/mqtt"
+	"github.com/antima/moody-core/pkg/rules"
+	"github.com/gorilla/mux"
+)
+
+func TestRuleHandlers(t *testing.T) {
+	engine, err := rules.NewEngine(t.TempDir(), mqtt.NewDataTable(), httpIfc.NewDeviceList(), nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/rule", postRule(engine)).Methods("POST")
+	router.HandleFunc("/api/rule/{name}", putRule(engine)).Methods("PUT")
+
+	jsonRule := `{"name": "fan", "trigger": {"topic": "moody/device/temp"}, "actions": [{"type": "publish", "topic": "moody/device/fan"}]}`
+	yamlRule := "trigger:\n  topic: moody/device/temp\nactions:\n  - type: publish\n    topic: moody/device/fan\n"
+	testCases := []struct {
+		Method      string
+		Path        string
+		ContentType string
+		Body        string
+		Status      int
+	}{
+		{"POST", "/api/rule", "application/json", jsonRule, http.StatusCreated},
+		{"POST", "/api/rule", "application/json", jsonRule, http.StatusConflict},
+		{"PUT", "/api/rule/fan", "application/json", jsonRule, http.StatusOK},
+		{"PUT", "/api/rule/heater", "application/yaml", yamlRule, http.StatusOK},
+		{"PUT", "/api/rule/heater", "application/json", yamlRule, http.StatusBadRequest},
+		{"POST", "/api/rule", "text/yaml; charset=utf-8", "name: light\n" + yamlRule, http.StatusCreated},
+	}
+
+	for _, test := range testCases {
+		req := httptest.NewRequest(test.Method, test.Path, strings.NewReader(test.Body))
+		req.Header.Set("Content-Type", test.ContentType)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		if recorder.Code != test.Status {
+			t.Errorf("%s %s: expected status %d, got %d %s", test.Method, test.Path, test.Status, recorder.Code, recorder.Body)
+		}
+	}
+
+	if ruleList := engine.Rules(); len(ruleList) != 3 {
+		t.Errorf("expected 3 rules, got %v", ruleList)
+	}
+}
@@ -2,17 +2,196 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/antima/moody-core/pkg/mqtt"
+	"github.com/gorilla/mux"
 )
 
-func getServices(services *mqtt.ServiceMap) func(http.ResponseWriter, *http.Request) {
+const serviceManagerComponent = "service manager"
+
+func getServices(manager *mqtt.ServiceManager) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if manager == nil {
+			writeNotEnabled(w, r, serviceManagerComponent)
+			return
+		}
+
+		serviceList := manager.Statuses()
+		writeJson(w, http.StatusOK, &serviceList)
+	}
+}
+
+func getService(manager *mqtt.ServiceManager) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if manager == nil {
+			writeNotEnabled(w, r, serviceManagerComponent)
+			return
+		}
+
+		vars := mux.Vars(r)
+		status, err := manager.Status(vars["name"])
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, err.Error())
+			return
+		}
+		writeJson(w, http.StatusOK, &status)
+	}
+}
+
+// maxArtifactSize limits the size of the uploaded service artifacts
+const maxArtifactSize = 64 << 20
+
+// postService installs the service artifact uploaded as the service
+// field of a multipart form, named after the uploaded file, the manifest
+// of a process service is sent as JSON in the manifest field
+func postService(manager *mqtt.ServiceManager) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if manager == nil {
+			writeNotEnabled(w, r, serviceManagerComponent)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxArtifactSize)
+		artifact, header, err := r.FormFile("service")
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		defer artifact.Close()
+
+		var manifest *mqtt.ServiceManifest
+		if encoded := r.FormValue("manifest"); encoded != "" {
+			manifest = &mqtt.ServiceManifest{}
+			if err := json.Unmarshal([]byte(encoded), manifest); err != nil {
+				writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+				return
+			}
+		}
+
+		status, err := manager.Install(header.Filename, artifact, manifest)
+		switch {
+		case errors.Is(err, mqtt.ErrInstallDisabled):
+			writeNotEnabled(w, r, "service installation")
+		case errors.Is(err, mqtt.ErrInvalidServiceName), errors.Is(err, mqtt.ErrUnsupportedService), errors.Is(err, mqtt.ErrInvalidArtifact):
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		case err != nil:
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, err.Error())
+		case status.State == mqtt.ServiceFailed:
+			writeJson(w, http.StatusInternalServerError, &status)
+		default:
+			writeJson(w, http.StatusCreated, &status)
+		}
+	}
+}
+
+func deleteService(manager *mqtt.ServiceManager) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if manager == nil {
+			writeNotEnabled(w, r, serviceManagerComponent)
+			return
+		}
+
+		vars := mux.Vars(r)
+		if err := manager.Uninstall(vars["name"]); err == mqtt.ErrUnknownService {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func getServiceConfig(manager *mqtt.ServiceManager) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if manager == nil {
+			writeNotEnabled(w, r, serviceManagerComponent)
+			return
+		}
+
+		vars := mux.Vars(r)
+		config, configSchema, err := manager.Config(vars["name"])
+		if err == mqtt.ErrUnknownService {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, err.Error())
+			return
+		}
+
+		configResp := ServiceConfigResp{Config: config, Schema: configSchema}
+		writeJson(w, http.StatusOK, &configResp)
+	}
+}
+
+// putServiceConfig replaces the configuration of a service, answering
+// with the status of the service restarted with the new configuration
+func putServiceConfig(manager *mqtt.ServiceManager) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-type", "application/json")
-		serviceList := services.List()
-		if err := json.NewEncoder(w).Encode(&serviceList); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if manager == nil {
+			writeNotEnabled(w, r, serviceManagerComponent)
+			return
+		}
+
+		config := mqtt.ServiceConfig{}
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+
+		vars := mux.Vars(r)
+		status, err := manager.SetConfig(vars["name"], config)
+		switch {
+		case err == mqtt.ErrUnknownService:
+			writeError(w, r, http.StatusNotFound, CodeNotFound, err.Error())
+		case errors.Is(err, mqtt.ErrInvalidConfig):
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		case err != nil:
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, err.Error())
+		case status.State == mqtt.ServiceFailed:
+			writeJson(w, http.StatusInternalServerError, &status)
+		default:
+			writeJson(w, http.StatusOK, &status)
+		}
+	}
+}
+
+// controlService applies a lifecycle action (start, stop or reload) to a
+// service, answering with its resulting status
+func controlService(manager *mqtt.ServiceManager) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if manager == nil {
+			writeNotEnabled(w, r, serviceManagerComponent)
+			return
+		}
+
+		vars := mux.Vars(r)
+		var action func(string) (mqtt.ServiceStatus, error)
+		switch vars["action"] {
+		case "start":
+			action = manager.StartService
+		case "stop":
+			action = manager.StopService
+		case "reload":
+			action = manager.ReloadService
+		default:
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "unknown service action "+vars["action"])
+			return
+		}
+
+		status, err := action(vars["name"])
+		switch {
+		case err == mqtt.ErrUnknownService:
+			writeError(w, r, http.StatusNotFound, CodeNotFound, err.Error())
+		case err != nil:
+			writeError(w, r, http.StatusConflict, CodeConflict, err.Error())
+		case status.State == mqtt.ServiceFailed:
+			writeJson(w, http.StatusInternalServerError, &status)
+		default:
+			writeJson(w, http.StatusOK, &status)
 		}
 	}
 }
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the browsers refuse the server certificates valid for longer
+	selfSignedValidity = 397 * 24 * time.Hour
+	selfSignedRenewal  = 30 * 24 * time.Hour
+	defaultHttpsPort   = "443"
+)
+
+var (
+	ErrInvalidApiTls = fmt.Errorf("the API TLS configuration is not valid")
+)
+
+// TlsOptions configure the API server to serve HTTPS with the certificate
+// and key files. If SelfSigned is set and the files do not exist yet, they
+// are created with a self-signed certificate, that is renewed when it is
+// about to expire. If RedirectAddr is set, a plain
+// HTTP server on that address redirects every request to the HTTPS one.
+type TlsOptions struct {
+	CertFile     string
+	KeyFile      string
+	SelfSigned   bool
+	RedirectAddr string
+}
+
+// Validate checks that both the certificate and key files are set
+func (options *TlsOptions) Validate() error {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return fmt.Errorf("%w: the certificate and key files must be passed together", ErrInvalidApiTls)
+	}
+	return nil
+}
+
+// ensureCertificate creates the self-signed certificate and its key if they
+// are requested and the files do not exist yet, or the existing self-signed
+// certificate expires in less than selfSignedRenewal
+func (options *TlsOptions) ensureCertificate(now time.Time) error {
+	if !options.SelfSigned {
+		return nil
+	}
+
+	_, certErr := os.Stat(options.CertFile)
+	_, keyErr := os.Stat(options.KeyFile)
+	if certErr == nil && keyErr == nil {
+		expiring, err := selfSignedExpiring(options.CertFile, now)
+		if err != nil || !expiring {
+			return err
+		}
+
+		log.Printf("renewing the self-signed certificate in %s\n", options.CertFile)
+		return generateSelfSigned(options.CertFile, options.KeyFile, now)
+	}
+
+	if !os.IsNotExist(certErr) && certErr != nil {
+		return certErr
+	}
+	if !os.IsNotExist(keyErr) && keyErr != nil {
+		return keyErr
+	}
+
+	log.Printf("generating a self-signed certificate in %s\n", options.CertFile)
+	return generateSelfSigned(options.CertFile, options.KeyFile, now)
+}
+
+// selfSignedExpiring reports whether the certificate in the file is a
+// self-signed one that expires in less than selfSignedRenewal, the
+// certificates issued by someone else are never replaced
+func selfSignedExpiring(certFile string, now time.Time) (bool, error) {
+	cert, err := readCertificate(certFile)
+	if err != nil {
+		return false, err
+	}
+
+	if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return false, nil
+	}
+	return now.Add(selfSignedRenewal).After(cert.NotAfter), nil
+}
+
+func readCertificate(certFile string) (*x509.Certificate, error) {
+	content, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%w: %s does not contain a certificate", ErrInvalidApiTls, certFile)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// selfSignedCertificate serves the self-signed certificate to the TLS
+// handshakes, renewing it while the server is running
+type selfSignedCertificate struct {
+	options *TlsOptions
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	expiry  time.Time
+}
+
+func (certificate *selfSignedCertificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate.mutex.Lock()
+	defer certificate.mutex.Unlock()
+
+	now := time.Now()
+	if certificate.cert != nil && now.Add(selfSignedRenewal).Before(certificate.expiry) {
+		return certificate.cert, nil
+	}
+
+	if err := certificate.options.ensureCertificate(now); err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.LoadX509KeyPair(certificate.options.CertFile, certificate.options.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	certificate.cert = &pair
+	certificate.expiry = leaf.NotAfter
+	return certificate.cert, nil
+}
+
+// generateSelfSigned writes a self-signed leaf certificate valid for the
+// host name, localhost and the addresses of the local interfaces, along
+// with its key, readable only by the owner
+func generateSelfSigned(certFile string, keyFile string, now time.Time) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"moody"}, CommonName: "moody-core"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity - time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname, hostname+".local")
+	}
+
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, isIpNet := addr.(*net.IPNet); isIpNet && !ipNet.IP.IsLoopback() {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := writePem(keyFile, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	return writePem(certFile, "CERTIFICATE", der, 0644)
+}
+
+// writePem writes a PEM block to the file, the permissions of an existing
+// file are changed before it is written
+func writePem(filename string, blockType string, der []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if err := file.Chmod(perm); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// redirectToHttps redirects the requests to the same URL on the HTTPS
+// server listening on the passed address, preserving the method
+func redirectToHttps(httpsAddr string) http.HandlerFunc {
+	_, httpsPort, err := net.SplitHostPort(httpsAddr)
+	if err != nil {
+		httpsPort = defaultHttpsPort
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+
+		// the brackets of an IPv6 host are kept when the default port is trimmed
+		host = strings.TrimSuffix(net.JoinHostPort(host, httpsPort), ":"+defaultHttpsPort)
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	}
+}
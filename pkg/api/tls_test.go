@@ -0,0 +1,139 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTlsOptions_Validate(t *testing.T) {
+	testCases := []struct {
+		Options  TlsOptions
+		Expected error
+	}{
+		{TlsOptions{CertFile: "cert.pem", KeyFile: "key.pem"}, nil},
+		{TlsOptions{CertFile: "cert.pem"}, ErrInvalidApiTls},
+		{TlsOptions{KeyFile: "key.pem", SelfSigned: true}, ErrInvalidApiTls},
+	}
+
+	for _, test := range testCases {
+		if err := test.Options.Validate(); !errors.Is(err, test.Expected) {
+			t.Errorf("expected %v for %+v, got %v", test.Expected, test.Options, err)
+		}
+	}
+}
+
+func TestTlsOptions_ensureCertificate(t *testing.T) {
+	dir := t.TempDir()
+	options := &TlsOptions{
+		CertFile:   filepath.Join(dir, "tls", "cert.pem"),
+		KeyFile:    filepath.Join(dir, "tls", "key.pem"),
+		SelfSigned: true,
+	}
+
+	now := time.Now().Add(-90 * 24 * time.Hour).Truncate(time.Second)
+	if err := options.ensureCertificate(now); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	pair, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+	if err != nil {
+		t.Fatalf("expected a valid key pair, got %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil || cert.VerifyHostname("localhost") != nil {
+		t.Fatalf("expected a certificate valid for localhost, got %v", err)
+	}
+
+	if cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign != 0 {
+		t.Errorf("expected a leaf certificate, got a CA one")
+	}
+	if !cert.NotBefore.Equal(now.Add(-time.Hour)) {
+		t.Errorf("expected a certificate valid from %v, got %v", now.Add(-time.Hour), cert.NotBefore)
+	}
+	if validity := cert.NotAfter.Sub(cert.NotBefore); validity > 397*24*time.Hour {
+		t.Errorf("expected a certificate valid for 397 days at most, got %v", validity)
+	}
+
+	if info, err := os.Stat(options.KeyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the key to be readable only by the owner, got %v", info.Mode())
+	}
+
+	// the certificate is generated on the first boot only
+	generated, _ := os.ReadFile(options.CertFile)
+	if err := options.ensureCertificate(now.Add(300 * 24 * time.Hour)); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if kept, _ := os.ReadFile(options.CertFile); string(kept) != string(generated) {
+		t.Errorf("expected the existing certificate to be kept")
+	}
+
+	// and renewed when it is about to expire, fixing the permissions of the key
+	if err := os.Chmod(options.KeyFile, 0644); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	renewal := now.Add(380 * 24 * time.Hour)
+	if err := options.ensureCertificate(renewal); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if renewed, err := readCertificate(options.CertFile); err != nil || !renewed.NotAfter.After(renewal.Add(300*24*time.Hour)) {
+		t.Errorf("expected the certificate to be renewed, got %v", err)
+	}
+	if info, err := os.Stat(options.KeyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the key to be readable only by the owner, got %v", info.Mode())
+	}
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certificate := &selfSignedCertificate{options: &TlsOptions{
+		CertFile:   filepath.Join(dir, "cert.pem"),
+		KeyFile:    filepath.Join(dir, "key.pem"),
+		SelfSigned: true,
+	}}
+
+	// a certificate about to expire is renewed on the next handshake
+	if err := generateSelfSigned(certificate.options.CertFile, certificate.options.KeyFile, time.Now().Add(-380*24*time.Hour)); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	cert, err := certificate.get(nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if !certificate.expiry.After(time.Now().Add(selfSignedRenewal)) {
+		t.Errorf("expected the certificate to be renewed, it expires on %v", certificate.expiry)
+	}
+	if cached, _ := certificate.get(nil); cached != cert {
+		t.Errorf("expected the certificate to be cached")
+	}
+}
+
+func TestRedirectToHttps(t *testing.T) {
+	testCases := []struct {
+		HttpsAddr string
+		Url       string
+		Expected  string
+	}{
+		{":8443", "http://moody.local:8080/api/device?x=1", "https://moody.local:8443/api/device?x=1"},
+		{":443", "http://moody.local/api/topic", "https://moody.local/api/topic"},
+		{"0.0.0.0:8443", "http://192.168.1.2/api/rule", "https://192.168.1.2:8443/api/rule"},
+		{":443", "http://[::1]:80/api/device", "https://[::1]/api/device"},
+		{":443", "http://[::1]/api/device", "https://[::1]/api/device"},
+		{":8443", "http://[fe80::1]:8080/api/device", "https://[fe80::1]:8443/api/device"},
+	}
+
+	for _, test := range testCases {
+		w := httptest.NewRecorder()
+		redirectToHttps(test.HttpsAddr)(w, httptest.NewRequest("PUT", test.Url, nil))
+		if location := w.Header().Get("Location"); w.Code != 308 || location != test.Expected {
+			t.Errorf("expected a redirect to %s, got %d %s", test.Expected, w.Code, location)
+		}
+	}
+}
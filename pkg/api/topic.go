@@ -0,0 +1,145 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/antima/moody-core/pkg/history"
+	"github.com/antima/moody-core/pkg/mqtt"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultAggregationInterval = time.Minute
+	wildcardTopicMessage       = "the topic can't contain wildcards"
+)
+
+func getTopics(dataTable *mqtt.DataTable) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		topics := TopicsResp{Topics: dataTable.Topics()}
+		writeJson(w, http.StatusOK, &topics)
+	}
+}
+
+func getTopic(dataTable *mqtt.DataTable) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if mqtt.IsWildcard(vars["topic"]) {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, wildcardTopicMessage)
+			return
+		}
+
+		snapshot, exists := dataTable.Snapshot(vars["topic"])
+		if !exists {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "no state was received on the topic")
+			return
+		}
+
+		topicResp := TopicResp{
+			Topic:    vars["topic"],
+			Broker:   snapshot.Source,
+			State:    snapshot.State,
+			Value:    snapshot.Value,
+			Received: snapshot.Updated,
+			Retained: snapshot.Retained,
+		}
+		writeJson(w, http.StatusOK, &topicResp)
+	}
+}
+
+func getTopicHistory(store *history.Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			writeNotEnabled(w, r, "history")
+			return
+		}
+
+		vars := mux.Vars(r)
+		if mqtt.IsWildcard(vars["topic"]) {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, wildcardTopicMessage)
+			return
+		}
+
+		query, err := parseHistoryQuery(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+
+		samples, err := store.Query(vars["topic"], query.from, query.to, 0)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, err.Error())
+			return
+		}
+
+		samples, err = history.Aggregate(samples, query.interval, query.aggregation)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+
+		if query.limit > 0 && len(samples) > query.limit {
+			samples = samples[len(samples)-query.limit:]
+		}
+
+		historyResp := HistoryResp{
+			Topic:   vars["topic"],
+			Samples: samples,
+		}
+		writeJson(w, http.StatusOK, &historyResp)
+	}
+}
+
+type historyQuery struct {
+	from        time.Time
+	to          time.Time
+	limit       int
+	interval    time.Duration
+	aggregation history.Aggregation
+}
+
+// parseHistoryQuery reads the from, to, limit, agg and interval query
+// parameters, all of them are optional
+func parseHistoryQuery(r *http.Request) (*historyQuery, error) {
+	values := r.URL.Query()
+	query := &historyQuery{
+		interval:    defaultAggregationInterval,
+		aggregation: history.Aggregation(values.Get("agg")),
+	}
+
+	var err error
+	if query.from, err = parseTime(values.Get("from")); err != nil {
+		return nil, err
+	}
+
+	if query.to, err = parseTime(values.Get("to")); err != nil {
+		return nil, err
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		if query.limit, err = strconv.Atoi(limit); err != nil {
+			return nil, err
+		}
+	}
+
+	if interval := values.Get("interval"); interval != "" {
+		if query.interval, err = time.ParseDuration(interval); err != nil {
+			return nil, err
+		}
+	}
+	return query, nil
+}
+
+// parseTime accepts either an RFC3339 string or a unix timestamp
+// in seconds, an empty value is returned as the zero time
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/antima/moody-core/pkg/history"
+	"github.com/antima/moody-core/pkg/mqtt"
+	"github.com/gorilla/mux"
+)
+
+func topicRouter(dataTable *mqtt.DataTable, store *history.Store) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/topic", getTopics(dataTable)).Methods("GET")
+	router.HandleFunc("/api/topic/{topic:.+}", getTopic(dataTable)).Methods("GET")
+	router.HandleFunc("/api/history/{topic:.+}", getTopicHistory(store)).Methods("GET")
+	return router
+}
+
+func TestTopicHandlers(t *testing.T) {
+	store, err := history.NewStore(t.TempDir(), history.Policy{})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer store.Stop()
+
+	dataTable := mqtt.NewDataTable()
+	dataTable.SetRecorder(store)
+	dataTable.Add("moody/device/kitchen/temp", "21.5")
+
+	testCases := []struct {
+		Store  *history.Store
+		Path   string
+		Status int
+		Code   ErrorCode
+	}{
+		{store, "/api/topic", http.StatusOK, ""},
+		{store, "/api/topic/moody/device/kitchen/temp", http.StatusOK, ""},
+		{store, "/api/topic/moody/device/kitchen/humidity", http.StatusNotFound, CodeNotFound},
+		{store, "/api/topic/moody/device/%23", http.StatusBadRequest, CodeInvalidRequest},
+		{store, "/api/topic/moody/+/kitchen/temp", http.StatusBadRequest, CodeInvalidRequest},
+		{store, "/api/history/moody/device/kitchen/temp", http.StatusOK, ""},
+		{store, "/api/history/moody/device/kitchen/humidity", http.StatusOK, ""},
+		{store, "/api/history/moody/device/%23", http.StatusBadRequest, CodeInvalidRequest},
+		{store, "/api/history/moody/device/kitchen/temp?from=yesterday", http.StatusBadRequest, CodeInvalidRequest},
+		{nil, "/api/history/moody/device/kitchen/temp", http.StatusNotFound, CodeNotEnabled},
+	}
+
+	for _, test := range testCases {
+		recorder := httptest.NewRecorder()
+		topicRouter(dataTable, test.Store).ServeHTTP(recorder, httptest.NewRequest("GET", test.Path, nil))
+		if recorder.Code != test.Status {
+			t.Errorf("%s: expected status %d, got %d", test.Path, test.Status, recorder.Code)
+			continue
+		}
+
+		if test.Code == "" {
+			continue
+		}
+
+		errResp := ErrorResp{}
+		if err := json.NewDecoder(recorder.Body).Decode(&errResp); err != nil || errResp.Code != test.Code {
+			t.Errorf("%s: expected %s, got %s %v", test.Path, test.Code, errResp.Code, err)
+		}
+	}
+}
+
+func TestGetTopic(t *testing.T) {
+	dataTable := mqtt.NewDataTable()
+	dataTable.AddFrom("local", "moody/device/kitchen/temp", "21.5", true)
+
+	recorder := httptest.NewRecorder()
+	topicRouter(dataTable, nil).ServeHTTP(recorder, httptest.NewRequest("GET", "/api/topic/moody/device/kitchen/temp", nil))
+
+	topicResp := TopicResp{}
+	if err := json.NewDecoder(recorder.Body).Decode(&topicResp); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	if topicResp.Topic != "moody/device/kitchen/temp" || topicResp.State != "21.5" || topicResp.Broker != "local" || !topicResp.Retained {
+		t.Errorf("expected the retained 21.5 state from local, got %+v", topicResp)
+	}
+}
+
+func TestGetTopicHistory(t *testing.T) {
+	store, err := history.NewStore(t.TempDir(), history.Policy{})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer store.Stop()
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	for idx, state := range []string{"20", "21", "22"} {
+		_ = store.Record("moody/device/kitchen/temp", state, start.Add(time.Duration(idx)*time.Minute))
+	}
+
+	recorder := httptest.NewRecorder()
+	path := "/api/history/moody/device/kitchen/temp?limit=2"
+	topicRouter(mqtt.NewDataTable(), store).ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+
+	historyResp := HistoryResp{}
+	if err := json.NewDecoder(recorder.Body).Decode(&historyResp); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	if len(historyResp.Samples) != 2 || historyResp.Samples[1].Value != "22" {
+		t.Errorf("expected the last two samples, got %v", historyResp.Samples)
+	}
+}
@@ -0,0 +1,133 @@
+package history
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Aggregation identifies a function used to summarize the
+// samples falling in the same time bucket
+type Aggregation string
+
+const (
+	AggregationNone  Aggregation = ""
+	AggregationMean  Aggregation = "mean"
+	AggregationMin   Aggregation = "min"
+	AggregationMax   Aggregation = "max"
+	AggregationSum   Aggregation = "sum"
+	AggregationCount Aggregation = "count"
+	AggregationFirst Aggregation = "first"
+	AggregationLast  Aggregation = "last"
+)
+
+var (
+	ErrUnknownAggregation = errors.New("unknown aggregation function")
+	ErrInvalidInterval    = errors.New("the aggregation interval must be positive")
+)
+
+// Aggregate groups the passed samples in buckets of the passed interval
+// and summarizes each one with the requested function. The numeric
+// functions ignore the values that can't be parsed as a number and
+// skip the buckets that do not contain any.
+func Aggregate(samples []Sample, interval time.Duration, aggregation Aggregation) ([]Sample, error) {
+	if aggregation == AggregationNone {
+		return samples, nil
+	}
+
+	if interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+
+	reduce, err := reducer(aggregation)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Sample{}
+	start := 0
+	for idx := 1; idx <= len(samples); idx++ {
+		if idx < len(samples) && samples[idx].Time.Truncate(interval).Equal(samples[start].Time.Truncate(interval)) {
+			continue
+		}
+		if value, ok := reduce(samples[start:idx]); ok {
+			result = append(result, Sample{
+				Time:  samples[start].Time.Truncate(interval),
+				Value: value,
+			})
+		}
+		start = idx
+	}
+	return result, nil
+}
+
+func reducer(aggregation Aggregation) (func([]Sample) (string, bool), error) {
+	switch aggregation {
+	case AggregationCount:
+		return func(bucket []Sample) (string, bool) {
+			return strconv.Itoa(len(bucket)), true
+		}, nil
+	case AggregationFirst:
+		return func(bucket []Sample) (string, bool) {
+			return bucket[0].Value, true
+		}, nil
+	case AggregationLast:
+		return func(bucket []Sample) (string, bool) {
+			return bucket[len(bucket)-1].Value, true
+		}, nil
+	case AggregationMean:
+		return numericReducer(func(values []float64) float64 {
+			var sum float64
+			for _, value := range values {
+				sum += value
+			}
+			return sum / float64(len(values))
+		}), nil
+	case AggregationSum:
+		return numericReducer(func(values []float64) float64 {
+			var sum float64
+			for _, value := range values {
+				sum += value
+			}
+			return sum
+		}), nil
+	case AggregationMin:
+		return numericReducer(func(values []float64) float64 {
+			min := values[0]
+			for _, value := range values[1:] {
+				if value < min {
+					min = value
+				}
+			}
+			return min
+		}), nil
+	case AggregationMax:
+		return numericReducer(func(values []float64) float64 {
+			max := values[0]
+			for _, value := range values[1:] {
+				if value > max {
+					max = value
+				}
+			}
+			return max
+		}), nil
+	default:
+		return nil, ErrUnknownAggregation
+	}
+}
+
+func numericReducer(reduce func([]float64) float64) func([]Sample) (string, bool) {
+	return func(bucket []Sample) (string, bool) {
+		var values []float64
+		for _, sample := range bucket {
+			value, err := strconv.ParseFloat(sample.Value, 64)
+			if err == nil {
+				values = append(values, value)
+			}
+		}
+		if len(values) == 0 {
+			return "", false
+		}
+		return strconv.FormatFloat(reduce(values), 'f', -1, 64), true
+	}
+}
@@ -0,0 +1,52 @@
+package history
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAggregate(t *testing.T) {
+	start := time.Unix(1600000000, 0).Truncate(time.Minute)
+	samples := []Sample{
+		{start, "1"},
+		{start.Add(10 * time.Second), "3"},
+		{start.Add(20 * time.Second), "off"},
+		{start.Add(time.Minute), "5"},
+		{start.Add(2 * time.Minute), "on"},
+	}
+
+	testCases := []struct {
+		Aggregation Aggregation
+		Expected    []string
+	}{
+		{AggregationMean, []string{"2", "5"}},
+		{AggregationMin, []string{"1", "5"}},
+		{AggregationMax, []string{"3", "5"}},
+		{AggregationSum, []string{"4", "5"}},
+		{AggregationCount, []string{"3", "1", "1"}},
+		{AggregationFirst, []string{"1", "5", "on"}},
+		{AggregationLast, []string{"off", "5", "on"}},
+	}
+
+	for _, test := range testCases {
+		aggregated, err := Aggregate(samples, time.Minute, test.Aggregation)
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if len(aggregated) != len(test.Expected) {
+			t.Fatalf("%s: expected %d samples, got %d", test.Aggregation, len(test.Expected), len(aggregated))
+		}
+		for idx, sample := range aggregated {
+			if sample.Value != test.Expected[idx] {
+				t.Errorf("%s: expected %s, got %s", test.Aggregation, test.Expected[idx], sample.Value)
+			}
+		}
+	}
+
+	if _, err := Aggregate(samples, time.Minute, "median"); err != ErrUnknownAggregation {
+		t.Errorf("expected %v, got %v", ErrUnknownAggregation, err)
+	}
+	if _, err := Aggregate(samples, 0, AggregationMean); err != ErrInvalidInterval {
+		t.Errorf("expected %v, got %v", ErrInvalidInterval, err)
+	}
+}
@@ -0,0 +1,441 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileExt         = ".jsonl"
+	maxRecordLength = 1024 * 1024
+	compactInterval = 10 * time.Minute
+	writeQueueSize  = 1024
+)
+
+var (
+	ErrEmptyDir    = errors.New("the history directory can't be empty")
+	ErrEmptyTopic  = errors.New("the topic of a sample can't be empty")
+	ErrInvalidRule = errors.New("the downsample interval must be set when downsampling is enabled")
+	ErrQueueFull   = errors.New("the history write queue is full")
+	ErrStopped     = errors.New("the history store is stopped")
+)
+
+// Sample is a single state recorded for a topic at a given time
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Value string    `json:"value"`
+}
+
+// record is the on-disk representation of a Sample
+type record struct {
+	Timestamp int64  `json:"t"`
+	Value     string `json:"v"`
+}
+
+// Policy describes how long samples are kept in the store and how
+// they get downsampled as they age. A zero Retention keeps samples
+// forever, a zero DownsampleAfter disables downsampling.
+type Policy struct {
+	Retention          time.Duration
+	DownsampleAfter    time.Duration
+	DownsampleInterval time.Duration
+}
+
+// write is a sample queued for the writer of the store, a write
+// without a line only signals its done channel once it is reached
+type write struct {
+	topic string
+	line  []byte
+	done  chan bool
+}
+
+// Store is an embedded, file-backed time-series store that keeps
+// one append-only file per topic inside its directory. The samples
+// are appended by a writer goroutine, so that recording a sample
+// never waits on the disk.
+type Store struct {
+	dir        string
+	policy     Policy
+	mutex      sync.Mutex
+	files      map[string]*os.File
+	writes     chan write
+	writerDone chan bool
+	stopChan   chan bool
+}
+
+// NewStore opens (or creates) a store in the passed directory, applying
+// the passed retention and downsampling policy during compaction
+func NewStore(dir string, policy Policy) (*Store, error) {
+	if dir == "" {
+		return nil, ErrEmptyDir
+	}
+
+	if policy.DownsampleAfter > 0 && policy.DownsampleInterval <= 0 {
+		return nil, ErrInvalidRule
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	store := &Store{
+		dir:        dir,
+		policy:     policy,
+		files:      make(map[string]*os.File),
+		writes:     make(chan write, writeQueueSize),
+		writerDone: make(chan bool),
+		stopChan:   make(chan bool),
+	}
+	go store.writer()
+	return store, nil
+}
+
+// Record queues a new sample for the passed topic, it is appended to the
+// store in the background. The sample is dropped if the queue is full.
+func (store *Store) Record(topic string, state string, timestamp time.Time) error {
+	if topic == "" {
+		return ErrEmptyTopic
+	}
+
+	line, err := json.Marshal(&record{Timestamp: timestamp.UnixNano(), Value: state})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-store.stopChan:
+		return ErrStopped
+	default:
+	}
+
+	select {
+	case store.writes <- write{topic: topic, line: append(line, '\n')}:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// writer appends the queued samples until the store is stopped,
+// writing the samples still in the queue before returning
+func (store *Store) writer() {
+	defer close(store.writerDone)
+	for {
+		select {
+		case next := <-store.writes:
+			store.write(next)
+		case <-store.stopChan:
+			for {
+				select {
+				case next := <-store.writes:
+					store.write(next)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (store *Store) write(next write) {
+	if next.done != nil {
+		close(next.done)
+		return
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	file, err := store.openFile(next.topic)
+	if err == nil {
+		_, err = file.Write(next.line)
+	}
+
+	if err != nil {
+		log.Printf("error: could not record the state of %s, %v\n", next.topic, err)
+	}
+}
+
+// flush waits for the samples queued so far to be written
+func (store *Store) flush() {
+	done := make(chan bool)
+	select {
+	case store.writes <- write{done: done}:
+	case <-store.stopChan:
+		return
+	}
+
+	select {
+	case <-done:
+	case <-store.writerDone:
+	}
+}
+
+// Query returns the samples of a topic received in the [from, to] time
+// range, in chronological order. A zero from or to leaves that end of the
+// range open; if limit is positive only the most recent limit samples
+// are returned.
+func (store *Store) Query(topic string, from time.Time, to time.Time, limit int) ([]Sample, error) {
+	store.flush()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	samples, err := store.readSamples(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := samples[:0]
+	for _, sample := range samples {
+		if !from.IsZero() && sample.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && sample.Time.After(to) {
+			continue
+		}
+		filtered = append(filtered, sample)
+	}
+
+	if limit > 0 && len(filtered) > limit {
+		filtered = filtered[len(filtered)-limit:]
+	}
+	return filtered, nil
+}
+
+// Topics returns the list of the topics that have a history in the store
+func (store *Store) Topics() []string {
+	store.flush()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var topics []string
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return topics
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != fileExt {
+			continue
+		}
+		topic, err := url.PathUnescape(strings.TrimSuffix(entry.Name(), fileExt))
+		if err == nil {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// Compact applies the retention and downsampling policy to every topic
+// in the store, rewriting each topic file atomically
+func (store *Store) Compact(now time.Time) error {
+	store.flush()
+	for _, topic := range store.Topics() {
+		if err := store.compactTopic(topic, now); err != nil {
+			return fmt.Errorf("could not compact the history of %s: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// Start periodically compacts the store in the background
+func (store *Store) Start() {
+	log.Printf("starting the history store in %s\n", store.dir)
+	go func() {
+		for {
+			select {
+			case <-time.After(compactInterval):
+				if err := store.Compact(time.Now()); err != nil {
+					log.Printf("error: %v\n", err)
+				}
+			case <-store.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop terminates the background compaction, writes the queued
+// samples and closes every open file
+func (store *Store) Stop() {
+	log.Println("stopping the history store")
+	close(store.stopChan)
+	<-store.writerDone
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for topic, file := range store.files {
+		_ = file.Close()
+		delete(store.files, topic)
+	}
+}
+
+func (store *Store) compactTopic(topic string, now time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	samples, err := store.readSamples(topic)
+	if err != nil {
+		return err
+	}
+
+	if store.policy.Retention > 0 {
+		oldest := now.Add(-store.policy.Retention)
+		kept := samples[:0]
+		for _, sample := range samples {
+			if !sample.Time.Before(oldest) {
+				kept = append(kept, sample)
+			}
+		}
+		samples = kept
+	}
+
+	if store.policy.DownsampleAfter > 0 {
+		// the cutoff is aligned to the interval so that a bucket never
+		// contains both raw and downsampled samples
+		cutoff := now.Add(-store.policy.DownsampleAfter).Truncate(store.policy.DownsampleInterval)
+		samples = downsample(samples, cutoff, store.policy.DownsampleInterval)
+	}
+
+	return store.rewriteFile(topic, samples)
+}
+
+// downsample groups the samples older than the cutoff in buckets of
+// the passed interval. Numeric buckets are averaged, any other bucket
+// keeps the latest value it received.
+func downsample(samples []Sample, cutoff time.Time, interval time.Duration) []Sample {
+	var result []Sample
+	var bucket []Sample
+
+	flush := func() {
+		if len(bucket) == 0 {
+			return
+		}
+		result = append(result, Sample{
+			Time:  bucket[0].Time.Truncate(interval),
+			Value: aggregate(bucket),
+		})
+		bucket = bucket[:0]
+	}
+
+	for _, sample := range samples {
+		if !sample.Time.Before(cutoff) {
+			flush()
+			result = append(result, sample)
+			continue
+		}
+		if len(bucket) > 0 && !sample.Time.Truncate(interval).Equal(bucket[0].Time.Truncate(interval)) {
+			flush()
+		}
+		bucket = append(bucket, sample)
+	}
+	flush()
+	return result
+}
+
+func aggregate(bucket []Sample) string {
+	var sum float64
+	for _, sample := range bucket {
+		value, err := strconv.ParseFloat(sample.Value, 64)
+		if err != nil {
+			return bucket[len(bucket)-1].Value
+		}
+		sum += value
+	}
+	return strconv.FormatFloat(sum/float64(len(bucket)), 'f', -1, 64)
+}
+
+func (store *Store) fileName(topic string) string {
+	return filepath.Join(store.dir, url.PathEscape(topic)+fileExt)
+}
+
+func (store *Store) openFile(topic string) (*os.File, error) {
+	if file, isOpen := store.files[topic]; isOpen {
+		return file, nil
+	}
+
+	file, err := os.OpenFile(store.fileName(topic), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store.files[topic] = file
+	return file, nil
+}
+
+func (store *Store) readSamples(topic string) ([]Sample, error) {
+	file, err := os.Open(store.fileName(topic))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Sample{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+
+	samples := []Sample{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 4096), maxRecordLength)
+	for scanner.Scan() {
+		var rec record
+		// a partially written line is skipped, it can only be the
+		// result of an unclean shutdown
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		samples = append(samples, Sample{Time: time.Unix(0, rec.Timestamp), Value: rec.Value})
+	}
+
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Time.Before(samples[j].Time)
+	})
+	return samples, scanner.Err()
+}
+
+func (store *Store) rewriteFile(topic string, samples []Sample) error {
+	tmpFile, err := os.CreateTemp(store.dir, "compact-*.tmp")
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmpFile)
+	for _, sample := range samples {
+		line, err := json.Marshal(&record{Timestamp: sample.Time.UnixNano(), Value: sample.Value})
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			_ = tmpFile.Close()
+			_ = os.Remove(tmpFile.Name())
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if file, isOpen := store.files[topic]; isOpen {
+		_ = file.Close()
+		delete(store.files, topic)
+	}
+	return os.Rename(tmpFile.Name(), store.fileName(topic))
+}
@@ -0,0 +1,130 @@
+package history
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStore_RecordQuery(t *testing.T) {
+	store, err := NewStore(t.TempDir(), Policy{})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer store.Stop()
+
+	start := time.Unix(1600000000, 0)
+	for idx := 0; idx < 10; idx++ {
+		if err := store.Record("moody/device/temp", fmt.Sprintf("%d", idx), start.Add(time.Duration(idx)*time.Minute)); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+	}
+
+	testCases := []struct {
+		From     time.Time
+		To       time.Time
+		Limit    int
+		Expected []string
+	}{
+		{time.Time{}, time.Time{}, 0, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}},
+		{start.Add(2 * time.Minute), start.Add(4 * time.Minute), 0, []string{"2", "3", "4"}},
+		{start.Add(5 * time.Minute), time.Time{}, 2, []string{"8", "9"}},
+		{start.Add(time.Hour), time.Time{}, 0, []string{}},
+	}
+
+	for _, test := range testCases {
+		samples, err := store.Query("moody/device/temp", test.From, test.To, test.Limit)
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if len(samples) != len(test.Expected) {
+			t.Fatalf("expected %d samples, got %d", len(test.Expected), len(samples))
+		}
+		for idx, sample := range samples {
+			if sample.Value != test.Expected[idx] {
+				t.Errorf("expected %s, got %s", test.Expected[idx], sample.Value)
+			}
+		}
+	}
+
+	topics := store.Topics()
+	if len(topics) != 1 || topics[0] != "moody/device/temp" {
+		t.Errorf("expected [moody/device/temp], got %v", topics)
+	}
+}
+
+func TestStore_Compact(t *testing.T) {
+	store, err := NewStore(t.TempDir(), Policy{
+		Retention:          time.Hour,
+		DownsampleAfter:    10 * time.Minute,
+		DownsampleInterval: 10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer store.Stop()
+
+	now := time.Unix(1600000000, 0).Truncate(10 * time.Minute)
+	for idx := 0; idx < 90; idx++ {
+		timestamp := now.Add(-time.Duration(idx) * time.Minute)
+		_ = store.Record("numeric", fmt.Sprintf("%d", idx%2), timestamp)
+		_ = store.Record("text", fmt.Sprintf("state%d", idx), timestamp)
+	}
+
+	if err := store.Compact(now); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	numeric, _ := store.Query("numeric", time.Time{}, time.Time{}, 0)
+	// 5 downsampled buckets in the (now-1h, now-10m] range, 11 raw samples
+	if len(numeric) != 16 {
+		t.Fatalf("expected 16 samples, got %d", len(numeric))
+	}
+	if numeric[0].Time.Before(now.Add(-time.Hour)) {
+		t.Errorf("expected samples newer than the retention, got %v", numeric[0].Time)
+	}
+	if numeric[0].Value != "0.5" {
+		t.Errorf("expected 0.5, got %s", numeric[0].Value)
+	}
+
+	text, _ := store.Query("text", time.Time{}, time.Time{}, 1)
+	if len(text) != 1 || text[0].Value != "state0" {
+		t.Errorf("expected [state0], got %v", text)
+	}
+
+	text, _ = store.Query("text", time.Time{}, now.Add(-55*time.Minute), 0)
+	if len(text) != 1 || text[0].Value != "state51" {
+		t.Errorf("expected [state51], got %v", text)
+	}
+}
+
+func TestStore_Stop(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir, Policy{})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	start := time.Unix(1600000000, 0)
+	for idx := 0; idx < 100; idx++ {
+		if err := store.Record("moody/device/temp", fmt.Sprintf("%d", idx), start.Add(time.Duration(idx)*time.Second)); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+	}
+	store.Stop()
+
+	if err := store.Record("moody/device/temp", "late", start); err != ErrStopped {
+		t.Errorf("expected %v, got %v", ErrStopped, err)
+	}
+
+	reopened, err := NewStore(dir, Policy{})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer reopened.Stop()
+
+	samples, _ := reopened.Query("moody/device/temp", time.Time{}, time.Time{}, 1)
+	if len(samples) != 1 || samples[0].Value != "99" {
+		t.Errorf("expected the queued samples to be written on stop, got %v", samples)
+	}
+}
@@ -6,12 +6,18 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"sync/atomic"
 	"time"
+
+	"github.com/antima/moody-core/pkg/value"
 )
 
 var (
 	NodeConnectionError  = errors.New("could not establish a connection with the model")
 	UnsupportedNodeError = errors.New("unsupported node type")
+	UnknownDeviceError   = errors.New("unknown device")
+	NotActuatorError     = errors.New("the device is not an actuator")
+	NotSensorError       = errors.New("the device is not a sensor")
 )
 
 type Endpoint string
@@ -48,21 +54,89 @@ type ConnectionPacket struct {
 
 // A DataPacket represents a packet returned by a data node endpoint
 type DataPacket struct {
-	Payload float64 `json:"payload"`
+	Payload value.Value `json:"payload"`
 }
 
-// A Device is a virtualization of a remote machine that can be synced
+// A Device is a virtualization of a remote machine that can be synced. Every
+// implementation embeds a Node, that identifies the remote machine.
 type Device interface {
-	sync() bool
+	// Sync updates the device with the remote machine, returning
+	// false if the machine could not be reached
+	Sync() bool
+	node() *Node
+}
+
+// A SensorDevice is a Device that can be read, the registered device
+// types implementing it are served as sensors
+type SensorDevice interface {
+	Device
+	// LastReading returns the latest successful reading of the sensor
+	LastReading() value.Value
+}
+
+// An ActuatorDevice is a Device that can be actuated, the registered
+// device types implementing it are served as actuators
+type ActuatorDevice interface {
+	Device
+	// State returns the last state requested for the actuator
+	State() value.Value
+	// Actuate sends the state to the remote machine, returning
+	// NodeConnectionError if it could not be reached
+	Actuate(state value.Value) error
+}
+
+// Liveness reports whether a node is reachable, it is updated by the monitor
+// and the syncs of the device while the API reads it, so it is accessed atomically
+type Liveness struct {
+	up int32
+}
+
+// NewLiveness returns the liveness of a node that is up or down
+func NewLiveness(up bool) Liveness {
+	liveness := Liveness{}
+	liveness.Set(up)
+	return liveness
+}
+
+// Get reports whether the node is up
+func (liveness *Liveness) Get() bool {
+	return atomic.LoadInt32(&liveness.up) == 1
+}
+
+// Set marks the node as up or down, returning true if it changed
+func (liveness *Liveness) Set(up bool) bool {
+	var state int32
+	if up {
+		state = 1
+	}
+	return atomic.SwapInt32(&liveness.up, state) != state
+}
+
+func (liveness *Liveness) MarshalJSON() ([]byte, error) {
+	return json.Marshal(liveness.Get())
+}
+
+func (liveness *Liveness) UnmarshalJSON(data []byte) error {
+	var up bool
+	if err := json.Unmarshal(data, &up); err != nil {
+		return err
+	}
+	liveness.Set(up)
+	return nil
 }
 
 // A Node is a generic remote model in the WSAN that implements the basic moody protocol
 // exposing tha /api/conn endpoint
 type Node struct {
-	isUp       bool
-	IpAddress  string `json:"ip"`
-	MacAddress string `json:"mac"`
-	Service    string `json:"service"`
+	IpAddress  string   `json:"ip"`
+	MacAddress string   `json:"mac"`
+	Service    string   `json:"service"`
+	Type       string   `json:"type"`
+	Up         Liveness `json:"up"`
+}
+
+func (n *Node) node() *Node {
+	return n
 }
 
 // NewDevice initializes a model for the first time from an ip string, returning an error
@@ -74,51 +148,46 @@ func NewDevice(ip string) (Device, error) {
 		return nil, NodeConnectionError
 	}
 
-	baseDev := Node{
-		isUp:       true,
+	factory, isRegistered := deviceFactory(connPkt.DeviceType)
+	if !isRegistered {
+		return nil, UnsupportedNodeError
+	}
+
+	return factory(Node{
 		IpAddress:  ip,
 		MacAddress: connPkt.MacAddress,
 		Service:    connPkt.Service,
-	}
-
-	switch connPkt.DeviceType {
-	case "sensor":
-		return &Sensor{
-			Node:        baseDev,
-			lastReading: 0,
-		}, nil
-	case "actuator":
-		return &Actuator{
-			Node:        baseDev,
-			syncChan:    make(chan bool),
-			stateSynced: true,
-			state:       0,
-		}, nil
-	default:
-		return nil, UnsupportedNodeError
-	}
+		Type:       connPkt.DeviceType,
+		Up:         NewLiveness(true),
+	}), nil
 }
 
 // A Sensor is a particular type of Node that can be queried for sensed data
 type Sensor struct {
 	Node
-	lastReading float64
+	lastReading value.Value
+}
+
+// Read syncs the sensor and returns its latest reading
+func (s *Sensor) Read() value.Value {
+	s.Sync()
+	return s.lastReading
 }
 
-func (s *Sensor) Read() float64 {
-	s.sync()
+// LastReading returns the latest successful reading of the sensor
+func (s *Sensor) LastReading() value.Value {
 	return s.lastReading
 }
 
-// sync attempts to get a new reading from the remote Sensor and either returns the new
+// Sync attempts to get a new reading from the remote Sensor and either returns the new
 // data if the Sensor responds, or returns the last successful reading
-func (s *Sensor) sync() bool {
+func (s *Sensor) Sync() bool {
 	dataPkt := DataPacket{}
 	res := getEndpointData(s.IpAddress, DataEndpoint, &dataPkt)
 	if res {
 		s.lastReading = dataPkt.Payload
 	}
-	s.isUp = res
+	s.Up.Set(res)
 	return res
 }
 
@@ -128,10 +197,11 @@ type Actuator struct {
 	Node
 	syncChan    chan bool
 	stateSynced bool
-	state       float64
+	state       value.Value
 }
 
-func (a *Actuator) State() float64 {
+// State returns the last state requested for the actuator
+func (a *Actuator) State() value.Value {
 	return a.state
 }
 
@@ -139,19 +209,22 @@ func (a *Actuator) StopSync() {
 	a.syncChan <- true
 }
 
-func (a *Actuator) Actuate(state float64) {
-	if state == a.state {
-		return
+// Actuate sends the passed state to the remote actuator, retrying in the
+// background until it is synced and returning NodeConnectionError if the
+// first attempt fails
+func (a *Actuator) Actuate(state value.Value) error {
+	if state.Equal(a.state) {
+		return nil
 	}
 
 	a.state = state
-	outcome := a.sync()
+	outcome := a.Sync()
 	if outcome {
 		if !a.stateSynced {
 			a.syncChan <- true
 			a.stateSynced = true
 		}
-		return
+		return nil
 	}
 
 	a.stateSynced = false
@@ -159,7 +232,7 @@ func (a *Actuator) Actuate(state float64) {
 		for {
 			select {
 			case <-time.After(10 * time.Second):
-				synced := act.sync()
+				synced := act.Sync()
 				if synced {
 					a.stateSynced = true
 					return
@@ -169,9 +242,10 @@ func (a *Actuator) Actuate(state float64) {
 			}
 		}
 	}(a)
+	return NodeConnectionError
 }
 
-func (a *Actuator) sync() bool {
+func (a *Actuator) Sync() bool {
 	client := http.Client{
 		Timeout: 5 * time.Second,
 	}
@@ -2,6 +2,8 @@ package http
 
 import (
 	"sync"
+
+	"github.com/antima/moody-core/pkg/value"
 )
 
 type DeviceEvent uint
@@ -37,6 +39,18 @@ func (list *DeviceList) Attach(obsChan chan<- DeviceMsg) {
 	list.observers = append(list.observers, obsChan)
 }
 
+// Detach an observer previously attached to the list
+func (list *DeviceList) Detach(obsChan chan<- DeviceMsg) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	for idx, observer := range list.observers {
+		if observer == obsChan {
+			list.observers = append(list.observers[:idx], list.observers[idx+1:]...)
+			break
+		}
+	}
+}
+
 func (list *DeviceList) Add(ip string, device Device) {
 	list.mutex.Lock()
 	defer list.mutex.Unlock()
@@ -95,6 +109,46 @@ func (list *DeviceList) ConnectedIPs() []string {
 		for ip := range list.devices {
 			list.namesCache = append(list.namesCache, ip)
 		}
+		list.changed = false
+	}
+
+	ips := make([]string, len(list.namesCache))
+	copy(ips, list.namesCache)
+	return ips
+}
+
+// Read syncs the sensor identified by the passed ip and returns its latest
+// reading, returning an error if there is no such device, if it is not a
+// sensor or if it can't be reached, along with its last successful reading
+func (list *DeviceList) Read(ip string) (value.Value, error) {
+	dev, exists := list.Get(ip)
+	if !exists {
+		return value.Value{}, UnknownDeviceError
+	}
+
+	sensor, isSensor := dev.(SensorDevice)
+	if !isSensor {
+		return value.Value{}, NotSensorError
+	}
+
+	if !sensor.Sync() {
+		return sensor.LastReading(), NodeConnectionError
+	}
+	return sensor.LastReading(), nil
+}
+
+// Actuate sets the state of the actuator identified by the passed ip, returning
+// an error if there is no such device, if it is not an actuator or if it can't
+// be reached, in which case the state is still synced in the background
+func (list *DeviceList) Actuate(ip string, state value.Value) error {
+	dev, exists := list.Get(ip)
+	if !exists {
+		return UnknownDeviceError
+	}
+
+	actuator, isActuator := dev.(ActuatorDevice)
+	if !isActuator {
+		return NotActuatorError
 	}
-	return list.namesCache
+	return actuator.Actuate(state)
 }
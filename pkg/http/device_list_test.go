@@ -1,9 +1,15 @@
 package http
 
 import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/antima/moody-core/pkg/value"
 )
 
 func TestNewDeviceList(t *testing.T) {
@@ -69,3 +75,97 @@ func TestDeviceList_Add(t *testing.T) {
 	}(obsChan, &wg)
 	wg.Wait()
 }
+
+func TestDeviceList_Read(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	unreachable := strings.TrimPrefix(closed.URL, "http://")
+	closed.Close()
+
+	list := NewDeviceList()
+	list.Add(unreachable, &Sensor{Node: Node{IpAddress: unreachable}})
+	list.Add("10.0.0.2", &Actuator{Node: Node{IpAddress: "10.0.0.2"}})
+	list.Add("10.0.0.3", &thermometer{Node: Node{IpAddress: "10.0.0.3"}})
+
+	testCases := []struct {
+		Ip       string
+		Expected error
+	}{
+		{"10.0.0.1", UnknownDeviceError},
+		{"10.0.0.2", NotSensorError},
+		{"10.0.0.3", nil},
+		{unreachable, NodeConnectionError},
+	}
+
+	for _, test := range testCases {
+		if _, err := list.Read(test.Ip); !errors.Is(err, test.Expected) {
+			t.Errorf("expected %v reading %s, got %v", test.Expected, test.Ip, err)
+		}
+	}
+}
+
+// thermometer and relay are device types registered by a user of the package
+type thermometer struct {
+	Node
+}
+
+func (th *thermometer) Sync() bool {
+	return true
+}
+
+func (th *thermometer) LastReading() value.Value {
+	return value.NewNumber(21)
+}
+
+type relay struct {
+	Node
+	state value.Value
+}
+
+func (r *relay) Sync() bool {
+	return true
+}
+
+func (r *relay) State() value.Value {
+	return r.state
+}
+
+func (r *relay) Actuate(state value.Value) error {
+	r.state = state
+	return nil
+}
+
+func TestDeviceList_Actuate(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	unreachable := strings.TrimPrefix(closed.URL, "http://")
+	closed.Close()
+
+	actuator := newActuator(Node{IpAddress: unreachable}).(*Actuator)
+	defer actuator.StopSync()
+
+	list := NewDeviceList()
+	list.Add(unreachable, actuator)
+	list.Add("10.0.0.2", &Sensor{Node: Node{IpAddress: "10.0.0.2"}})
+	list.Add("10.0.0.3", &relay{Node: Node{IpAddress: "10.0.0.3"}})
+
+	testCases := []struct {
+		Ip       string
+		Expected error
+	}{
+		{"10.0.0.1", UnknownDeviceError},
+		{"10.0.0.2", NotActuatorError},
+		{"10.0.0.3", nil},
+		{unreachable, NodeConnectionError},
+	}
+
+	on := value.NewNumber(1)
+	for _, test := range testCases {
+		if err := list.Actuate(test.Ip, on); !errors.Is(err, test.Expected) {
+			t.Errorf("expected %v actuating %s, got %v", test.Expected, test.Ip, err)
+		}
+	}
+
+	// the state of the unreachable actuator is still synced in the background
+	if !actuator.State().Equal(on) {
+		t.Errorf("expected %v, got %v", on, actuator.State())
+	}
+}
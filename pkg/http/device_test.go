@@ -8,6 +8,8 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/antima/moody-core/pkg/value"
 )
 
 func mockOkConn() *httptest.Server {
@@ -38,6 +40,20 @@ func mockWrongDeviceTypeConn() *httptest.Server {
 	return httptest.NewServer(router)
 }
 
+func mockDimmerConn() *httptest.Server {
+	router := http.NewServeMux()
+	router.HandleFunc("/api/conn", func(w http.ResponseWriter, r *http.Request) {
+		conn := ConnectionPacket{
+			DeviceType: "dimmer",
+			MacAddress: "aa:aa:aa:aa:aa:aa",
+			Service:    "example",
+		}
+		_ = json.NewEncoder(w).Encode(&conn)
+	})
+
+	return httptest.NewServer(router)
+}
+
 func mockSensor() *httptest.Server {
 	router := http.NewServeMux()
 	router.HandleFunc("/api/conn", func(w http.ResponseWriter, r *http.Request) {
@@ -51,7 +67,7 @@ func mockSensor() *httptest.Server {
 
 	router.HandleFunc("/api/data", func(w http.ResponseWriter, r *http.Request) {
 		n := rand.Float64()*1000 + 10
-		data := DataPacket{Payload: n}
+		data := DataPacket{Payload: value.NewNumber(n)}
 		_ = json.NewEncoder(w).Encode(&data)
 	})
 
@@ -132,14 +148,14 @@ func TestSensor_Read(t *testing.T) {
 	dev, _ := NewDevice(ip)
 	sensor := dev.(*Sensor)
 	val := sensor.Read()
-	if val == 0 {
-		t.Errorf("got 0, expected val != 0")
+	if val.Kind != value.Number || val.Number == 0 {
+		t.Errorf("got %v, expected val != 0", val)
 	}
 
 	server.Close()
 	newVal := sensor.Read()
-	if newVal != val {
-		t.Errorf("got %f, expected %f", newVal, val)
+	if !newVal.Equal(val) {
+		t.Errorf("got %v, expected %v", newVal, val)
 	}
 }
 
@@ -150,11 +166,57 @@ func TestActuator_SetState(t *testing.T) {
 
 	dev, _ := NewDevice(ip)
 	actuator := dev.(*Actuator)
-	val := 1500.0
+	val := value.NewNumber(1500.0)
 	actuator.Actuate(val)
 
-	if actuator.State() != val {
-		t.Errorf("expected %f, got %f", val, actuator.State())
+	if !actuator.State().Equal(val) {
+		t.Errorf("expected %v, got %v", val, actuator.State())
 	}
 
+	rgb := value.NewVector(255, 128, 0)
+	actuator.Actuate(rgb)
+
+	if !actuator.State().Equal(rgb) {
+		t.Errorf("expected %v, got %v", rgb, actuator.State())
+	}
+
+}
+
+type dimmer struct {
+	Node
+	Level float64 `json:"level"`
+}
+
+func (d *dimmer) Sync() bool {
+	return true
+}
+
+func TestRegisterDeviceType(t *testing.T) {
+	if err := RegisterDeviceType(SensorType, newSensor); err != ErrDuplicateDeviceType {
+		t.Errorf("got %s, expected %s", nillableErrorString(err), ErrDuplicateDeviceType)
+	}
+
+	err := RegisterDeviceType("dimmer", func(node Node) Device {
+		return &dimmer{Node: node, Level: 50}
+	})
+	if err != nil {
+		t.Fatalf("got %s, expected nil", err)
+	}
+	t.Cleanup(func() { unregisterDeviceType("dimmer") })
+
+	server := mockDimmerConn()
+	defer server.Close()
+	ipStart := strings.Index(server.URL, "://") + 3
+	ip := server.URL[ipStart:]
+
+	dev, err := NewDevice(ip)
+	if err != nil {
+		t.Fatalf("got %s, expected nil", err)
+	}
+
+	encoded, _ := json.Marshal(dev)
+	expected := `{"ip":"` + ip + `","mac":"aa:aa:aa:aa:aa:aa","service":"example","type":"dimmer","up":true,"level":50}`
+	if string(encoded) != expected {
+		t.Errorf("got %s, expected %s", encoded, expected)
+	}
 }
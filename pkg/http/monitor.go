@@ -4,22 +4,41 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/koron/go-ssdp"
 )
 
+const (
+	// defaultMaxAge is used when a node does not announce a max-age,
+	// it is the value suggested by the UPnP specification
+	defaultMaxAge   = 1800 * time.Second
+	probeInterval   = 30 * time.Second
+	maxFailedProbes = 3
+)
+
 type SsdpMonitor struct {
-	DeviceList     *DeviceList
-	notSyncedMutex sync.Mutex
-	NotSynced      []string
-	monitor        *ssdp.Monitor
+	DeviceList    *DeviceList
+	NotSynced     *RetryQueue
+	monitor       *ssdp.Monitor
+	livenessMutex sync.Mutex
+	expiries      map[string]time.Time
+	failedProbes  map[string]int
+	stopChan      chan bool
 }
 
-// TODO removal, management, fn this only adds nodes
+// NewMonitor creates a monitor that adds to the list the nodes announcing
+// themselves via SSDP, and removes them when they say goodbye, stop announcing
+// or fail too many consecutive health probes. The nodes that can't be synced
+// when they first announce themselves are retried in the background.
 func NewMonitor(list *DeviceList) *SsdpMonitor {
 	monitor := &SsdpMonitor{
-		DeviceList: list,
-		monitor:    &ssdp.Monitor{},
+		DeviceList:   list,
+		NotSynced:    NewRetryQueue(list),
+		monitor:      &ssdp.Monitor{},
+		expiries:     make(map[string]time.Time),
+		failedProbes: make(map[string]int),
+		stopChan:     make(chan bool),
 	}
 
 	monitor.monitor.Alive = func(m *ssdp.AliveMessage) {
@@ -29,17 +48,35 @@ func NewMonitor(list *DeviceList) *SsdpMonitor {
 		server := m.Server
 
 		if strings.Contains(server, "Arduino") {
+			maxAge := time.Duration(m.MaxAge()) * time.Second
+			if maxAge <= 0 {
+				maxAge = defaultMaxAge
+			}
+			monitor.refresh(ip, time.Now().Add(maxAge))
+
+			if _, exists := monitor.DeviceList.Get(ip); exists {
+				return
+			}
+
 			dev, err := NewDevice(ip)
 			if err != nil {
-				monitor.notSyncedMutex.Lock()
-				defer monitor.notSyncedMutex.Unlock()
-				monitor.NotSynced = append(monitor.NotSynced, ip)
+				monitor.NotSynced.Push(ip, err)
 				return
 			}
+			monitor.NotSynced.Remove(ip)
 			monitor.DeviceList.Add(ip, dev)
 		}
 	}
 
+	monitor.monitor.Bye = func(m *ssdp.ByeMessage) {
+		log.Printf("Bye: From=%s Type=%s USN=%s", m.From.String(), m.Type, m.USN)
+		ip := strings.Split(m.From.String(), ":")[0]
+		if _, exists := monitor.DeviceList.Get(ip); exists {
+			log.Printf("device %s said goodbye, removing it\n", ip)
+		}
+		monitor.remove(ip)
+	}
+
 	return monitor
 
 }
@@ -51,9 +88,95 @@ func (m *SsdpMonitor) Start() {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	m.NotSynced.Start()
+	go func() {
+		for {
+			select {
+			case <-time.After(probeInterval):
+				m.expireDevices(time.Now())
+				m.probeDevices()
+			case <-m.stopChan:
+				return
+			}
+		}
+	}()
 }
 
 func (m *SsdpMonitor) Stop() {
 	log.Println("stopping the SSDP monitor")
+	close(m.stopChan)
+	m.NotSynced.Stop()
 	_ = m.monitor.Close()
 }
+
+// refresh marks a device as alive until the passed expiry time
+func (m *SsdpMonitor) refresh(ip string, expiry time.Time) {
+	m.livenessMutex.Lock()
+	defer m.livenessMutex.Unlock()
+	m.expiries[ip] = expiry
+	m.failedProbes[ip] = 0
+
+	if dev, exists := m.DeviceList.Get(ip); exists {
+		dev.node().Up.Set(true)
+	}
+}
+
+// expireDevices removes the devices that did not renew their
+// SSDP announcement before their max-age elapsed
+func (m *SsdpMonitor) expireDevices(now time.Time) {
+	var expired []string
+	m.livenessMutex.Lock()
+	for ip, expiry := range m.expiries {
+		if now.After(expiry) {
+			expired = append(expired, ip)
+		}
+	}
+	m.livenessMutex.Unlock()
+
+	for _, ip := range expired {
+		log.Printf("device %s stopped announcing itself, removing it\n", ip)
+		m.remove(ip)
+	}
+}
+
+// probeDevices checks the connection endpoint of every device in the list,
+// marking the unresponsive ones as down and removing the devices that
+// failed too many consecutive probes
+func (m *SsdpMonitor) probeDevices() {
+	for _, ip := range m.DeviceList.ConnectedIPs() {
+		dev, exists := m.DeviceList.Get(ip)
+		if !exists {
+			continue
+		}
+
+		isUp := getEndpointData(ip, ConnectionEndpoint, &ConnectionPacket{})
+		if dev.node().Up.Set(isUp) {
+			log.Printf("device %s is now up=%v\n", ip, isUp)
+		}
+
+		m.livenessMutex.Lock()
+		if isUp {
+			m.failedProbes[ip] = 0
+		} else {
+			m.failedProbes[ip] += 1
+		}
+		failed := m.failedProbes[ip]
+		m.livenessMutex.Unlock()
+
+		if failed >= maxFailedProbes {
+			log.Printf("device %s failed %d health probes, removing it\n", ip, failed)
+			m.remove(ip)
+		}
+	}
+}
+
+func (m *SsdpMonitor) remove(ip string) {
+	m.livenessMutex.Lock()
+	delete(m.expiries, ip)
+	delete(m.failedProbes, ip)
+	m.livenessMutex.Unlock()
+
+	m.NotSynced.Remove(ip)
+	m.DeviceList.Remove(ip)
+}
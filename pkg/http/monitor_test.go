@@ -0,0 +1,121 @@
+package http
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSsdpMonitor_ExpireDevices(t *testing.T) {
+	obsChan := make(chan DeviceMsg, 2)
+	list := NewDeviceList()
+	list.Attach(obsChan)
+	monitor := NewMonitor(list)
+
+	now := time.Now()
+	list.Add("10.0.0.1", &Sensor{Node: Node{IpAddress: "10.0.0.1"}})
+	list.Add("10.0.0.2", &Sensor{Node: Node{IpAddress: "10.0.0.2"}})
+	<-obsChan
+	<-obsChan
+	monitor.refresh("10.0.0.1", now.Add(-time.Second))
+	monitor.refresh("10.0.0.2", now.Add(time.Minute))
+
+	monitor.expireDevices(now)
+	if _, exists := list.Get("10.0.0.1"); exists {
+		t.Errorf("expected expired device to be removed, got found")
+	}
+	if _, exists := list.Get("10.0.0.2"); !exists {
+		t.Errorf("expected alive device in list, got not found")
+	}
+
+	select {
+	case msg := <-obsChan:
+		if msg.Event != EventRemoved {
+			t.Errorf("expected EventRemoved, got %d", msg.Event)
+		}
+	default:
+		t.Errorf("expected removal message, got nothing")
+	}
+}
+
+func TestSsdpMonitor_ProbeDevices(t *testing.T) {
+	server := mockOkConn()
+	ipStart := strings.Index(server.URL, "://") + 3
+	ip := server.URL[ipStart:]
+
+	list := NewDeviceList()
+	monitor := NewMonitor(list)
+	dev, _ := NewDevice(ip)
+	list.Add(ip, dev)
+
+	monitor.probeDevices()
+	if !dev.node().Up.Get() {
+		t.Errorf("expected device up, got down")
+	}
+
+	server.Close()
+	for probe := 1; probe <= maxFailedProbes; probe++ {
+		monitor.probeDevices()
+		_, exists := list.Get(ip)
+		if dev.node().Up.Get() {
+			t.Errorf("expected device down, got up")
+		}
+		if probe < maxFailedProbes && !exists {
+			t.Errorf("expected device in list after %d failed probes, got not found", probe)
+		}
+		if probe == maxFailedProbes && exists {
+			t.Errorf("expected device removed after %d failed probes, got found", probe)
+		}
+	}
+}
+
+func TestSsdpMonitor_ConcurrentLiveness(t *testing.T) {
+	server := mockOkConn()
+	defer server.Close()
+	ipStart := strings.Index(server.URL, "://") + 3
+	ip := server.URL[ipStart:]
+
+	list := NewDeviceList()
+	monitor := NewMonitor(list)
+	dev, _ := NewDevice(ip)
+	list.Add(ip, dev)
+
+	// the monitor, the syncs and the API access the liveness concurrently
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		for idx := 0; idx < 10; idx++ {
+			monitor.probeDevices()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for idx := 0; idx < 10; idx++ {
+			monitor.refresh(ip, time.Now().Add(time.Minute))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for idx := 0; idx < 10; idx++ {
+			dev.Sync()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for idx := 0; idx < 10; idx++ {
+			if _, err := json.Marshal(dev); err != nil {
+				t.Errorf("expected nil error, got %v", err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	data, _ := json.Marshal(dev)
+	node := Node{}
+	if err := json.Unmarshal(data, &node); err != nil || node.Up.Get() != dev.node().Up.Get() {
+		t.Errorf("expected up=%v, got %s", dev.node().Up.Get(), data)
+	}
+}
@@ -0,0 +1,97 @@
+package http
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/antima/moody-core/pkg/value"
+)
+
+const (
+	SensorType   = "sensor"
+	ActuatorType = "actuator"
+)
+
+var (
+	ErrEmptyDeviceType     = errors.New("the device type can't be empty")
+	ErrNilDeviceFactory    = errors.New("the device factory can't be nil")
+	ErrDuplicateDeviceType = errors.New("the device type is already registered")
+)
+
+// A DeviceFactory builds a device of a registered type starting from the
+// node that answered to the connection endpoint. The returned device is
+// expected to embed the passed node, that provides its base JSON fields.
+type DeviceFactory func(node Node) Device
+
+var (
+	registryMutex sync.RWMutex
+	deviceTypes   = map[string]DeviceFactory{
+		SensorType:   newSensor,
+		ActuatorType: newActuator,
+	}
+)
+
+// RegisterDeviceType makes NewDevice build the nodes announcing the passed
+// type with the passed factory, returning an error if the type is already
+// registered
+func RegisterDeviceType(deviceType string, factory DeviceFactory) error {
+	if deviceType == "" {
+		return ErrEmptyDeviceType
+	}
+
+	if factory == nil {
+		return ErrNilDeviceFactory
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, exists := deviceTypes[deviceType]; exists {
+		return ErrDuplicateDeviceType
+	}
+	deviceTypes[deviceType] = factory
+	return nil
+}
+
+// DeviceTypes returns the sorted list of the registered device types
+func DeviceTypes() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	types := make([]string, 0, len(deviceTypes))
+	for deviceType := range deviceTypes {
+		types = append(types, deviceType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// unregisterDeviceType removes a device type from the registry
+func unregisterDeviceType(deviceType string) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	delete(deviceTypes, deviceType)
+}
+
+func deviceFactory(deviceType string) (DeviceFactory, bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	factory, exists := deviceTypes[deviceType]
+	return factory, exists
+}
+
+func newSensor(node Node) Device {
+	return &Sensor{
+		Node:        node,
+		lastReading: value.NewNumber(0),
+	}
+}
+
+func newActuator(node Node) Device {
+	return &Actuator{
+		Node:        node,
+		syncChan:    make(chan bool),
+		stateSynced: true,
+		state:       value.NewNumber(0),
+	}
+}
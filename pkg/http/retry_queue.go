@@ -0,0 +1,146 @@
+package http
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	initialRetryDelay = 5 * time.Second
+	maxRetryDelay     = 10 * time.Minute
+	retryTick         = 1 * time.Second
+)
+
+// A PendingDevice is a node that announced itself but could not
+// be synced yet
+type PendingDevice struct {
+	IpAddress string    `json:"ip"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError"`
+	NextRetry time.Time `json:"nextRetry"`
+}
+
+// RetryQueue keeps retrying the initialization of the pending devices with
+// an exponential backoff, moving them into the device list once they respond
+type RetryQueue struct {
+	mutex    sync.Mutex
+	pending  map[string]*PendingDevice
+	list     *DeviceList
+	stopChan chan bool
+}
+
+// NewRetryQueue creates an empty queue that promotes the synced devices
+// into the passed list
+func NewRetryQueue(list *DeviceList) *RetryQueue {
+	return &RetryQueue{
+		pending:  make(map[string]*PendingDevice),
+		list:     list,
+		stopChan: make(chan bool),
+	}
+}
+
+// Push adds a device to the queue or, if it is already pending, records the
+// last error without changing its backoff
+func (queue *RetryQueue) Push(ip string, err error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if pending, isPending := queue.pending[ip]; isPending {
+		pending.LastError = err.Error()
+		return
+	}
+
+	log.Printf("could not sync device %s, retrying in %v: %v\n", ip, initialRetryDelay, err)
+	queue.pending[ip] = &PendingDevice{
+		IpAddress: ip,
+		Attempts:  1,
+		LastError: err.Error(),
+		NextRetry: time.Now().Add(initialRetryDelay),
+	}
+}
+
+// Remove a device from the queue, this changes nothing if the
+// device is not pending
+func (queue *RetryQueue) Remove(ip string) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	delete(queue.pending, ip)
+}
+
+// Pending returns a snapshot of the devices in the queue, sorted by ip
+func (queue *RetryQueue) Pending() []PendingDevice {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	pendingList := make([]PendingDevice, 0, len(queue.pending))
+	for _, pending := range queue.pending {
+		pendingList = append(pendingList, *pending)
+	}
+	sort.Slice(pendingList, func(i, j int) bool {
+		return pendingList[i].IpAddress < pendingList[j].IpAddress
+	})
+	return pendingList
+}
+
+// Start retrying the pending devices in the background
+func (queue *RetryQueue) Start() {
+	go func() {
+		for {
+			select {
+			case <-time.After(retryTick):
+				queue.retry(time.Now())
+			case <-queue.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop retrying the pending devices
+func (queue *RetryQueue) Stop() {
+	close(queue.stopChan)
+}
+
+// retry attempts to sync every device whose backoff elapsed before now
+func (queue *RetryQueue) retry(now time.Time) {
+	var due []string
+	queue.mutex.Lock()
+	for ip, pending := range queue.pending {
+		if !now.Before(pending.NextRetry) {
+			due = append(due, ip)
+		}
+	}
+	queue.mutex.Unlock()
+
+	for _, ip := range due {
+		dev, err := NewDevice(ip)
+
+		queue.mutex.Lock()
+		pending, isPending := queue.pending[ip]
+		if !isPending {
+			// removed while the request was in flight
+			queue.mutex.Unlock()
+			continue
+		}
+
+		if err != nil {
+			delay := initialRetryDelay << uint(pending.Attempts)
+			if delay > maxRetryDelay || delay <= 0 {
+				delay = maxRetryDelay
+			}
+			pending.Attempts += 1
+			pending.LastError = err.Error()
+			pending.NextRetry = now.Add(delay)
+			queue.mutex.Unlock()
+			continue
+		}
+
+		delete(queue.pending, ip)
+		queue.mutex.Unlock()
+
+		log.Printf("device %s synced after %d attempts\n", ip, pending.Attempts+1)
+		queue.list.Add(ip, dev)
+	}
+}
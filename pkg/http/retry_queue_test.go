@@ -0,0 +1,48 @@
+package http
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryQueue_Retry(t *testing.T) {
+	list := NewDeviceList()
+	queue := NewRetryQueue(list)
+	queue.Push("127.0.0.1:1", NodeConnectionError)
+
+	pending := queue.Pending()
+	if len(pending) != 1 || pending[0].LastError != NodeConnectionError.Error() {
+		t.Fatalf("expected one pending device, got %v", pending)
+	}
+
+	// the device is still unreachable, the backoff doubles
+	now := pending[0].NextRetry
+	queue.retry(now)
+	pending = queue.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 2 {
+		t.Fatalf("expected one pending device with 2 attempts, got %v", pending)
+	}
+	if delay := pending[0].NextRetry.Sub(now); delay != 2*initialRetryDelay {
+		t.Errorf("expected %v backoff, got %v", 2*initialRetryDelay, delay)
+	}
+
+	server := mockOkConn()
+	defer server.Close()
+	ipStart := strings.Index(server.URL, "://") + 3
+	ip := server.URL[ipStart:]
+
+	queue.Push(ip, NodeConnectionError)
+	queue.retry(time.Now())
+	if _, exists := list.Get(ip); exists {
+		t.Errorf("expected device to wait for its backoff, got synced")
+	}
+
+	queue.retry(time.Now().Add(initialRetryDelay))
+	if _, exists := list.Get(ip); !exists {
+		t.Errorf("expected device promoted into the list, got not found")
+	}
+	if pending = queue.Pending(); len(pending) != 1 {
+		t.Errorf("expected one pending device, got %v", pending)
+	}
+}
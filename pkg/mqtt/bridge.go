@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidBridge  = fmt.Errorf("the mqtt bridge configuration is not valid")
+	ErrInvalidForward = fmt.Errorf("the mqtt forward is not valid")
+)
+
+// ForwardOptions configure the forwarding of the messages received by the
+// From broker on the topics matching the Filter to the To broker, both
+// identified by name. A Target rewrites the forwarded topics like an alias,
+// so a Filter ending with the '#' wildcard maps the whole tree under it to
+// the tree under the Target; without a Target the topics are not rewritten.
+// The forwards that could send a message back to a broker it was forwarded
+// from, such as the same topics forwarded back and forth, are rejected.
+type ForwardOptions struct {
+	From   string
+	To     string
+	Filter string
+	Target string
+}
+
+// forward is a validated ForwardOptions
+type forward struct {
+	from   string
+	to     string
+	filter string
+	alias  *topicAlias
+}
+
+func newForward(options ForwardOptions) (*forward, error) {
+	if err := ValidateFilter(options.Filter); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidForward, err)
+	}
+
+	fwd := &forward{from: options.From, to: options.To, filter: options.Filter}
+	if options.Target != "" {
+		aliases, err := NewTopicAliases(map[string]string{options.Filter: options.Target})
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidForward, err)
+		}
+		fwd.alias = &aliases.aliases[0]
+	}
+	return fwd, nil
+}
+
+// rewrite returns the topic the passed one is forwarded to, the second
+// return value is false if the topic is not forwarded
+func (fwd *forward) rewrite(topic string) (string, bool) {
+	if !TopicMatches(fwd.filter, topic) {
+		return "", false
+	}
+
+	if fwd.alias == nil {
+		return topic, true
+	}
+	return rewriteTopic(topic, fwd.alias.source, fwd.alias.target, fwd.alias.prefix)
+}
+
+// targetFilter returns the filter matching the topics that the forward publishes
+func (fwd *forward) targetFilter() string {
+	switch {
+	case fwd.alias == nil:
+		return fwd.filter
+	case fwd.alias.prefix:
+		return fwd.alias.target + multiLevelWild
+	default:
+		return fwd.alias.target
+	}
+}
+
+// findLoop returns a chain of forwards that can send a message back to the
+// broker it was forwarded from, a forward feeds the next one in the chain if
+// the topics it publishes overlap the filter of the next one, nil if the
+// forwards can't loop
+func findLoop(forwards []*forward) []*forward {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make([]int, len(forwards))
+	var chain []*forward
+
+	var visit func(idx int) []*forward
+	visit = func(idx int) []*forward {
+		states[idx] = visiting
+		chain = append(chain, forwards[idx])
+		for next, fwd := range forwards {
+			if fwd.from != forwards[idx].to || !filtersOverlap(forwards[idx].targetFilter(), fwd.filter) {
+				continue
+			}
+
+			switch states[next] {
+			case visiting:
+				for start, chained := range chain {
+					if chained == fwd {
+						return append(chain[start:], fwd)
+					}
+				}
+			case unvisited:
+				if loop := visit(next); loop != nil {
+					return loop
+				}
+			}
+		}
+		chain = chain[:len(chain)-1]
+		states[idx] = visited
+		return nil
+	}
+
+	for idx := range forwards {
+		if states[idx] == unvisited {
+			if loop := visit(idx); loop != nil {
+				return loop
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateBridge checks the options of each broker, that the brokers have
+// distinct names and that the forwards are valid, between two of them and
+// that they do not loop
+func ValidateBridge(brokers []Options, forwards []ForwardOptions) error {
+	if len(brokers) == 0 {
+		return fmt.Errorf("%w: no broker", ErrInvalidBridge)
+	}
+
+	names := make(map[string]bool)
+	for _, options := range brokers {
+		if err := options.Validate(); err != nil {
+			return err
+		}
+
+		name := brokerName(options)
+		if names[name] {
+			return fmt.Errorf("%w: duplicate broker %s", ErrInvalidBridge, name)
+		}
+		names[name] = true
+	}
+
+	var validated []*forward
+	for _, options := range forwards {
+		if !names[options.From] || !names[options.To] {
+			return fmt.Errorf("%w: unknown broker in %s -> %s", ErrInvalidForward, options.From, options.To)
+		}
+
+		if options.From == options.To {
+			return fmt.Errorf("%w: %s is forwarded to itself", ErrInvalidForward, options.From)
+		}
+
+		fwd, err := newForward(options)
+		if err != nil {
+			return err
+		}
+		validated = append(validated, fwd)
+	}
+
+	if loop := findLoop(validated); loop != nil {
+		var steps []string
+		for _, fwd := range loop[:len(loop)-1] {
+			steps = append(steps, fmt.Sprintf("%s (%s) -> %s", fwd.from, fwd.filter, fwd.to))
+		}
+		return fmt.Errorf("%w: the forwards loop, %s", ErrInvalidForward, strings.Join(steps, ", "))
+	}
+	return nil
+}
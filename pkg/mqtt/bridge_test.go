@@ -0,0 +1,188 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidateBridge(t *testing.T) {
+	brokers := []Options{
+		{Name: "site", Broker: "tcp://localhost:1883"},
+		{Name: "cloud", Broker: "tcp://cloud.example.com:8883"},
+	}
+
+	testCases := []struct {
+		Brokers  []Options
+		Forwards []ForwardOptions
+		Expected error
+	}{
+		{brokers, nil, nil},
+		{brokers, []ForwardOptions{{From: "site", To: "cloud", Filter: "moody/device/#", Target: "sites/home/#"}}, nil},
+		{brokers, []ForwardOptions{{From: "site", To: "cloud", Filter: "moody/device/+/temperature"}}, nil},
+		{nil, nil, ErrInvalidBridge},
+		{[]Options{{Broker: "tcp://localhost:1883"}, {Broker: "tcp://localhost:1883"}}, nil, ErrInvalidBridge},
+		{brokers, []ForwardOptions{{From: "site", To: "backup", Filter: "moody/device/#"}}, ErrInvalidForward},
+		{brokers, []ForwardOptions{{From: "site", To: "site", Filter: "moody/device/#"}}, ErrInvalidForward},
+		{brokers, []ForwardOptions{{From: "site", To: "cloud", Filter: "moody/#/lamp"}}, ErrInvalidForward},
+		{brokers, []ForwardOptions{{From: "site", To: "cloud", Filter: "moody/device/#", Target: "sites/home"}}, ErrInvalidForward},
+		{brokers, []ForwardOptions{
+			{From: "site", To: "cloud", Filter: "moody/device/#", Target: "sites/home/#"},
+			{From: "cloud", To: "site", Filter: "sites/+/alert"},
+		}, nil},
+		{brokers, []ForwardOptions{
+			{From: "site", To: "cloud", Filter: "moody/device/+/temperature"},
+			{From: "cloud", To: "site", Filter: "moody/device/kitchen/#"},
+		}, ErrInvalidForward},
+		{brokers, []ForwardOptions{
+			{From: "site", To: "cloud", Filter: "moody/device/#", Target: "sites/home/#"},
+			{From: "cloud", To: "site", Filter: "sites/home/alert", Target: "moody/device/alert"},
+		}, ErrInvalidForward},
+		{append(brokers, Options{Name: "backup", Broker: "tcp://backup.example.com:1883"}), []ForwardOptions{
+			{From: "site", To: "cloud", Filter: "moody/device/#"},
+			{From: "cloud", To: "backup", Filter: "moody/#"},
+			{From: "backup", To: "site", Filter: "moody/device/lamp"},
+		}, ErrInvalidForward},
+	}
+
+	for _, test := range testCases {
+		if err := ValidateBridge(test.Brokers, test.Forwards); !errors.Is(err, test.Expected) {
+			t.Errorf("expected %v for %v, got %v", test.Expected, test.Forwards, err)
+		}
+	}
+}
+
+func TestForward_rewrite(t *testing.T) {
+	tree, _ := newForward(ForwardOptions{Filter: "moody/device/#", Target: "sites/home/#"})
+	single, _ := newForward(ForwardOptions{Filter: "moody/device/+/temperature"})
+
+	testCases := []struct {
+		Forward   *forward
+		Topic     string
+		Expected  string
+		Forwarded bool
+	}{
+		{tree, "moody/device/kitchen/lamp", "sites/home/kitchen/lamp", true},
+		{tree, "moody/device", "sites/home", true},
+		{tree, "zigbee2mqtt/lamp", "", false},
+		{single, "moody/device/kitchen/temperature", "moody/device/kitchen/temperature", true},
+		{single, "moody/device/kitchen/humidity", "", false},
+	}
+
+	for _, test := range testCases {
+		if topic, forwarded := test.Forward.rewrite(test.Topic); topic != test.Expected || forwarded != test.Forwarded {
+			t.Errorf("expected %s %v for %s, got %s %v", test.Expected, test.Forwarded, test.Topic, topic, forwarded)
+		}
+	}
+}
+
+func TestMqttManager_Bridge(t *testing.T) {
+	address := freeAddress(t)
+	cloudTable := NewDataTable()
+	cloud := StartMqttManager(Options{
+		Embedded: &EmbeddedOptions{Address: address},
+		Roots:    []string{"sites/#"},
+	}, cloudTable)
+	defer cloud.StopMqttManager()
+
+	dataTable := NewDataTable()
+	mgr := StartMqttBridge([]Options{
+		{Name: "site", Embedded: &EmbeddedOptions{}, Roots: []string{"moody/device/#"}},
+		{Name: "cloud", Broker: "tcp://" + address, Roots: []string{"cloud/#"}},
+	}, []ForwardOptions{
+		{From: "site", To: "cloud", Filter: "moody/device/#", Target: "sites/home/#"},
+	}, dataTable)
+	defer mgr.StopMqttManager()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for mgr.Health()[1].State != BrokerConnected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the cloud broker to connect, got %+v", mgr.Health())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := mgr.Publish("moody/device/lamp", "on", 1, false); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	if source, _ := dataTable.Source("moody/device/lamp"); source != "site" {
+		t.Errorf("expected moody/device/lamp from site, got %s", source)
+	}
+
+	if err := cloud.Publish("cloud/alert", "fire", 1, false); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		_, forwarded := cloudTable.Get("sites/home/lamp")
+		source, received := dataTable.Source("cloud/alert")
+		if forwarded && received && source == "cloud" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the messages to be bridged, got forwarded %v and received %v from %s", forwarded, received, source)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestMqttManager_ForwardRetained(t *testing.T) {
+	address := freeAddress(t)
+	cloud := StartMqttManager(Options{Embedded: &EmbeddedOptions{Address: address}}, NewDataTable())
+	defer cloud.StopMqttManager()
+
+	// the cloud broker stores the state before the core subscribes to it
+	if err := cloud.Publish("moody/device/lamp", "on", 1, true); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	dataTable := NewDataTable()
+	mgr := StartMqttBridge([]Options{
+		{Name: "site", Embedded: &EmbeddedOptions{}, Roots: []string{"sites/#"}},
+		{Name: "cloud", Broker: "tcp://" + address, Roots: []string{"cloud/#"}},
+	}, []ForwardOptions{
+		{From: "cloud", To: "site", Filter: "moody/device/#", Target: "sites/cloud/#"},
+	}, dataTable)
+	defer mgr.StopMqttManager()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		retained, received := dataTable.Retained("sites/cloud/lamp")
+		if received {
+			if !retained {
+				t.Errorf("expected the forwarded replay to be marked as retained")
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the retained state to be forwarded")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the live updates are still forwarded as such
+	if err := cloud.Publish("moody/device/lamp", "off", 1, false); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		state, _ := dataTable.Get("sites/cloud/lamp")
+		retained, _ := dataTable.Retained("sites/cloud/lamp")
+		if state == "off" {
+			if retained {
+				t.Errorf("expected the forwarded update to be live")
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the update to be forwarded")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
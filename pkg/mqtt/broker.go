@@ -0,0 +1,105 @@
+package mqtt
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+
+	mochi "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/events"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+)
+
+const embeddedListenerId = "moody"
+
+var (
+	ErrInsecureBroker = fmt.Errorf("the embedded mqtt broker can't listen on a non-loopback address without credentials")
+)
+
+// EmbeddedOptions configure the broker run in-process in place of an external
+// one. The MQTT clients connect to it on Address, authenticating with the
+// Username and Password if set; an empty Address starts the broker without
+// listening, so that only the core and its services can use it. The broker
+// only listens on a loopback address unless the credentials are set.
+type EmbeddedOptions struct {
+	Address  string
+	Username string
+	Password string
+}
+
+// validate checks that the broker requires credentials
+// if it listens on a non-loopback address
+func (options *EmbeddedOptions) validate() error {
+	if options.Address == "" || options.Username != "" {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(options.Address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%w: %s", ErrInsecureBroker, options.Address)
+	}
+	return nil
+}
+
+// credentials is the auth controller of an embedded broker that
+// requires a username and password
+type credentials struct {
+	username []byte
+	password []byte
+}
+
+// Authenticate checks the credentials of a connecting client
+func (creds *credentials) Authenticate(user []byte, password []byte) bool {
+	userMatch := subtle.ConstantTimeCompare(user, creds.username)
+	passwordMatch := subtle.ConstantTimeCompare(password, creds.password)
+	return userMatch&passwordMatch == 1
+}
+
+// ACL allows the authenticated clients to read and write every topic
+func (creds *credentials) ACL(user []byte, topic string, write bool) bool {
+	return true
+}
+
+// startEmbedded starts the embedded broker, the messages published by the
+// clients connected to it are received by the manager as they arrive
+func (conn *brokerConnection) startEmbedded(options *EmbeddedOptions) error {
+	broker := mochi.NewServer(nil)
+	if options.Address != "" {
+		var controller auth.Controller = new(auth.Allow)
+		if options.Username != "" {
+			controller = &credentials{username: []byte(options.Username), password: []byte(options.Password)}
+		}
+
+		listener := listeners.NewTCP(embeddedListenerId, options.Address)
+		if err := broker.AddListener(listener, &listeners.Config{Auth: controller}); err != nil {
+			return err
+		}
+	}
+
+	// the messages published by the clients are live updates, the broker
+	// already stored the retained ones, so the retain flag is cleared before
+	// delivering them to the subscribers, as the MQTT specification requires
+	broker.Events.OnMessage = func(client events.Client, packet events.Packet) (events.Packet, error) {
+		conn.manager.receive(conn, packet.TopicName, string(packet.Payload), packet.FixedHeader.Qos, false)
+		packet.FixedHeader.Retain = false
+		return packet, nil
+	}
+
+	if err := broker.Serve(); err != nil {
+		return err
+	}
+
+	conn.broker = broker
+	if options.Address != "" {
+		log.Printf("started the embedded mqtt broker @%s\n", options.Address)
+	} else {
+		log.Println("started the embedded mqtt broker without listeners")
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func connectClient(address string, username string, password string) (mqtt.Client, error) {
+	clientOpts := mqtt.NewClientOptions()
+	clientOpts.AddBroker("tcp://" + address)
+	clientOpts.SetClientID("moody-test")
+	clientOpts.SetUsername(username)
+	clientOpts.SetPassword(password)
+	client := mqtt.NewClient(clientOpts)
+
+	token := client.Connect()
+	if token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return client, nil
+}
+
+func TestMqttManager_Embedded(t *testing.T) {
+	address := freeAddress(t)
+	dataTable := NewDataTable()
+	mgr := StartMqttManager(Options{
+		Embedded: &EmbeddedOptions{Address: address, Username: "moody", Password: "secret"},
+		Aliases:  map[string]string{"zigbee2mqtt/#": "moody/device/zigbee/#"},
+		Roots:    []string{"moody/device/#", "zigbee2mqtt/#"},
+	}, dataTable)
+	defer mgr.StopMqttManager()
+
+	if _, err := connectClient(address, "moody", "wrong"); err == nil {
+		t.Fatalf("expected the wrong credentials to be refused")
+	}
+
+	client, err := connectClient(address, "moody", "secret")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer client.Disconnect(100)
+
+	updates := make(chan StateTuple, 4)
+	dataTable.Subscribe("moody/device/#", updates)
+
+	token := client.Publish("zigbee2mqtt/lamp", 1, false, "on")
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("expected nil error, got %v", token.Error())
+	}
+
+	select {
+	case update := <-updates:
+		if update.Topic() != "moody/device/zigbee/lamp" || update.State() != "on" {
+			t.Errorf("expected moody/device/zigbee/lamp on, got %s %s", update.Topic(), update.State())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the message to reach the data table")
+	}
+
+	received := make(chan mqtt.Message, 1)
+	token = client.Subscribe("zigbee2mqtt/fan", 1, func(c mqtt.Client, m mqtt.Message) {
+		received <- m
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("expected nil error, got %v", token.Error())
+	}
+
+	if err := mgr.Publish("moody/device/zigbee/fan", "off", 1, false); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	select {
+	case message := <-received:
+		if string(message.Payload()) != "off" {
+			t.Errorf("expected off, got %s", message.Payload())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the client to receive the message")
+	}
+
+	if state, isPresent := dataTable.Get("moody/device/zigbee/fan"); !isPresent || state != "off" {
+		t.Errorf("expected the published state to be in the data table, got %s", state)
+	}
+}
@@ -2,10 +2,25 @@ package mqtt
 
 import "sync"
 
+type ServiceEvent uint
+
+const (
+	ServiceLoaded ServiceEvent = iota
+	ServiceUnloaded
+)
+
+// ServiceMsg is sent to the observers of a ServiceMap when
+// a service is added to or removed from it
+type ServiceMsg struct {
+	Name  string
+	Event ServiceEvent
+}
+
 // ServiceMap implements a synchronized collection of services
 type ServiceMap struct {
-	mutex    sync.RWMutex
-	mappings map[string]MoodyService
+	mutex     sync.RWMutex
+	mappings  map[string]MoodyService
+	observers []chan<- ServiceMsg
 }
 
 // NewServiceMap creates a new initialized map and returns a pointer to it
@@ -15,11 +30,32 @@ func NewServiceMap() *ServiceMap {
 	}
 }
 
+// Attach an observer that is notified every time a service is
+// added to or removed from the map
+func (concurrentMap *ServiceMap) Attach(obsChan chan<- ServiceMsg) {
+	concurrentMap.mutex.Lock()
+	defer concurrentMap.mutex.Unlock()
+	concurrentMap.observers = append(concurrentMap.observers, obsChan)
+}
+
+// Detach an observer previously attached to the map
+func (concurrentMap *ServiceMap) Detach(obsChan chan<- ServiceMsg) {
+	concurrentMap.mutex.Lock()
+	defer concurrentMap.mutex.Unlock()
+	for idx, observer := range concurrentMap.observers {
+		if observer == obsChan {
+			concurrentMap.observers = append(concurrentMap.observers[:idx], concurrentMap.observers[idx+1:]...)
+			break
+		}
+	}
+}
+
 // Add a service to the map, identified by name, in a synchronous fashion
 func (concurrentMap *ServiceMap) Add(name string, service MoodyService) {
 	concurrentMap.mutex.Lock()
 	defer concurrentMap.mutex.Unlock()
 	concurrentMap.mappings[name] = service
+	concurrentMap.notify(ServiceMsg{Name: name, Event: ServiceLoaded})
 }
 
 // Get a service from the map in a synchronous fashion, returns (nil, false)
@@ -38,6 +74,9 @@ func (concurrentMap *ServiceMap) Remove(name string) (MoodyService, bool) {
 	defer concurrentMap.mutex.Unlock()
 	elem, isPresent := concurrentMap.mappings[name]
 	delete(concurrentMap.mappings, name)
+	if isPresent {
+		concurrentMap.notify(ServiceMsg{Name: name, Event: ServiceUnloaded})
+	}
 	return elem, isPresent
 }
 
@@ -45,9 +84,15 @@ func (concurrentMap *ServiceMap) Remove(name string) (MoodyService, bool) {
 func (concurrentMap *ServiceMap) List() []MoodyService {
 	concurrentMap.mutex.RLock()
 	defer concurrentMap.mutex.RUnlock()
-	serviceList := make([]MoodyService, len(concurrentMap.mappings))
+	serviceList := make([]MoodyService, 0, len(concurrentMap.mappings))
 	for _, service := range concurrentMap.mappings {
 		serviceList = append(serviceList, service)
 	}
 	return serviceList
 }
+
+func (concurrentMap *ServiceMap) notify(msg ServiceMsg) {
+	for _, observer := range concurrentMap.observers {
+		observer <- msg
+	}
+}
@@ -0,0 +1,255 @@
+package mqtt
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-co/mqtt/server"
+)
+
+const embeddedBrokerName = "embedded"
+
+// brokerConnection is the connection of a MqttManager to one of its brokers,
+// either an external one reached through a client or the embedded one
+type brokerConnection struct {
+	name       string
+	manager    *MqttManager
+	client     mqtt.Client
+	broker     *mochi.Server
+	embedded   *EmbeddedOptions
+	roots      []string
+	filters    []string
+	aliases    *TopicAliases
+	policies   topicPolicies
+	stateMutex sync.Mutex
+	health     BrokerHealth
+	stopChan   chan bool
+}
+
+// brokerName returns the name identifying the broker of the options
+func brokerName(options Options) string {
+	switch {
+	case options.Name != "":
+		return options.Name
+	case options.Embedded != nil:
+		return embeddedBrokerName
+	}
+	return options.Broker
+}
+
+// newConnection builds the connection to the embedded or external broker,
+// that subscribes to the roots of the options and to the additional filters
+// of the forwards from the broker once started
+func newConnection(manager *MqttManager, options Options, filters []string) (*brokerConnection, error) {
+	roots := options.Roots
+	if len(roots) == 0 {
+		roots = []string{NamespaceRoot(DefaultNamespace)}
+	}
+
+	// the aliases were already validated
+	aliases, _ := NewTopicAliases(options.Aliases)
+	conn := &brokerConnection{
+		name:     brokerName(options),
+		manager:  manager,
+		roots:    roots,
+		filters:  append([]string{}, roots...),
+		aliases:  aliases,
+		policies: options.Policies,
+		health:   BrokerHealth{Name: brokerName(options), Broker: options.Broker, State: BrokerConnecting, Since: time.Now()},
+		stopChan: make(chan bool),
+	}
+
+	for _, filter := range filters {
+		if !conn.subscribed(filter) {
+			conn.filters = append(conn.filters, filter)
+		}
+	}
+
+	if options.Embedded != nil {
+		conn.health.Broker = options.Embedded.Address
+		conn.embedded = options.Embedded
+		return conn, nil
+	}
+
+	clientOpts, err := options.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	clientOpts.SetAutoReconnect(true)
+	clientOpts.SetMaxReconnectInterval(maxReconnectDelay)
+	clientOpts.SetOnConnectHandler(conn.subscribe)
+	clientOpts.SetConnectionLostHandler(conn.lostConnectionHandler)
+	clientOpts.SetReconnectingHandler(conn.reconnectingHandler)
+	conn.client = mqtt.NewClient(clientOpts)
+	return conn, nil
+}
+
+// start starts the embedded broker or the connection to the external one,
+// the messages received from then on are handled by the manager
+func (conn *brokerConnection) start() error {
+	if conn.embedded != nil {
+		if err := conn.startEmbedded(conn.embedded); err != nil {
+			return err
+		}
+		conn.setState(BrokerConnected, nil)
+		return nil
+	}
+
+	// the broker may be unreachable, the core keeps running without
+	// it while the connection is retried in the background
+	go conn.connect()
+	return nil
+}
+
+func (conn *brokerConnection) stop() {
+	close(conn.stopChan)
+	if conn.broker != nil {
+		_ = conn.broker.Close()
+		return
+	}
+
+	if conn.client.IsConnectionOpen() {
+		conn.client.Unsubscribe(conn.filters...)
+	}
+	conn.client.Disconnect(100)
+}
+
+// subscribed reports whether the topic matches one of the roots of the broker
+func (conn *brokerConnection) subscribed(topic string) bool {
+	for _, root := range conn.roots {
+		if TopicMatches(root, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (conn *brokerConnection) getHealth() BrokerHealth {
+	conn.stateMutex.Lock()
+	defer conn.stateMutex.Unlock()
+	return conn.health
+}
+
+// setState records a new connection state, logging the transition
+func (conn *brokerConnection) setState(state ConnectionState, err error) {
+	conn.stateMutex.Lock()
+	defer conn.stateMutex.Unlock()
+
+	if err != nil {
+		conn.health.LastError = err.Error()
+	}
+
+	if conn.health.State == state {
+		return
+	}
+
+	log.Printf("mqtt broker %s: %s -> %s\n", conn.name, conn.health.State, state)
+	conn.health.State = state
+	conn.health.Since = time.Now()
+}
+
+// publish sends a message of the core to the passed topic of the broker,
+// applying the topic policies. The embedded broker does not notify the core
+// of its own messages, so they are received directly as live updates; its
+// clients receive them with the retain flag set, if retained.
+func (conn *brokerConnection) publish(topic string, payload string, qos byte, retained bool) error {
+	return conn.send(topic, payload, qos, retained, false)
+}
+
+// forward sends a message received from another broker to the passed topic
+// of the broker, like publish, but the embedded broker receives the forwarded
+// replays of retained messages as replays rather than as live updates
+func (conn *brokerConnection) forward(topic string, payload string, qos byte, retained bool) error {
+	return conn.send(topic, payload, qos, retained, retained)
+}
+
+// send sends the payload to the passed topic of the broker, applying the topic
+// policies, the embedded broker receives it as a replay if replayed is set
+func (conn *brokerConnection) send(topic string, payload string, qos byte, retained bool, replayed bool) error {
+	qos, retained = conn.policies.apply(topic, qos, retained)
+	if conn.broker != nil {
+		if err := conn.broker.Publish(topic, []byte(payload), retained); err != nil {
+			return err
+		}
+		conn.manager.receive(conn, topic, payload, qos, replayed)
+		return nil
+	}
+
+	if !conn.client.IsConnectionOpen() {
+		return ErrNotConnected
+	}
+
+	token := conn.client.Publish(topic, qos, retained, payload)
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// connect attempts the first connection to the broker with an exponential
+// backoff until it succeeds or the connection is stopped, the later connection
+// losses are handled by the automatic reconnection of the client
+func (conn *brokerConnection) connect() {
+	delay := minReconnectDelay
+	for attempt := 1; ; attempt++ {
+		log.Printf("attempting a connection #%d to the mqtt broker %s\n", attempt, conn.name)
+		token := conn.client.Connect()
+		<-token.Done()
+
+		select {
+		case <-conn.stopChan:
+			// the connection was stopped while connecting
+			conn.client.Disconnect(0)
+			return
+		default:
+		}
+
+		if token.Error() == nil {
+			return
+		}
+
+		conn.setState(BrokerDisconnected, token.Error())
+		log.Printf("error: could not connect to the mqtt broker %s, retrying in %v: %v\n", conn.name, delay, token.Error())
+		select {
+		case <-time.After(delay):
+		case <-conn.stopChan:
+			return
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+		conn.setState(BrokerConnecting, nil)
+	}
+}
+
+func (conn *brokerConnection) subscribe(c mqtt.Client) {
+	opts := c.OptionsReader()
+	log.Printf("succesfully connected to the mqtt broker @%s!", opts.Servers()[0])
+	conn.setState(BrokerConnected, nil)
+	for _, filter := range conn.filters {
+		token := c.Subscribe(filter, conn.policies.subscriptionQos(filter), conn.dataCallback)
+		if token.Wait() && token.Error() != nil {
+			log.Printf("error: could not subscribe to the %s topic, %v\n", filter, token.Error())
+			continue
+		}
+		log.Printf("succesfully subscribed to the %s topic\n", filter)
+	}
+}
+
+func (conn *brokerConnection) dataCallback(c mqtt.Client, m mqtt.Message) {
+	conn.manager.receive(conn, m.Topic(), string(m.Payload()), m.Qos(), m.Retained())
+}
+
+func (conn *brokerConnection) lostConnectionHandler(c mqtt.Client, e error) {
+	opts := c.OptionsReader()
+	log.Printf("lost connection with the broker @%s, trying to reconnect", opts.Servers()[0])
+	conn.setState(BrokerDisconnected, e)
+}
+
+func (conn *brokerConnection) reconnectingHandler(c mqtt.Client, opts *mqtt.ClientOptions) {
+	conn.setState(BrokerConnecting, nil)
+}
@@ -2,9 +2,18 @@ package mqtt
 
 import (
 	"context"
+	"log"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/antima/moody-core/pkg/value"
 )
 
+// observerQueueSize is the number of updates queued for each observer
+// of the whole table, the newer ones are dropped when it is full
+const observerQueueSize = 256
+
 // DataObservable provides an interface for updatable and
 // observable types, that can notify a number of entities
 // of their state updates
@@ -14,11 +23,57 @@ type DataObservable interface {
 	Detach(obs chan<- StateTuple)
 }
 
+// Recorder is implemented by types that keep the history of
+// the states received on each topic
+type Recorder interface {
+	Record(topic string, state string, timestamp time.Time) error
+}
+
 // StateTuple used to communicate with services that receive
 // data from the MQTT flows
 type StateTuple struct {
-	topic string
-	state string
+	topic    string
+	state    string
+	value    value.Value
+	source   string
+	retained bool
+}
+
+// Topic returns the topic the state was received on
+func (tuple StateTuple) Topic() string {
+	return tuple.topic
+}
+
+// State returns the received payload
+func (tuple StateTuple) State() string {
+	return tuple.state
+}
+
+// Value returns the received payload parsed as a typed value
+func (tuple StateTuple) Value() value.Value {
+	return tuple.value
+}
+
+// Source returns the name of the broker the state was received from,
+// empty if it was not received from a broker
+func (tuple StateTuple) Source() string {
+	return tuple.source
+}
+
+// Retained reports whether the state is the replay of a retained message,
+// stored by the broker before the core subscribed, rather than a live update
+func (tuple StateTuple) Retained() bool {
+	return tuple.retained
+}
+
+// TopicSnapshot is the latest reading of a topic along with the broker it
+// was received from, whether it is a retained replay and when it was received
+type TopicSnapshot struct {
+	State    string
+	Value    value.Value
+	Source   string
+	Retained bool
+	Updated  time.Time
 }
 
 // TopicManager structs handle the data traffic for each
@@ -27,7 +82,12 @@ type StateTuple struct {
 type TopicManager struct {
 	obsMutex   sync.Mutex
 	state      string
+	value      value.Value
+	source     string
+	retained   bool
+	updated    time.Time
 	observers  []chan<- StateTuple
+	refs       map[chan<- StateTuple]int
 	cancelFunc context.CancelFunc
 }
 
@@ -37,12 +97,132 @@ type TopicManager struct {
 type DataTable struct {
 	rwMutex    sync.RWMutex
 	topicTable map[string]*TopicManager
+	wildcards  map[string][]chan<- StateTuple
+	recorder   Recorder
+	observers  []*tableObserver
+}
+
+// tableObserver relays the updates of the table to one of its observers
+// through a queue, so that a slow observer can't stall the table
+type tableObserver struct {
+	obs      chan<- StateTuple
+	queue    chan StateTuple
+	stopChan chan bool
+}
+
+func (observer *tableObserver) relay() {
+	for {
+		select {
+		case tuple := <-observer.queue:
+			select {
+			case observer.obs <- tuple:
+			case <-observer.stopChan:
+				return
+			}
+		case <-observer.stopChan:
+			return
+		}
+	}
 }
 
 // NewDataTable returns an initialized pointer to a DataTable
 func NewDataTable() *DataTable {
 	return &DataTable{
 		topicTable: make(map[string]*TopicManager),
+		wildcards:  make(map[string][]chan<- StateTuple),
+	}
+}
+
+// SetRecorder makes the table store every received state
+// into the passed recorder
+func (table *DataTable) SetRecorder(recorder Recorder) {
+	table.rwMutex.Lock()
+	defer table.rwMutex.Unlock()
+	table.recorder = recorder
+}
+
+// Attach an observer that is notified of the updates of every topic in
+// the table, in order. The updates are queued for the observer, those
+// received while observerQueueSize of them are pending are dropped.
+func (table *DataTable) Attach(obs chan<- StateTuple) {
+	observer := &tableObserver{
+		obs:      obs,
+		queue:    make(chan StateTuple, observerQueueSize),
+		stopChan: make(chan bool),
+	}
+	go observer.relay()
+
+	table.rwMutex.Lock()
+	defer table.rwMutex.Unlock()
+	table.observers = append(table.observers, observer)
+}
+
+// Detach an observer previously attached to the table, the
+// updates still queued for it are not delivered
+func (table *DataTable) Detach(obs chan<- StateTuple) {
+	table.rwMutex.Lock()
+	defer table.rwMutex.Unlock()
+	for idx, observer := range table.observers {
+		if observer.obs == obs {
+			close(observer.stopChan)
+			table.observers = append(table.observers[:idx], table.observers[idx+1:]...)
+			break
+		}
+	}
+}
+
+// Subscribe attaches an observer to the managers of the topics matching the
+// passed filter, that can contain the MQTT wildcards. A wildcard subscription
+// also covers the topics that first appear after the observer subscribed.
+func (table *DataTable) Subscribe(filter string, obs chan<- StateTuple) {
+	table.rwMutex.Lock()
+	defer table.rwMutex.Unlock()
+
+	if !IsWildcard(filter) {
+		table.getManagerRef(filter).Attach(obs)
+		return
+	}
+
+	table.wildcards[filter] = append(table.wildcards[filter], obs)
+	for topic, manager := range table.topicTable {
+		if TopicMatches(filter, topic) {
+			manager.Attach(obs)
+		}
+	}
+}
+
+// Unsubscribe detaches an observer from the managers of the topics matching
+// the passed filter, an observer subscribed to overlapping filters keeps
+// receiving the topics matching the other ones
+func (table *DataTable) Unsubscribe(filter string, obs chan<- StateTuple) {
+	table.rwMutex.Lock()
+	defer table.rwMutex.Unlock()
+
+	if !IsWildcard(filter) {
+		if manager, isPresent := table.topicTable[filter]; isPresent {
+			manager.Detach(obs)
+		}
+		return
+	}
+
+	observers := table.wildcards[filter]
+	for idx, obsChan := range observers {
+		if obsChan == obs {
+			observers = append(observers[:idx], observers[idx+1:]...)
+			break
+		}
+	}
+
+	if len(observers) == 0 {
+		delete(table.wildcards, filter)
+	} else {
+		table.wildcards[filter] = observers
+	}
+
+	for topic, manager := range table.topicTable {
+		if TopicMatches(filter, topic) {
+			manager.Detach(obs)
+		}
 	}
 }
 
@@ -50,79 +230,230 @@ func NewDataTable() *DataTable {
 // to the table. This function initializes the data handler
 // for that topic if it was not already initialized
 func (table *DataTable) Add(topic string, state string) {
+	table.AddFrom("", topic, state, false)
+}
+
+// AddFrom adds the most recently received payload for the passed
+// topic to the table, tagging it with the broker it was received from
+// and marking whether it is the replay of a retained message. The
+// replays are not recorded, as they repeat an already received state.
+func (table *DataTable) AddFrom(source string, topic string, state string, retained bool) {
 	table.rwMutex.Lock()
 	defer table.rwMutex.Unlock()
 
-	manager, isPresent := table.topicTable[topic]
-	if !isPresent {
-		table.topicTable[topic] = &TopicManager{}
-		manager = table.topicTable[topic]
+	manager := table.getManagerRef(topic)
+	manager.state = state
+	manager.value = value.Parse(state)
+	manager.source = source
+	manager.retained = retained
+	manager.updated = time.Now()
+	if table.recorder != nil && !retained {
+		if err := table.recorder.Record(topic, state, manager.updated); err != nil {
+			log.Printf("error: could not record the state of %s, %v\n", topic, err)
+		}
 	}
 
-	table.topicTable[topic].state = state
-
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	if manager.cancelFunc != nil {
 		manager.cancelFunc()
 	}
 
 	manager.cancelFunc = cancelFunc
-	go manager.Notify(ctx, StateTuple{topic, state})
+	tuple := StateTuple{topic, state, manager.value, source, retained}
+	go manager.Notify(ctx, tuple)
+
+	for _, observer := range table.observers {
+		select {
+		case observer.queue <- tuple:
+		default:
+			log.Printf("dropping the %s update, an observer of the table is not keeping up\n", topic)
+		}
+	}
 }
 
 // Get the latest reading for the passed topic, the second return
 // value is false if such a topic does not exist in the table
 func (table *DataTable) Get(topic string) (string, bool) {
+	state, _, isPresent := table.LastUpdate(topic)
+	return state, isPresent
+}
+
+// LastUpdate returns the latest reading for the passed topic along
+// with the time it was received, the third return value is false if
+// no state was ever received on that topic
+func (table *DataTable) LastUpdate(topic string) (string, time.Time, bool) {
 	table.rwMutex.RLock()
 	defer table.rwMutex.RUnlock()
 
 	value, isPresent := table.topicTable[topic]
-	return value.state, isPresent
+	if !isPresent || value.updated.IsZero() {
+		return "", time.Time{}, false
+	}
+	return value.state, value.updated, true
+}
+
+// Snapshot returns the latest reading for the passed topic along with all
+// of its metadata, read at once so that they all belong to the same update,
+// the second return value is false if no state was ever received on that topic
+func (table *DataTable) Snapshot(topic string) (TopicSnapshot, bool) {
+	table.rwMutex.RLock()
+	defer table.rwMutex.RUnlock()
+
+	manager, isPresent := table.topicTable[topic]
+	if !isPresent || manager.updated.IsZero() {
+		return TopicSnapshot{}, false
+	}
+
+	return TopicSnapshot{
+		State:    manager.state,
+		Value:    manager.value,
+		Source:   manager.source,
+		Retained: manager.retained,
+		Updated:  manager.updated,
+	}, true
+}
+
+// Source returns the name of the broker the latest reading for the passed
+// topic was received from, the second return value is false if no state
+// was ever received on that topic
+func (table *DataTable) Source(topic string) (string, bool) {
+	table.rwMutex.RLock()
+	defer table.rwMutex.RUnlock()
+
+	manager, isPresent := table.topicTable[topic]
+	if !isPresent || manager.updated.IsZero() {
+		return "", false
+	}
+	return manager.source, true
+}
+
+// Retained reports whether the latest reading for the passed topic is the
+// replay of a retained message, the second return value is false if no
+// state was ever received on that topic
+func (table *DataTable) Retained(topic string) (bool, bool) {
+	table.rwMutex.RLock()
+	defer table.rwMutex.RUnlock()
+
+	manager, isPresent := table.topicTable[topic]
+	if !isPresent || manager.updated.IsZero() {
+		return false, false
+	}
+	return manager.retained, true
+}
+
+// Value returns the latest reading for the passed topic parsed as a
+// typed value, the second return value is false if no state was ever
+// received on that topic
+func (table *DataTable) Value(topic string) (value.Value, bool) {
+	table.rwMutex.RLock()
+	defer table.rwMutex.RUnlock()
+
+	manager, isPresent := table.topicTable[topic]
+	if !isPresent || manager.updated.IsZero() {
+		return value.Value{}, false
+	}
+	return manager.value, true
+}
+
+// Topics returns a list of the topics that received at least one state
+func (table *DataTable) Topics() []string {
+	table.rwMutex.RLock()
+	defer table.rwMutex.RUnlock()
+
+	topics := []string{}
+	for topic, manager := range table.topicTable {
+		if !manager.updated.IsZero() {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
 }
 
+// getManagerRef returns the manager of the passed topic, creating it and
+// attaching the matching wildcard subscribers if it does not exist yet,
+// the table mutex must be held by the caller
 func (table *DataTable) getManagerRef(topic string) *TopicManager {
 	mgr, isPresent := table.topicTable[topic]
 	if !isPresent {
-		table.topicTable[topic] = &TopicManager{}
-		mgr = table.topicTable[topic]
+		mgr = &TopicManager{}
+		for filter, observers := range table.wildcards {
+			if TopicMatches(filter, topic) {
+				for _, obs := range observers {
+					mgr.Attach(obs)
+				}
+			}
+		}
+		table.topicTable[topic] = mgr
 	}
 	return mgr
 }
 
 func NewTopicManager() *TopicManager {
 	return &TopicManager{
-		observers:  make([]chan<- StateTuple, 5),
+		refs:       make(map[chan<- StateTuple]int),
 		cancelFunc: nil,
 	}
 }
 
+// Notify sends the event to the observers of the topic, giving up when
+// the context is cancelled by a newer event, the observers channels are
+// never closed, so an observer that stopped reading only holds the
+// notification until the next event on the topic
 func (manager *TopicManager) Notify(ctx context.Context, event StateTuple) {
-	for _, obsChan := range manager.observers {
+	manager.obsMutex.Lock()
+	observers := make([]chan<- StateTuple, len(manager.observers))
+	copy(observers, manager.observers)
+	manager.obsMutex.Unlock()
+
+	for _, obsChan := range observers {
+		// a cancelled notification is not sent to the observers that are ready
+		if ctx.Err() != nil {
+			return
+		}
+
 		select {
 		case <-ctx.Done():
 			return
-		default:
-			obsChan <- event
+		case obsChan <- event:
 		}
 	}
 }
 
+// Attach an observer to the topic, an observer that is already
+// attached, for example through overlapping filters, is notified once
+// and stays attached until it is detached as many times
 func (manager *TopicManager) Attach(obs chan<- StateTuple) {
 	manager.obsMutex.Lock()
 	defer manager.obsMutex.Unlock()
-	manager.observers = append(manager.observers, obs)
+	if manager.refs == nil {
+		manager.refs = make(map[chan<- StateTuple]int)
+	}
+
+	manager.refs[obs]++
+	if manager.refs[obs] == 1 {
+		manager.observers = append(manager.observers, obs)
+	}
 }
 
+// Detach an observer from the topic, once detached as many times as it was attached
 func (manager *TopicManager) Detach(obs chan<- StateTuple) {
-	// TODO this may be optimized without re-slicing
-	// for example keep it there and when you notify something in the future
-	// check if the channel is open, if it is not, delete it from the list
-	// a call to this would only close the chan
 	manager.obsMutex.Lock()
 	defer manager.obsMutex.Unlock()
+	if manager.refs[obs] == 0 {
+		return
+	}
+
+	manager.refs[obs]--
+	if manager.refs[obs] > 0 {
+		return
+	}
+
+	delete(manager.refs, obs)
 	for idx, obsChan := range manager.observers {
 		if obsChan == obs {
 			manager.observers = append(manager.observers[:idx], manager.observers[idx+1:]...)
+			break
 		}
 	}
 }
@@ -0,0 +1,130 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, obsChan <-chan StateTuple) (StateTuple, bool) {
+	t.Helper()
+	select {
+	case tuple := <-obsChan:
+		return tuple, true
+	case <-time.After(100 * time.Millisecond):
+		return StateTuple{}, false
+	}
+}
+
+func TestDataTable_Subscribe(t *testing.T) {
+	table := NewDataTable()
+	table.Add("moody/device/kitchen/temperature", "20")
+
+	wildChan := make(chan StateTuple)
+	literalChan := make(chan StateTuple)
+	table.Subscribe("moody/device/+/temperature", wildChan)
+	table.Subscribe("moody/device/kitchen/#", wildChan)
+	table.Subscribe("moody/device/kitchen/temperature", literalChan)
+
+	table.Add("moody/device/kitchen/temperature", "21")
+	if tuple, received := receive(t, wildChan); !received || tuple.State() != "21" {
+		t.Errorf("expected the wildcard subscriber to receive 21, got %v", tuple)
+	}
+	if tuple, received := receive(t, wildChan); received {
+		t.Errorf("expected overlapping filters to deliver the update once, got %v", tuple)
+	}
+	if tuple, received := receive(t, literalChan); !received || tuple.State() != "21" {
+		t.Errorf("expected the literal subscriber to receive 21, got %v", tuple)
+	}
+
+	// topics that appear after the subscription are matched as well
+	table.Add("moody/device/living/temperature", "18")
+	if tuple, received := receive(t, wildChan); !received || tuple.Topic() != "moody/device/living/temperature" {
+		t.Errorf("expected the wildcard subscriber to receive the new topic, got %v", tuple)
+	}
+
+	table.Add("moody/device/living/humidity", "40")
+	if tuple, received := receive(t, wildChan); received {
+		t.Errorf("expected no update for a non matching topic, got %v", tuple)
+	}
+
+	table.Unsubscribe("moody/device/+/temperature", wildChan)
+	table.Add("moody/device/living/temperature", "19")
+	if tuple, received := receive(t, wildChan); received {
+		t.Errorf("expected no update after unsubscribing, got %v", tuple)
+	}
+
+	// the topics still matched by another filter keep being delivered
+	table.Add("moody/device/kitchen/temperature", "22")
+	if tuple, received := receive(t, wildChan); !received || tuple.State() != "22" {
+		t.Errorf("expected the overlapping filter to keep delivering, got %v", tuple)
+	}
+	if _, received := receive(t, literalChan); !received {
+		t.Errorf("expected the literal subscriber to receive 22")
+	}
+
+	table.Unsubscribe("moody/device/kitchen/#", wildChan)
+	table.Add("moody/device/kitchen/temperature", "23")
+	if tuple, received := receive(t, wildChan); received {
+		t.Errorf("expected no update after unsubscribing, got %v", tuple)
+	}
+	if _, received := receive(t, literalChan); !received {
+		t.Errorf("expected the literal subscriber to receive 23")
+	}
+
+	table.Add("moody/device/garage/temperature", "10")
+	if tuple, received := receive(t, wildChan); received {
+		t.Errorf("expected no update after unsubscribing, got %v", tuple)
+	}
+}
+
+func TestDataTable_Attach(t *testing.T) {
+	table := NewDataTable()
+	obsChan := make(chan StateTuple)
+	table.Attach(obsChan)
+
+	// an observer that does not drain its channel does not stall the table
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for idx := 0; idx < observerQueueSize*2; idx++ {
+			table.Add("moody/device/kitchen/temperature", "20")
+		}
+		table.Add("moody/device/kitchen/temperature", "21")
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the table not to wait for its observers")
+	}
+
+	if state, _ := table.Get("moody/device/kitchen/temperature"); state != "21" {
+		t.Errorf("expected 21, got %s", state)
+	}
+
+	// the queued updates are delivered in order
+	if tuple, received := receive(t, obsChan); !received || tuple.State() != "20" {
+		t.Errorf("expected the queued 20 update, got %v", tuple)
+	}
+
+	// only the update already dequeued by the relay may follow the detach
+	table.Detach(obsChan)
+	receive(t, obsChan)
+	if tuple, received := receive(t, obsChan); received {
+		t.Errorf("expected no update after detaching, got %v", tuple)
+	}
+}
+
+func TestDataTable_Snapshot(t *testing.T) {
+	table := NewDataTable()
+	if _, exists := table.Snapshot("moody/device/lamp"); exists {
+		t.Errorf("expected no snapshot of a topic without states")
+	}
+
+	table.AddFrom("local", "moody/device/lamp", "on", true)
+	table.AddFrom("cloud", "moody/device/lamp", "12", false)
+	snapshot, exists := table.Snapshot("moody/device/lamp")
+	if !exists || snapshot.State != "12" || snapshot.Value.Number != 12 || snapshot.Source != "cloud" || snapshot.Retained || snapshot.Updated.IsZero() {
+		t.Errorf("expected the live 12 update from cloud, got %+v", snapshot)
+	}
+}
@@ -1,91 +1,368 @@
 package mqtt
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 const (
-	connectionRetries = 5
-	baseTopic         = "moody/device/#"
+	DefaultNamespace  = "moody/device"
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
 )
 
-type MqttManager struct {
-	client    mqtt.Client
-	dataTable *DataTable
+// tlsSchemes are the schemes of the broker connection strings
+// that make the client connect over TLS
+var tlsSchemes = map[string]bool{
+	"ssl":      true,
+	"tls":      true,
+	"mqtts":    true,
+	"mqtt+ssl": true,
+	"tcps":     true,
+	"wss":      true,
+}
+
+var (
+	ErrInvalidQos   = fmt.Errorf("the QoS level must be 0, 1 or 2")
+	ErrNotConnected = fmt.Errorf("the mqtt client is not connected to the broker")
+	ErrInvalidTls   = fmt.Errorf("the mqtt TLS configuration is not valid")
+	ErrInvalidWill  = fmt.Errorf("the mqtt last will is not valid")
+)
+
+// Publisher is implemented by types that can send messages
+// over MQTT on behalf of a service
+type Publisher interface {
+	Publish(topic string, payload string, qos byte, retained bool) error
+}
+
+// TlsOptions configure the TLS connection to the broker, the CA file
+// verifies the broker certificate and the client certificate and key
+// authenticate the core, if required by the broker. They require a broker
+// connection string with a TLS scheme: ssl, tls, mqtts, tcps or wss.
+type TlsOptions struct {
+	CaFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// WillOptions configure the message that the broker publishes
+// when the core disconnects unexpectedly
+type WillOptions struct {
+	Topic    string
+	Payload  string
+	Qos      byte
+	Retained bool
+}
+
+// Options configure the connection of a MqttManager: the broker and the
+// client session on it, the topic filters subscribed on it and the aliases
+// of the received topics. An empty ClientId is replaced by one derived from
+// the host name, a nil CleanSession by a clean session. The Policies set the
+// QoS level and retain flag of the matching topics. If Embedded is set
+// the manager runs its own broker, ignoring the connection options. The Name
+// identifies the broker when bridging several ones, it defaults to the
+// connection string.
+type Options struct {
+	Name         string
+	Embedded     *EmbeddedOptions
+	Broker       string
+	ClientId     string
+	Username     string
+	Password     string
+	KeepAlive    time.Duration
+	CleanSession *bool
+	Tls          *TlsOptions
+	Will         *WillOptions
+	Roots        []string
+	Aliases      map[string]string
+	Policies     []TopicPolicy
+}
+
+// DefaultClientId returns a client id that is unique for each host, so
+// that the cores running on different hosts do not share a session
+func DefaultClientId() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return fmt.Sprintf("moody-core-%d", os.Getpid())
+	}
+	return fmt.Sprintf("moody-core-%s", hostname)
+}
+
+// tlsConfig loads the files of the TLS options
+func (options *TlsOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify}
+	if options.CaFile != "" {
+		caCert, err := os.ReadFile(options.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTls, err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("%w: no certificate found in %s", ErrInvalidTls, options.CaFile)
+		}
+	}
+
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return nil, fmt.Errorf("%w: the client certificate and key must be passed together", ErrInvalidTls)
+	}
+
+	if options.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTls, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// clientOptions builds the paho client options from the options
+func (options *Options) clientOptions() (*mqtt.ClientOptions, error) {
+	clientOpts := mqtt.NewClientOptions()
+	clientOpts.AddBroker(options.Broker)
+
+	clientId := options.ClientId
+	if clientId == "" {
+		clientId = DefaultClientId()
+	}
+	clientOpts.SetClientID(clientId)
+
+	if options.Username != "" {
+		clientOpts.SetUsername(options.Username)
+		clientOpts.SetPassword(options.Password)
+	}
+
+	if options.KeepAlive > 0 {
+		clientOpts.SetKeepAlive(options.KeepAlive)
+	}
+
+	if options.CleanSession != nil {
+		clientOpts.SetCleanSession(*options.CleanSession)
+	}
+
+	if options.Tls != nil {
+		tlsConfig, err := options.Tls.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		clientOpts.SetTLSConfig(tlsConfig)
+	}
+
+	if options.Will != nil {
+		clientOpts.SetWill(options.Will.Topic, options.Will.Payload, options.Will.Qos, options.Will.Retained)
+	}
+	return clientOpts, nil
+}
+
+// NamespaceRoot returns the filter matching every topic under the namespace
+func NamespaceRoot(namespace string) string {
+	return fmt.Sprintf("%s%s%s", namespace, topicSeparator, multiLevelWild)
 }
 
-func StartMqttManager(brokerString string, dataTableRef *DataTable) *MqttManager {
-	mgr := &MqttManager{}
+// Validate checks the embedded broker options, the TLS options, the last will, the subscription roots,
+// the aliases and the topic policies of the options
+func (options *Options) Validate() error {
+	// paho ignores the TLS configuration of the plain schemes,
+	// the connection would silently fall back to plaintext
+	if options.Embedded != nil {
+		if err := options.Embedded.validate(); err != nil {
+			return err
+		}
+	}
 
-	clientOpts := mqtt.ClientOptions{}
-	clientOpts.AddBroker(brokerString)
-	clientOpts.SetClientID(fmt.Sprintf("Moody-Recv"))
-	clientOpts.SetAutoReconnect(true)
-	clientOpts.SetOnConnectHandler(mgr.subscribe)
-	clientOpts.SetConnectionLostHandler(mgr.lostConnectionHandler)
-	client := mqtt.NewClient(&clientOpts)
+	if options.Tls != nil && options.Embedded == nil {
+		brokerUrl, err := url.Parse(options.Broker)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidTls, err)
+		}
+		if !tlsSchemes[strings.ToLower(brokerUrl.Scheme)] {
+			return fmt.Errorf("%w: the broker %s does not use a TLS scheme (ssl, tls, mqtts, tcps or wss)", ErrInvalidTls, options.Broker)
+		}
+	}
 
-	mgr.client = client
-	mgr.dataTable = dataTableRef
-	if err := mgr.connect(client); err != nil {
+	if options.Will != nil {
+		if options.Will.Qos > 2 {
+			return fmt.Errorf("%w: %v", ErrInvalidWill, ErrInvalidQos)
+		}
+		if options.Will.Topic == "" || IsWildcard(options.Will.Topic) {
+			return fmt.Errorf("%w: the topic can't be empty nor contain wildcards", ErrInvalidWill)
+		}
+	}
+
+	for _, root := range options.Roots {
+		if err := ValidateFilter(root); err != nil {
+			return err
+		}
+	}
+
+	for _, policy := range options.Policies {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+	}
+	_, err := NewTopicAliases(options.Aliases)
+	return err
+}
+
+// ConnectionState is the state of the connection of a MqttManager to its broker
+type ConnectionState string
+
+const (
+	BrokerConnecting   ConnectionState = "connecting"
+	BrokerConnected    ConnectionState = "connected"
+	BrokerDisconnected ConnectionState = "disconnected"
+)
+
+// BrokerHealth reports the state of the connection to the broker, since
+// when it is in that state and the last connection error, if any
+type BrokerHealth struct {
+	Name      string          `json:"name"`
+	Broker    string          `json:"broker"`
+	State     ConnectionState `json:"state"`
+	Since     time.Time       `json:"since"`
+	LastError string          `json:"lastError,omitempty"`
+}
+
+// MqttManager connects the core to one or more brokers, merging the messages
+// received from all of them into a single data table and forwarding the
+// selected topics from a broker to another
+type MqttManager struct {
+	connections []*brokerConnection
+	forwards    []*forward
+	dataTable   *DataTable
+}
+
+// StartMqttManager connects the core to a single broker
+func StartMqttManager(options Options, dataTableRef *DataTable) *MqttManager {
+	return StartMqttBridge([]Options{options}, nil, dataTableRef)
+}
+
+// StartMqttBridge connects the core to every passed broker, the first one is
+// the main broker that receives the messages published on the topics not
+// subscribed on any broker. The brokers may be unreachable, the connections
+// are retried in the background.
+func StartMqttBridge(brokers []Options, forwards []ForwardOptions, dataTableRef *DataTable) *MqttManager {
+	if err := ValidateBridge(brokers, forwards); err != nil {
 		log.Fatal(err)
 	}
 
+	mgr := &MqttManager{dataTable: dataTableRef}
+	for _, forwardOpts := range forwards {
+		// the forwards were already validated
+		fwd, _ := newForward(forwardOpts)
+		mgr.forwards = append(mgr.forwards, fwd)
+	}
+
+	connections := make([]*brokerConnection, 0, len(brokers))
+	for _, options := range brokers {
+		var filters []string
+		for _, fwd := range mgr.forwards {
+			if fwd.from == brokerName(options) {
+				filters = append(filters, fwd.filter)
+			}
+		}
+
+		conn, err := newConnection(mgr, options, filters)
+		if err != nil {
+			log.Fatal(err)
+		}
+		connections = append(connections, conn)
+	}
+
+	// the connections are started once all of them are known, as
+	// the messages received by one may be forwarded to the others
+	mgr.connections = connections
+	for _, conn := range mgr.connections {
+		if err := conn.start(); err != nil {
+			log.Fatal(err)
+		}
+	}
 	return mgr
 }
 
 func (mgr *MqttManager) StopMqttManager() {
 	log.Println("stopping the mqtt service")
-	mgr.client.Unsubscribe(baseTopic)
-	mgr.client.Disconnect(100)
+	for _, conn := range mgr.connections {
+		conn.stop()
+	}
 }
 
-func (mgr *MqttManager) Publish(payload string, topic string) {
-	// TODO
-	// if the actuate function from a service returns with a
-	// send flag, this should be called with a specific topic
-	// and payload obtained from the actuate return value
-	token := mgr.client.Publish(topic, 0, true, payload)
-	if token.Wait() && token.Error() != nil {
+// Health returns the state of the connection to each broker
+func (mgr *MqttManager) Health() []BrokerHealth {
+	health := make([]BrokerHealth, 0, len(mgr.connections))
+	for _, conn := range mgr.connections {
+		health = append(health, conn.getHealth())
 	}
+	return health
 }
 
-func (mgr *MqttManager) connect(client mqtt.Client) error {
-	var token mqtt.Token
-	opts := client.OptionsReader()
-	for retries := 0; retries < connectionRetries; retries += 1 {
-		log.Printf("attempting a connection #%d to the mqtt broker @%s\n", retries+1, opts.Servers()[0])
-		token = client.Connect()
-		if token.Wait() && token.Error() != nil {
-			continue
+// Publish sends the payload to the passed topic, using the requested QoS level
+// and retain flag, on every broker subscribed to it, or on the main broker if
+// no broker is. An aliased topic is rewritten to the original one of each broker.
+func (mgr *MqttManager) Publish(topic string, payload string, qos byte, retained bool) error {
+	if qos > 2 {
+		return ErrInvalidQos
+	}
+
+	var targets []*brokerConnection
+	for _, conn := range mgr.connections {
+		if conn.subscribed(conn.aliases.Reverse(topic)) {
+			targets = append(targets, conn)
 		}
-		return nil
 	}
-	return token.Error()
-}
 
-func (mgr *MqttManager) subscribe(c mqtt.Client) {
-	opts := c.OptionsReader()
-	log.Printf("succesfully connected to the mqtt broker @%s!", opts.Servers()[0])
-	token := c.Subscribe(baseTopic, 0, mgr.dataCallback)
-	for token.Wait() && token.Error() != nil {
+	if len(targets) == 0 {
+		targets = mgr.connections[:1]
 	}
-	log.Printf("succesfully subscribed to the %s topic\n", baseTopic)
-}
 
-func (mgr *MqttManager) dataCallback(c mqtt.Client, m mqtt.Message) {
-	if mgr.dataTable != nil {
-		topic := m.Topic()
-		payload := string(m.Payload())
-		log.Printf("received MQTT message from topic %s, with payload: %s\n", topic, payload)
-		mgr.dataTable.Add(topic, payload)
+	var publishErr error
+	for _, conn := range targets {
+		if err := conn.publish(conn.aliases.Reverse(topic), payload, qos, retained); err != nil && publishErr == nil {
+			publishErr = err
+		}
 	}
+	return publishErr
 }
 
-func (mgr *MqttManager) lostConnectionHandler(c mqtt.Client, e error) {
-	opts := c.OptionsReader()
-	log.Printf("lost connection with the broker @%s, trying to reconnect", opts.Servers()[0])
+// receive handles a message received from a broker: it is added to the data
+// table, tagged with the broker, if its topic matches one of the subscription
+// roots of the broker, and forwarded to the other brokers if it matches any
+// of the forwards. A retained message is the replay of a state stored by the
+// broker, received when subscribing, rather than a live update.
+func (mgr *MqttManager) receive(conn *brokerConnection, topic string, payload string, qos byte, retained bool) {
+	for _, fwd := range mgr.forwards {
+		if fwd.from != conn.name {
+			continue
+		}
+
+		target, isForwarded := fwd.rewrite(topic)
+		if !isForwarded {
+			continue
+		}
+
+		for _, dest := range mgr.connections {
+			if dest.name != fwd.to {
+				continue
+			}
+			if err := dest.forward(target, payload, qos, retained); err != nil {
+				log.Printf("error: could not forward %s from %s to %s on %s, %v\n", topic, conn.name, target, dest.name, err)
+			}
+		}
+	}
+
+	if mgr.dataTable != nil && conn.subscribed(topic) {
+		topic = conn.aliases.Resolve(topic)
+		log.Printf("received MQTT message from topic %s on %s, with payload: %s, retained: %v\n", topic, conn.name, payload, retained)
+		mgr.dataTable.AddFrom(conn.name, topic, payload, retained)
+	}
 }
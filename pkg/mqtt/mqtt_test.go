@@ -0,0 +1,136 @@
+package mqtt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOptions_Validate(t *testing.T) {
+	invalidQos := byte(3)
+	testCases := []struct {
+		Options  Options
+		Expected error
+	}{
+		{Options{Roots: []string{"moody/device/#", "zigbee2mqtt/#"}}, nil},
+		{Options{Roots: []string{"moody/#/device"}}, ErrInvalidFilter},
+		{Options{Aliases: map[string]string{"zigbee2mqtt/#": "moody/device"}}, ErrInvalidAlias},
+		{Options{Will: &WillOptions{Topic: "moody/core/status", Qos: 1}}, nil},
+		{Options{Will: &WillOptions{Topic: "moody/core/status", Qos: 3}}, ErrInvalidWill},
+		{Options{Will: &WillOptions{Topic: "moody/+/status"}}, ErrInvalidWill},
+		{Options{Policies: []TopicPolicy{{Filter: "moody/device/#/set"}}}, ErrInvalidPolicy},
+		{Options{Policies: []TopicPolicy{{Filter: "moody/device/#", Qos: &invalidQos}}}, ErrInvalidPolicy},
+		{Options{Broker: "ssl://localhost:8883", Tls: &TlsOptions{InsecureSkipVerify: true}}, nil},
+		{Options{Broker: "MQTTS://localhost:8883", Tls: &TlsOptions{}}, nil},
+		{Options{Broker: "tcp://localhost:1883", Tls: &TlsOptions{CaFile: "ca.pem"}}, ErrInvalidTls},
+		{Options{Broker: "ws://localhost:9001", Tls: &TlsOptions{InsecureSkipVerify: true}}, ErrInvalidTls},
+		{Options{Embedded: &EmbeddedOptions{}, Tls: &TlsOptions{}}, nil},
+		{Options{Embedded: &EmbeddedOptions{Address: "127.0.0.1:1883"}}, nil},
+		{Options{Embedded: &EmbeddedOptions{Address: "localhost:1883"}}, nil},
+		{Options{Embedded: &EmbeddedOptions{Address: "[::1]:1883"}}, nil},
+		{Options{Embedded: &EmbeddedOptions{Address: ":1883"}}, ErrInsecureBroker},
+		{Options{Embedded: &EmbeddedOptions{Address: "0.0.0.0:1883"}}, ErrInsecureBroker},
+		{Options{Embedded: &EmbeddedOptions{Address: "0.0.0.0:1883", Username: "moody", Password: "secret"}}, nil},
+	}
+
+	for _, test := range testCases {
+		if err := test.Options.Validate(); !errors.Is(err, test.Expected) {
+			t.Errorf("expected %v, got %v", test.Expected, err)
+		}
+	}
+}
+
+func TestOptions_clientOptions(t *testing.T) {
+	cleanSession := false
+	options := Options{
+		Broker:       "tcp://localhost:1883",
+		Username:     "moody",
+		Password:     "secret",
+		KeepAlive:    10 * time.Second,
+		CleanSession: &cleanSession,
+		Will:         &WillOptions{Topic: "moody/core/status", Payload: "offline", Qos: 1, Retained: true},
+	}
+
+	clientOpts, err := options.clientOptions()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	if clientOpts.ClientID != DefaultClientId() {
+		t.Errorf("expected client id %s, got %s", DefaultClientId(), clientOpts.ClientID)
+	}
+
+	if clientOpts.Username != "moody" || clientOpts.Password != "secret" {
+		t.Errorf("expected the credentials to be set, got %s:%s", clientOpts.Username, clientOpts.Password)
+	}
+
+	if clientOpts.KeepAlive != 10 || clientOpts.CleanSession {
+		t.Errorf("expected keepalive 10 and no clean session, got %d and %v", clientOpts.KeepAlive, clientOpts.CleanSession)
+	}
+
+	if !clientOpts.WillEnabled || clientOpts.WillTopic != "moody/core/status" || string(clientOpts.WillPayload) != "offline" || !clientOpts.WillRetained {
+		t.Errorf("expected the last will to be set, got %s %s", clientOpts.WillTopic, clientOpts.WillPayload)
+	}
+
+	options.ClientId = "moody-kitchen"
+	if clientOpts, _ := options.clientOptions(); clientOpts.ClientID != "moody-kitchen" {
+		t.Errorf("expected client id moody-kitchen, got %s", clientOpts.ClientID)
+	}
+}
+
+func TestTlsOptions_tlsConfig(t *testing.T) {
+	invalidCa := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(invalidCa, []byte("not a certificate"), 0644); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	testCases := []TlsOptions{
+		{CaFile: invalidCa},
+		{CaFile: filepath.Join(t.TempDir(), "missing.pem")},
+		{CertFile: "client.pem"},
+		{KeyFile: "client.key"},
+	}
+
+	for _, test := range testCases {
+		if _, err := test.tlsConfig(); !errors.Is(err, ErrInvalidTls) {
+			t.Errorf("expected %v for %+v, got %v", ErrInvalidTls, test, err)
+		}
+	}
+
+	config, err := (&TlsOptions{InsecureSkipVerify: true}).tlsConfig()
+	if err != nil || !config.InsecureSkipVerify {
+		t.Errorf("expected an insecure TLS configuration, got %v", err)
+	}
+}
+
+func TestMqttManager_Reconnect(t *testing.T) {
+	address := freeAddress(t)
+	dataTable := NewDataTable()
+	mgr := StartMqttManager(Options{Broker: "tcp://" + address}, dataTable)
+	defer mgr.StopMqttManager()
+
+	if health := mgr.Health()[0]; health.State == BrokerConnected {
+		t.Fatalf("expected the broker to be unreachable, got %+v", health)
+	}
+
+	if err := mgr.Publish("moody/device/fan", "on", 0, false); err != ErrNotConnected {
+		t.Errorf("expected %v, got %v", ErrNotConnected, err)
+	}
+
+	broker := StartMqttManager(Options{Embedded: &EmbeddedOptions{Address: address}}, nil)
+	defer broker.StopMqttManager()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for mgr.Health()[0].State != BrokerConnected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the manager to connect, got %+v", mgr.Health())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := mgr.Publish("moody/device/fan", "on", 1, false); err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+}
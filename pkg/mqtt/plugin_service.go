@@ -4,35 +4,166 @@
 package mqtt
 
 import (
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
 	"fmt"
+	"os"
+	"path/filepath"
 	"plugin"
+	"strings"
+	"sync"
+
+	"github.com/antima/moody-core/pkg/schema"
 )
 
+const pluginExt = ".so"
+
 var (
-	ErrInvalidNameVar    = fmt.Errorf("the Name variable defined in the service is not valid")
-	ErrInvalidVersionVar = fmt.Errorf("the Version variable defined in the service is not valid")
-	ErrInvalidTopicsVar  = fmt.Errorf("the Topics array defined in the service is not valid")
-	ErrInvalidInitFunc   = fmt.Errorf("the init function defined in the service is not valid")
-	ErrActuateInitFunc   = fmt.Errorf("the actuate function defined in the service is not valid")
+	ErrInvalidPublishVar = fmt.Errorf("the Publish variable defined in the service is not valid")
+	ErrInvalidPlugin     = fmt.Errorf("the file is not a go plugin")
 )
 
+// pluginSymbols are the symbols that a plugin must export
+var pluginSymbols = []string{"Name", "Version", "Topics", "Init", "Actuate"}
+
+func init() {
+	serviceLoaders[pluginExt] = func(filename string) (MoodyService, error) {
+		service, err := NewPluginService(filename)
+		if err != nil {
+			return nil, err
+		}
+		return service, nil
+	}
+	artifactValidators[pluginExt] = validatePlugin
+}
+
+// validatePlugin checks that the passed file is a shared object exporting
+// the symbols of a plugin service, reading its ELF header and symbol tables
+// instead of opening it, since opening a plugin runs its init functions
+func validatePlugin(filename string, _ *ServiceManifest) error {
+	file, err := elf.Open(filename)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPlugin, err)
+	}
+	defer file.Close()
+
+	if file.Type != elf.ET_DYN {
+		return ErrInvalidPlugin
+	}
+
+	// the exported symbols are prefixed by the path of the plugin package,
+	// the stripped plugins only keep the dynamic symbol table
+	symbols := make(map[string]bool)
+	for _, table := range []func() ([]elf.Symbol, error){file.Symbols, file.DynamicSymbols} {
+		tableSymbols, _ := table()
+		for _, symbol := range tableSymbols {
+			if elf.ST_BIND(symbol.Info) == elf.STB_GLOBAL && symbol.Section != elf.SHN_UNDEF {
+				symbols[symbol.Name] = true
+			}
+		}
+	}
+
+	for name := range symbols {
+		if !strings.HasSuffix(name, ".Actuate") {
+			continue
+		}
+
+		pluginPath := strings.TrimSuffix(name, "Actuate")
+		isPlugin := true
+		for _, symbol := range pluginSymbols {
+			isPlugin = isPlugin && symbols[pluginPath+symbol]
+		}
+		if isPlugin {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: the %s symbols are not exported", ErrInvalidPlugin, strings.Join(pluginSymbols, ", "))
+}
+
+// go plugins can't be unloaded and the runtime caches them by path, so the
+// opened plugins are kept by the hash of their content and each content is
+// opened from its own copy, allowing to load again a plugin that was moved
+// in the service directory and to load a plugin replaced with the same name.
+// The copy is written in a private temporary directory, that is removed
+// once the plugin is opened.
+var (
+	pluginsMutex  sync.Mutex
+	openedPlugins = make(map[string]*plugin.Plugin)
+)
+
+// openPlugin opens the passed plugin file, reusing the already opened
+// plugin with the same content, if any
+func openPlugin(filename string) (*plugin.Plugin, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(content)
+	sum := hex.EncodeToString(hash[:])
+
+	pluginsMutex.Lock()
+	defer pluginsMutex.Unlock()
+	if opened, isOpened := openedPlugins[sum]; isOpened {
+		return opened, nil
+	}
+
+	copyDir, err := os.MkdirTemp("", "moody-plugins-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(copyDir)
+
+	copyName := filepath.Join(copyDir, sum+pluginExt)
+	copyFile, err := os.OpenFile(copyName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = copyFile.Write(content)
+	if closeErr := copyFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	opened, err := plugin.Open(copyName)
+	if err != nil {
+		return nil, err
+	}
+	openedPlugins[sum] = opened
+	return opened, nil
+}
+
+// PublishFunc is the type of the optional Publish variable that a
+// plugin can declare to be able to send messages over MQTT
+type PublishFunc = func(topic string, payload string, qos byte, retained bool) error
+
 // PluginService represent a kind of plugin that is implemented
-// as a go plugin module
+// as a go plugin module. The Init function of the plugin can either
+// take no arguments or receive the configuration of the service as a
+// map[string]interface{}, validated against the JSON schema in the
+// optional ConfigSchema string variable.
 type PluginService struct {
 	dataChan    chan StateTuple
 	Name        string `json:"name"`
 	ServiceName string `json:"serviceName"`
 	Version     string `json:"version"`
 	topics      []string
-	init        func() error
+	schema      *schema.Schema
+	counter     updateCounter
+	init        func(config ServiceConfig) error
 	actuate     func(topic string, state string) error
+	publish     *PublishFunc
+	stopChan    chan bool
 }
 
 // NewPluginService creates a new service from the passed plugin
 // file, returning an error if there is no such file or if it does
 // not conform to the moody service interface
 func NewPluginService(filename string) (*PluginService, error) {
-	pluginService, err := plugin.Open(filename)
+	pluginService, err := openPlugin(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -68,12 +199,17 @@ func NewPluginService(filename string) (*PluginService, error) {
 	}
 
 	init, err := pluginService.Lookup("Init")
-	initFunc, isInitFunc := init.(func() error)
 	if err != nil {
 		return nil, err
 	}
 
-	if !isInitFunc {
+	var initFunc func(config ServiceConfig) error
+	switch typedInit := init.(type) {
+	case func() error:
+		initFunc = func(ServiceConfig) error { return typedInit() }
+	case func(ServiceConfig) error:
+		initFunc = typedInit
+	default:
 		return nil, ErrInvalidInitFunc
 	}
 
@@ -87,25 +223,62 @@ func NewPluginService(filename string) (*PluginService, error) {
 		return nil, ErrActuateInitFunc
 	}
 
-	for idx, topic := range *topicsVar {
-		(*topicsVar)[idx] = fmt.Sprintf("%s%s", baseTopic[:len(baseTopic)-1], topic)
+	// the Publish variable is optional, services that only observe
+	// the MQTT flows do not need to declare it
+	var publishVar *PublishFunc
+	if publish, err := pluginService.Lookup("Publish"); err == nil {
+		var isPublishVar bool
+		publishVar, isPublishVar = publish.(*PublishFunc)
+		if !isPublishVar {
+			return nil, ErrInvalidPublishVar
+		}
+	}
+
+	// the ConfigSchema variable is optional as well, services without
+	// a configuration do not need to declare it
+	var configSchema *schema.Schema
+	if schemaSym, err := pluginService.Lookup("ConfigSchema"); err == nil {
+		schemaVar, isSchemaVar := schemaSym.(*string)
+		if !isSchemaVar {
+			return nil, ErrInvalidSchemaVar
+		}
+
+		if configSchema, err = schema.Parse([]byte(*schemaVar)); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSchemaVar, err)
+		}
+	}
+
+	// the symbols are shared by every load of the same plugin,
+	// so the declared topics must not be modified in place
+	serviceTopics := make([]string, 0, len(*topicsVar))
+	for _, topic := range *topicsVar {
+		serviceTopics = append(serviceTopics, serviceTopic(topic))
 	}
 
 	return &PluginService{
 		dataChan:    make(chan StateTuple),
+		stopChan:    make(chan bool),
 		Name:        filename,
 		ServiceName: *nameVar,
 		Version:     *versionVar,
-		topics:      *topicsVar,
+		topics:      serviceTopics,
+		schema:      configSchema,
 		init:        initFunc,
 		actuate:     actuateFunc,
+		publish:     publishVar,
 	}, nil
 }
 
 // Init initializes the service by calling the underlying
-// init function
-func (service *PluginService) Init() error {
-	return service.init()
+// init function with the passed configuration
+func (service *PluginService) Init(config ServiceConfig) error {
+	return service.init(config)
+}
+
+// ConfigSchema returns the schema of the configuration declared by
+// the plugin, or nil if it does not declare one
+func (service *PluginService) ConfigSchema() *schema.Schema {
+	return service.schema
 }
 
 // Topics returns a list of the topics that the service is
@@ -119,18 +292,48 @@ func (service *PluginService) Actuate(topic string, state string) error {
 	return service.actuate(topic, state)
 }
 
-// ListenForUpdates starts the event loop for the service
+// SetPublisher binds the Publish variable of the plugin, if declared,
+// to the passed publisher
+func (service *PluginService) SetPublisher(publisher Publisher) {
+	if service.publish == nil || publisher == nil {
+		return
+	}
+	*service.publish = publisher.Publish
+}
+
+// Subscribe attaches the service to its topics, that can contain wildcards
+func (service *PluginService) Subscribe(dataTable *DataTable) {
+	for _, topic := range service.Topics() {
+		dataTable.Subscribe(topic, service.dataChan)
+	}
+}
+
+// ListenForUpdates starts the event loop for the service, the
+// replays of retained states are not actuated
 func (service *PluginService) ListenForUpdates() {
-	for data := range service.dataChan {
-		service.actuate(data.topic, data.state)
+	for {
+		select {
+		case data := <-service.dataChan:
+			if data.retained {
+				continue
+			}
+			service.counter.count(service.actuate(data.topic, data.state))
+		case <-service.stopChan:
+			return
+		}
 	}
 }
 
-// Stop terminates the service
+// Stats returns the number of updates processed by the service
+func (service *PluginService) Stats() ServiceStats {
+	return service.counter.stats(service.ServiceName, service.Version)
+}
+
+// Stop terminates the service, the data channel is left open since
+// the data table may still be notifying it
 func (service *PluginService) Stop(dataTable *DataTable) {
 	for _, topic := range service.Topics() {
-		topicManager := dataTable.getManagerRef(topic)
-		topicManager.Detach(service.dataChan)
+		dataTable.Unsubscribe(topic, service.dataChan)
 	}
-	close(service.dataChan)
+	close(service.stopChan)
 }
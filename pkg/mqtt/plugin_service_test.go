@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+package mqtt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPluginService_SetPublisher(t *testing.T) {
+	// the Publish variable declared by the plugin, as looked up by NewPluginService
+	var publish PublishFunc
+	service := &PluginService{publish: &publish}
+
+	unreachable := StartMqttManager(Options{Broker: "tcp://" + freeAddress(t)}, nil)
+	defer unreachable.StopMqttManager()
+
+	service.SetPublisher(unreachable)
+	if publish == nil {
+		t.Fatalf("expected the Publish variable to be bound")
+	}
+
+	if err := publish("moody/device/fan", "on", 0, false); err != ErrNotConnected {
+		t.Errorf("expected %v, got %v", ErrNotConnected, err)
+	}
+
+	dataTable := NewDataTable()
+	mgr := StartMqttManager(Options{Embedded: &EmbeddedOptions{}}, dataTable)
+	defer mgr.StopMqttManager()
+
+	service.SetPublisher(mgr)
+	if err := publish("moody/device/fan", "off", 1, false); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	if state, isPresent := dataTable.Get("moody/device/fan"); !isPresent || state != "off" {
+		t.Errorf("expected the published state to reach the manager, got %s", state)
+	}
+
+	service.SetPublisher(nil)
+	if publish == nil {
+		t.Errorf("expected a nil publisher to keep the bound Publish variable")
+	}
+}
+
+func TestValidatePlugin(t *testing.T) {
+	notElf := filepath.Join(t.TempDir(), "service.so")
+	if err := os.WriteFile(notElf, []byte("Name = \"fan\""), 0644); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// the test binary is an ELF file that does not export the plugin symbols
+	for _, filename := range []string{notElf, os.Args[0]} {
+		if err := validatePlugin(filename, nil); !errors.Is(err, ErrInvalidPlugin) {
+			t.Errorf("%s: expected %v, got %v", filename, ErrInvalidPlugin, err)
+		}
+	}
+}
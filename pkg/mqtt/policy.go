@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidPolicy = fmt.Errorf("the topic policy is not valid")
+)
+
+// TopicPolicy sets the QoS level and the retain flag of the messages published
+// on the broker topics matching the Filter, taking precedence over the ones
+// requested by the publisher; a nil field leaves the requested value. The
+// roots overlapping the Filter are subscribed with at least its QoS level.
+type TopicPolicy struct {
+	Filter string
+	Qos    *byte
+	Retain *bool
+}
+
+// topicPolicies are the policies of a broker, the first policy
+// matching a topic applies to it
+type topicPolicies []TopicPolicy
+
+func (policy *TopicPolicy) validate() error {
+	if err := ValidateFilter(policy.Filter); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPolicy, err)
+	}
+
+	if policy.Qos != nil && *policy.Qos > 2 {
+		return fmt.Errorf("%w: %s, %v", ErrInvalidPolicy, policy.Filter, ErrInvalidQos)
+	}
+	return nil
+}
+
+// apply returns the QoS level and the retain flag of a message published
+// on the passed topic, given the requested ones
+func (policies topicPolicies) apply(topic string, qos byte, retained bool) (byte, bool) {
+	for _, policy := range policies {
+		if !TopicMatches(policy.Filter, topic) {
+			continue
+		}
+
+		if policy.Qos != nil {
+			qos = *policy.Qos
+		}
+		if policy.Retain != nil {
+			retained = *policy.Retain
+		}
+		break
+	}
+	return qos, retained
+}
+
+// subscriptionQos returns the QoS level to subscribe to the passed filter
+// with, the highest one among the policies of the overlapping filters
+func (policies topicPolicies) subscriptionQos(filter string) byte {
+	var qos byte
+	for _, policy := range policies {
+		if policy.Qos != nil && *policy.Qos > qos && filtersOverlap(policy.Filter, filter) {
+			qos = *policy.Qos
+		}
+	}
+	return qos
+}
+
+// filtersOverlap reports whether at least one topic matches both filters
+func filtersOverlap(first string, second string) bool {
+	firstLevels := strings.Split(first, topicSeparator)
+	secondLevels := strings.Split(second, topicSeparator)
+
+	for idx := 0; idx < len(firstLevels) && idx < len(secondLevels); idx++ {
+		firstLevel, secondLevel := firstLevels[idx], secondLevels[idx]
+		if firstLevel == multiLevelWild || secondLevel == multiLevelWild {
+			return true
+		}
+		if firstLevel != singleLevelWild && secondLevel != singleLevelWild && firstLevel != secondLevel {
+			return false
+		}
+	}
+
+	// the '#' wildcard also matches the parent level
+	switch {
+	case len(firstLevels) == len(secondLevels):
+		return true
+	case len(firstLevels) == len(secondLevels)+1:
+		return firstLevels[len(secondLevels)] == multiLevelWild
+	case len(secondLevels) == len(firstLevels)+1:
+		return secondLevels[len(firstLevels)] == multiLevelWild
+	}
+	return false
+}
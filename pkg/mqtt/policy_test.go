@@ -0,0 +1,120 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFiltersOverlap(t *testing.T) {
+	testCases := []struct {
+		First    string
+		Second   string
+		Expected bool
+	}{
+		{"moody/device/#", "moody/device/+/temperature", true},
+		{"moody/device/kitchen/lamp", "moody/+/kitchen/+", true},
+		{"moody/device", "moody/device/#", true},
+		{"moody/#", "zigbee2mqtt/#", false},
+		{"moody/device/+", "moody/device/kitchen/lamp", false},
+		{"moody/device/kitchen", "moody/device/garage", false},
+	}
+
+	for _, test := range testCases {
+		if overlap := filtersOverlap(test.First, test.Second); overlap != test.Expected {
+			t.Errorf("expected %v for %s and %s, got %v", test.Expected, test.First, test.Second, overlap)
+		}
+		if overlap := filtersOverlap(test.Second, test.First); overlap != test.Expected {
+			t.Errorf("expected %v for %s and %s, got %v", test.Expected, test.Second, test.First, overlap)
+		}
+	}
+}
+
+func TestTopicPolicies(t *testing.T) {
+	atLeastOnce, exactlyOnce := byte(1), byte(2)
+	retain, noRetain := true, false
+	policies := topicPolicies{
+		{Filter: "moody/device/+/set", Qos: &exactlyOnce, Retain: &noRetain},
+		{Filter: "moody/device/#", Qos: &atLeastOnce},
+		{Filter: "moody/core/status", Retain: &retain},
+	}
+
+	testCases := []struct {
+		Topic    string
+		Qos      byte
+		Retained bool
+	}{
+		{"moody/device/lamp/set", 2, false},
+		{"moody/device/lamp", 1, true},
+		{"moody/core/status", 0, true},
+		{"zigbee2mqtt/lamp", 0, true},
+	}
+
+	for _, test := range testCases {
+		if qos, retained := policies.apply(test.Topic, 0, true); qos != test.Qos || retained != test.Retained {
+			t.Errorf("expected qos %d and retained %v for %s, got %d and %v", test.Qos, test.Retained, test.Topic, qos, retained)
+		}
+	}
+
+	if qos := policies.subscriptionQos("moody/#"); qos != 2 {
+		t.Errorf("expected qos 2 for moody/#, got %d", qos)
+	}
+
+	if qos := policies.subscriptionQos("zigbee2mqtt/#"); qos != 0 {
+		t.Errorf("expected qos 0 for zigbee2mqtt/#, got %d", qos)
+	}
+}
+
+func TestMqttManager_RetainedReplay(t *testing.T) {
+	address := freeAddress(t)
+	retain := true
+	broker := StartMqttManager(Options{
+		Embedded: &EmbeddedOptions{Address: address},
+		Policies: []TopicPolicy{{Filter: "moody/device/#", Retain: &retain}},
+	}, nil)
+	defer broker.StopMqttManager()
+
+	if err := broker.Publish("moody/device/lamp", "on", 1, false); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	dataTable := NewDataTable()
+	mgr := StartMqttManager(Options{Broker: "tcp://" + address}, dataTable)
+	defer mgr.StopMqttManager()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if retained, received := dataTable.Retained("moody/device/lamp"); received {
+			if !retained {
+				t.Errorf("expected the state to be marked as a retained replay")
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the retained state to be replayed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	client, err := connectClient(address, "", "")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer client.Disconnect(100)
+
+	updates := make(chan StateTuple, 1)
+	dataTable.Subscribe("moody/device/lamp", updates)
+	token := client.Publish("moody/device/lamp", 1, true, "off")
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("expected nil error, got %v", token.Error())
+	}
+
+	select {
+	case update := <-updates:
+		if update.Retained() || update.State() != "off" {
+			t.Errorf("expected a live update to off, got %s retained %v", update.State(), update.Retained())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the live update to be received")
+	}
+}
@@ -0,0 +1,657 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/antima/moody-core/pkg/internal/fsutil"
+	"github.com/antima/moody-core/pkg/schema"
+	"github.com/antima/moody-core/pkg/value"
+)
+
+const (
+	processExt      = ".svc"
+	manifestExt     = ".manifest"
+	rpcVersion      = "2.0"
+	rpcTimeout      = 5 * time.Second
+	stopTimeout     = 2 * time.Second
+	minRestartDelay = 1 * time.Second
+	maxRestartDelay = 1 * time.Minute
+	maxMessageSize  = 1024 * 1024
+)
+
+// JSON-RPC error codes used in the responses to the service requests
+const (
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+)
+
+var (
+	ErrProcessExited    = fmt.Errorf("the service process exited")
+	ErrRpcTimeout       = fmt.Errorf("the service process did not answer in time")
+	ErrNoActuator       = fmt.Errorf("no device actuator is available")
+	ErrNoManifest       = fmt.Errorf("the service manifest is missing")
+	ErrInvalidManifest  = fmt.Errorf("the service manifest is not valid")
+	ErrManifestMismatch = fmt.Errorf("the service process does not match its manifest")
+)
+
+// ServiceManifest declares the name, version and topics of a process service,
+// it is required to install a process service, whose executable can't be
+// inspected without running it, and it is stored next to the service file,
+// named after it with the .manifest extension. The process must describe
+// itself as declared in its manifest, if any.
+type ServiceManifest struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Topics  []string `json:"topics"`
+}
+
+// matches tells if the passed description is the one declared in the manifest
+func (manifest *ServiceManifest) matches(description *describeResult) bool {
+	if manifest.Name != description.Name || manifest.Version != description.Version || len(manifest.Topics) != len(description.Topics) {
+		return false
+	}
+
+	for idx, topic := range manifest.Topics {
+		if description.Topics[idx] != topic {
+			return false
+		}
+	}
+	return true
+}
+
+// validateProcess checks the manifest of a process service,
+// the executable itself is not run
+func validateProcess(filename string, manifest *ServiceManifest) error {
+	if manifest == nil {
+		return ErrNoManifest
+	}
+
+	if manifest.Name == "" {
+		return ErrInvalidNameVar
+	}
+
+	if manifest.Version == "" {
+		return ErrInvalidVersionVar
+	}
+
+	for _, topic := range manifest.Topics {
+		if err := ValidateFilter(topic); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidTopicsVar, err)
+		}
+	}
+	return nil
+}
+
+// readManifest reads the manifest of the named service file, returning
+// a nil manifest if there is none
+func readManifest(filename string) (*ServiceManifest, error) {
+	encoded, err := os.ReadFile(filename + manifestExt)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	manifest := &ServiceManifest{}
+	if err := json.Unmarshal(encoded, manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	return manifest, nil
+}
+
+// writeManifest stores the manifest of the named service file, if any
+func writeManifest(filename string, manifest *ServiceManifest) error {
+	if manifest == nil {
+		return nil
+	}
+
+	encoded, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(filename+manifestExt, encoded)
+}
+
+// rpcMessage is a JSON-RPC 2.0 request, notification or response, exchanged
+// with the service process as a single line of its stdin or stdout
+type rpcMessage struct {
+	Version string          `json:"jsonrpc"`
+	Id      *uint64         `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *rpcError) Error() string {
+	return err.Message
+}
+
+// describeResult is returned by the describe method of a service process
+type describeResult struct {
+	Name         string          `json:"name"`
+	Version      string          `json:"version"`
+	Topics       []string        `json:"topics"`
+	ConfigSchema json.RawMessage `json:"configSchema,omitempty"`
+}
+
+// initParams are sent to the init method of a service process
+type initParams struct {
+	Config ServiceConfig `json:"config"`
+}
+
+// actuateParams are sent to the actuate method of a service process
+type actuateParams struct {
+	Topic string `json:"topic"`
+	State string `json:"state"`
+}
+
+// publishParams are received with a publish request from a service process
+type publishParams struct {
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	Qos      byte   `json:"qos"`
+	Retained bool   `json:"retained"`
+}
+
+// deviceParams are received with an actuate request from a service process
+type deviceParams struct {
+	Device string      `json:"device"`
+	Value  value.Value `json:"value"`
+}
+
+// ProcessService represent a kind of service that runs as a separate executable,
+// exchanging JSON-RPC 2.0 messages with the core over its stdin and stdout, one
+// per line. The core calls the describe, init and actuate methods of the service,
+// that can call the publish, actuate and log methods of the core. The describe
+// result can declare a configSchema, the configuration is passed to init. The
+// process is restarted with an exponential backoff if it exits or stops answering.
+type ProcessService struct {
+	dataChan    chan StateTuple
+	Name        string `json:"name"`
+	ServiceName string `json:"serviceName"`
+	Version     string `json:"version"`
+	topics      []string
+	schema      *schema.Schema
+	config      ServiceConfig
+	counter     updateCounter
+	mutex       sync.Mutex
+	process     *serviceProcess
+	publisher   Publisher
+	actuator    DeviceActuator
+	stopChan    chan bool
+}
+
+// serviceProcess is a single run of the executable of a ProcessService
+type serviceProcess struct {
+	cmd          *exec.Cmd
+	stdin        io.WriteCloser
+	started      time.Time
+	writeMutex   sync.Mutex
+	pendingMutex sync.Mutex
+	pending      map[uint64]chan *rpcMessage
+	nextId       uint64
+	exited       chan bool
+}
+
+// NewProcessService starts the passed executable and asks it to describe
+// itself, returning an error if it can't be started or if it does not
+// conform to the moody service interface
+func NewProcessService(filename string) (*ProcessService, error) {
+	service := &ProcessService{
+		dataChan: make(chan StateTuple),
+		Name:     filename,
+		stopChan: make(chan bool),
+	}
+
+	process, err := service.spawn()
+	if err != nil {
+		return nil, err
+	}
+
+	var description describeResult
+	if err := process.call("describe", nil, &description); err != nil {
+		process.stop()
+		return nil, err
+	}
+
+	if description.Name == "" {
+		process.stop()
+		return nil, ErrInvalidNameVar
+	}
+
+	if description.Version == "" {
+		process.stop()
+		return nil, ErrInvalidVersionVar
+	}
+
+	manifest, err := readManifest(filename)
+	if err == nil && manifest != nil && !manifest.matches(&description) {
+		err = ErrManifestMismatch
+	}
+	if err != nil {
+		process.stop()
+		return nil, err
+	}
+
+	for _, topic := range description.Topics {
+		service.topics = append(service.topics, serviceTopic(topic))
+	}
+
+	if len(description.ConfigSchema) > 0 {
+		if service.schema, err = schema.Parse(description.ConfigSchema); err != nil {
+			process.stop()
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSchemaVar, err)
+		}
+	}
+
+	service.ServiceName = description.Name
+	service.Version = description.Version
+	service.process = process
+	go service.supervise(process)
+	return service, nil
+}
+
+func loadProcessService(filename string) (MoodyService, error) {
+	service, err := NewProcessService(filename)
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// Init initializes the service by calling the init method of the process,
+// the configuration is kept to initialize the restarted processes
+func (service *ProcessService) Init(config ServiceConfig) error {
+	service.mutex.Lock()
+	service.config = config
+	service.mutex.Unlock()
+	return service.call("init", &initParams{Config: config})
+}
+
+// ConfigSchema returns the schema of the configuration declared by the
+// process, or nil if it does not declare one
+func (service *ProcessService) ConfigSchema() *schema.Schema {
+	return service.schema
+}
+
+// Topics returns a list of the topics that the service is
+// subscribed to
+func (service *ProcessService) Topics() []string {
+	return service.topics
+}
+
+// Actuate a (topic, state) tuple by calling the actuate method of the process
+func (service *ProcessService) Actuate(topic string, state string) error {
+	return service.call("actuate", &actuateParams{Topic: topic, State: state})
+}
+
+// SetPublisher sets the publisher used to serve the publish requests
+func (service *ProcessService) SetPublisher(publisher Publisher) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.publisher = publisher
+}
+
+// SetActuator sets the actuator used to serve the actuate requests
+func (service *ProcessService) SetActuator(actuator DeviceActuator) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.actuator = actuator
+}
+
+// Subscribe attaches the service to its topics, that can contain wildcards
+func (service *ProcessService) Subscribe(dataTable *DataTable) {
+	for _, topic := range service.Topics() {
+		dataTable.Subscribe(topic, service.dataChan)
+	}
+}
+
+// ListenForUpdates starts the event loop for the service, the
+// replays of retained states are not actuated
+func (service *ProcessService) ListenForUpdates() {
+	for {
+		select {
+		case data := <-service.dataChan:
+			if data.retained {
+				continue
+			}
+
+			err := service.Actuate(data.topic, data.state)
+			if err != nil {
+				log.Printf("error: service %s could not actuate, %v\n", service.ServiceName, err)
+			}
+			service.counter.count(err)
+		case <-service.stopChan:
+			return
+		}
+	}
+}
+
+// Stats returns the number of updates processed by the service
+func (service *ProcessService) Stats() ServiceStats {
+	return service.counter.stats(service.ServiceName, service.Version)
+}
+
+// Stop terminates the service and its process, the data channel is
+// left open since the data table may still be notifying it
+func (service *ProcessService) Stop(dataTable *DataTable) {
+	for _, topic := range service.Topics() {
+		dataTable.Unsubscribe(topic, service.dataChan)
+	}
+	close(service.stopChan)
+
+	service.mutex.Lock()
+	process := service.process
+	service.process = nil
+	service.mutex.Unlock()
+
+	if process != nil {
+		process.stop()
+	}
+}
+
+func (service *ProcessService) call(method string, params interface{}) error {
+	service.mutex.Lock()
+	process := service.process
+	service.mutex.Unlock()
+
+	if process == nil {
+		return ErrProcessExited
+	}
+	return process.call(method, params, nil)
+}
+
+// supervise restarts the process of the service every time it exits,
+// until the service is stopped
+func (service *ProcessService) supervise(process *serviceProcess) {
+	delay := minRestartDelay
+	for {
+		select {
+		case <-process.exited:
+		case <-service.stopChan:
+			return
+		}
+
+		// a process that ran for a while is not crash-looping
+		if time.Since(process.started) > maxRestartDelay {
+			delay = minRestartDelay
+		}
+
+		log.Printf("error: the process of service %s exited, restarting it in %v\n", service.ServiceName, delay)
+		select {
+		case <-time.After(delay):
+		case <-service.stopChan:
+			return
+		}
+
+		delay *= 2
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+
+		service.mutex.Lock()
+		config := service.config
+		service.mutex.Unlock()
+
+		restarted, err := service.spawn()
+		if err == nil {
+			if err = restarted.call("init", &initParams{Config: config}, nil); err != nil {
+				restarted.stop()
+			}
+		}
+
+		if err != nil {
+			log.Printf("error: could not restart service %s, %v\n", service.ServiceName, err)
+			process = &serviceProcess{started: time.Now(), exited: make(chan bool)}
+			close(process.exited)
+			continue
+		}
+
+		service.mutex.Lock()
+		select {
+		case <-service.stopChan:
+			service.mutex.Unlock()
+			restarted.stop()
+			return
+		default:
+			service.process = restarted
+		}
+		service.mutex.Unlock()
+
+		log.Printf("service %s restarted\n", service.ServiceName)
+		process = restarted
+	}
+}
+
+// spawn starts a new process for the service
+func (service *ProcessService) spawn() (*serviceProcess, error) {
+	cmd := exec.Command(service.Name)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	process := &serviceProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		started: time.Now(),
+		pending: make(map[uint64]chan *rpcMessage),
+		exited:  make(chan bool),
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 4096), maxMessageSize)
+		for scanner.Scan() {
+			var msg rpcMessage
+			if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+				log.Printf("error: service %s sent an invalid message, %v\n", service.Name, err)
+				continue
+			}
+
+			// requests are served in the background, so that a slow request
+			// can't delay the replies to the calls of the core, nor a process
+			// blocked on its stdout stall the core
+			if msg.Method != "" {
+				go func(msg rpcMessage) {
+					process.reply(msg.Id, service.handle(&msg))
+				}(msg)
+				continue
+			}
+			process.deliver(&msg)
+		}
+
+		_ = cmd.Wait()
+		close(process.exited)
+	}()
+	return process, nil
+}
+
+// handle serves a request sent by the service process
+func (service *ProcessService) handle(msg *rpcMessage) *rpcError {
+	service.mutex.Lock()
+	publisher := service.publisher
+	actuator := service.actuator
+	service.mutex.Unlock()
+
+	var err error
+	switch msg.Method {
+	case "publish":
+		var params publishParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+		if publisher == nil {
+			return &rpcError{Code: rpcServerError, Message: ErrNotConnected.Error()}
+		}
+		err = publisher.Publish(params.Topic, params.Payload, params.Qos, params.Retained)
+	case "actuate":
+		var params deviceParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+		if actuator == nil {
+			return &rpcError{Code: rpcServerError, Message: ErrNoActuator.Error()}
+		}
+		err = actuator.Actuate(params.Device, params.Value)
+	case "log":
+		var message string
+		if err := json.Unmarshal(msg.Params, &message); err != nil {
+			return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+		log.Printf("[%s] %s\n", service.ServiceName, message)
+	default:
+		return &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("unknown method %s", msg.Method)}
+	}
+
+	if err != nil {
+		return &rpcError{Code: rpcServerError, Message: err.Error()}
+	}
+	return nil
+}
+
+// call a method of the process, waiting for its response. A process that
+// does not answer in time is considered hung and killed.
+func (process *serviceProcess) call(method string, params interface{}, result interface{}) error {
+	msg := rpcMessage{Version: rpcVersion, Method: method}
+	if params != nil {
+		encoded, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		msg.Params = encoded
+	}
+
+	respChan := make(chan *rpcMessage, 1)
+	process.pendingMutex.Lock()
+	process.nextId += 1
+	id := process.nextId
+	process.pending[id] = respChan
+	process.pendingMutex.Unlock()
+
+	defer func() {
+		process.pendingMutex.Lock()
+		delete(process.pending, id)
+		process.pendingMutex.Unlock()
+	}()
+
+	msg.Id = &id
+	timeout := time.After(rpcTimeout)
+	if err := process.write(&msg, timeout); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-respChan:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result != nil {
+			return json.Unmarshal(resp.Result, result)
+		}
+		return nil
+	case <-process.exited:
+		return ErrProcessExited
+	case <-timeout:
+		_ = process.cmd.Process.Kill()
+		return ErrRpcTimeout
+	}
+}
+
+// reply to a request of the process, notifications are not answered
+func (process *serviceProcess) reply(id *uint64, rpcErr *rpcError) {
+	if id == nil {
+		return
+	}
+
+	msg := rpcMessage{Version: rpcVersion, Id: id, Error: rpcErr}
+	if rpcErr == nil {
+		msg.Result = json.RawMessage("null")
+	}
+	if err := process.write(&msg, time.After(rpcTimeout)); err != nil {
+		log.Printf("error: could not reply to a service request, %v\n", err)
+	}
+}
+
+func (process *serviceProcess) deliver(msg *rpcMessage) {
+	if msg.Id == nil {
+		return
+	}
+
+	process.pendingMutex.Lock()
+	defer process.pendingMutex.Unlock()
+	if respChan, isPending := process.pending[*msg.Id]; isPending {
+		// a duplicate response finds the channel full and is dropped
+		select {
+		case respChan <- msg:
+		default:
+		}
+	}
+}
+
+// write sends a message to the process before the timeout, a process that
+// stops reading its stdin is considered hung and killed
+func (process *serviceProcess) write(msg *rpcMessage, timeout <-chan time.Time) error {
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		process.writeMutex.Lock()
+		defer process.writeMutex.Unlock()
+		_, err := process.stdin.Write(append(encoded, '\n'))
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		return err
+	case <-process.exited:
+		return ErrProcessExited
+	case <-timeout:
+		_ = process.cmd.Process.Kill()
+		return ErrRpcTimeout
+	}
+}
+
+// stop closes the stdin of the process, killing it if it does
+// not exit in time
+func (process *serviceProcess) stop() {
+	_ = process.stdin.Close()
+	select {
+	case <-process.exited:
+	case <-time.After(stopTimeout):
+		_ = process.cmd.Process.Kill()
+		<-process.exited
+	}
+}
@@ -0,0 +1,231 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antima/moody-core/pkg/value"
+)
+
+// writeProcess writes an executable that re-runs the test binary
+// as the helper service process
+func writeProcess(t *testing.T) string {
+	filename := filepath.Join(t.TempDir(), "service.svc")
+	script := fmt.Sprintf("#!/bin/sh\nGO_WANT_HELPER_PROCESS=1 exec %s -test.run=TestHelperProcess\n", os.Args[0])
+	if err := os.WriteFile(filename, []byte(script), 0755); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	return filename
+}
+
+// TestHelperProcess is not a real test, it implements the service
+// process used by TestProcessService
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var msg rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil || msg.Method == "" {
+			continue
+		}
+
+		resp := rpcMessage{Version: rpcVersion, Id: msg.Id, Result: json.RawMessage("null")}
+		switch msg.Method {
+		case "describe":
+			resp.Result, _ = json.Marshal(&describeResult{Name: "fan", Version: "1.0.0", Topics: []string{"kitchen/temperature"}})
+		case "actuate":
+			var params actuateParams
+			_ = json.Unmarshal(msg.Params, &params)
+			switch params.State {
+			case "crash":
+				os.Exit(1)
+			case "stall":
+				// answer twice, then stop reading the stdin
+				_ = encoder.Encode(&resp)
+				_ = encoder.Encode(&resp)
+				select {}
+			case "slow":
+				actuate, _ := json.Marshal(&deviceParams{Device: "10.0.0.1", Value: value.NewString("on")})
+				requestId := *msg.Id + 1000
+				_ = encoder.Encode(&rpcMessage{Version: rpcVersion, Id: &requestId, Method: "actuate", Params: actuate})
+			case "off":
+				resp.Result = nil
+				resp.Error = &rpcError{Code: rpcServerError, Message: "not a number: off"}
+			default:
+				publish, _ := json.Marshal(&publishParams{Topic: "moody/device/fan", Payload: params.State, Qos: 1})
+				_ = encoder.Encode(&rpcMessage{Version: rpcVersion, Method: "publish", Params: publish})
+			}
+		}
+		_ = encoder.Encode(&resp)
+	}
+	os.Exit(0)
+}
+
+func TestProcessService(t *testing.T) {
+	service, err := NewProcessService(writeProcess(t))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer service.Stop(NewDataTable())
+
+	if service.ServiceName != "fan" || service.Version != "1.0.0" {
+		t.Errorf("expected fan v1.0.0, got %s v%s", service.ServiceName, service.Version)
+	}
+
+	topics := service.Topics()
+	if len(topics) != 1 || topics[0] != "moody/device/kitchen/temperature" {
+		t.Errorf("expected [moody/device/kitchen/temperature], got %v", topics)
+	}
+
+	publisher := &mockPublisher{}
+	service.SetPublisher(publisher)
+	if err := service.Init(nil); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	if err := service.Actuate(topics[0], "on"); err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+
+	if err := service.Actuate(topics[0], "off"); err == nil || err.Error() != "not a number: off" {
+		t.Errorf("expected 'not a number: off' error, got %v", err)
+	}
+
+	if err := service.Actuate(topics[0], "crash"); err != ErrProcessExited {
+		t.Errorf("expected %v, got %v", ErrProcessExited, err)
+	}
+
+	// the process is restarted after the minimum restart delay
+	deadline := time.Now().Add(minRestartDelay + rpcTimeout)
+	for service.Actuate(topics[0], "on") != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the service process to be restarted")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the publish requests are served in the background
+	deadline = time.Now().Add(rpcTimeout)
+	for {
+		topics, payloads := publisher.published()
+		if len(payloads) == 2 && topics[0] == "moody/device/fan" && payloads[0] == "on" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected two messages to moody/device/fan, got %v %v", topics, payloads)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestProcessService_Stall(t *testing.T) {
+	service, err := NewProcessService(writeProcess(t))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer service.Stop(NewDataTable())
+
+	topic := service.Topics()[0]
+	if err := service.Actuate(topic, "stall"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// the duplicate response is dropped, while a state larger than the pipe
+	// buffer can't be written to the process, that is killed and restarted
+	large := strings.Repeat("x", 1024*1024)
+	if err := service.Actuate(topic, large); err != ErrRpcTimeout {
+		t.Fatalf("expected %v, got %v", ErrRpcTimeout, err)
+	}
+
+	deadline := time.Now().Add(minRestartDelay + rpcTimeout)
+	for service.Actuate(topic, "on") != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the service process to be restarted")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// slowActuator blocks the actuations until it is released
+type slowActuator struct {
+	release chan bool
+}
+
+func (actuator *slowActuator) Actuate(ip string, state value.Value) error {
+	<-actuator.release
+	return nil
+}
+
+func TestProcessService_SlowRequest(t *testing.T) {
+	service, err := NewProcessService(writeProcess(t))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer service.Stop(NewDataTable())
+
+	actuator := &slowActuator{release: make(chan bool)}
+	defer close(actuator.release)
+	service.SetActuator(actuator)
+	if err := service.Init(nil); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// the process sends a request that blocks in the actuator before replying
+	start := time.Now()
+	if err := service.Actuate(service.Topics()[0], "slow"); err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= rpcTimeout {
+		t.Errorf("expected the reply not to wait for the slow request, took %v", elapsed)
+	}
+}
+
+func TestProcessService_Manifest(t *testing.T) {
+	filename := writeProcess(t)
+	testCases := []struct {
+		Manifest *ServiceManifest
+		Expected error
+	}{
+		{nil, ErrNoManifest},
+		{&ServiceManifest{Version: "1.0.0"}, ErrInvalidNameVar},
+		{&ServiceManifest{Name: "fan"}, ErrInvalidVersionVar},
+		{&ServiceManifest{Name: "fan", Version: "1.0.0", Topics: []string{"kitchen/#/temperature"}}, ErrInvalidTopicsVar},
+		{&ServiceManifest{Name: "fan", Version: "1.0.0", Topics: []string{"kitchen/temperature"}}, nil},
+	}
+
+	for _, test := range testCases {
+		if err := validateProcess(filename, test.Manifest); !errors.Is(err, test.Expected) {
+			t.Errorf("expected %v, got %v", test.Expected, err)
+		}
+	}
+
+	// the process must describe itself as declared in its manifest
+	if err := writeManifest(filename, &ServiceManifest{Name: "fan", Version: "2.0.0", Topics: []string{"kitchen/temperature"}}); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if _, err := NewProcessService(filename); err != ErrManifestMismatch {
+		t.Errorf("expected %v, got %v", ErrManifestMismatch, err)
+	}
+
+	if err := writeManifest(filename, &ServiceManifest{Name: "fan", Version: "1.0.0", Topics: []string{"kitchen/temperature"}}); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	service, err := NewProcessService(filename)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	service.Stop(NewDataTable())
+}
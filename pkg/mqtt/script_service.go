@@ -0,0 +1,393 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/antima/moody-core/pkg/schema"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	scriptExt     = ".lua"
+	scriptTimeout = 5 * time.Second
+)
+
+var (
+	ErrScriptStopped = fmt.Errorf("the script service was stopped")
+	ErrScriptTimeout = fmt.Errorf("the script did not return in time")
+)
+
+// ScriptService represent a kind of service that is implemented as a Lua
+// script, declaring the same Name, Version, Topics, Init and Actuate symbols
+// of a plugin service. Scripts can publish MQTT messages through the
+// moody.publish(topic, payload [, qos [, retained]]) function. The Init function
+// receives the configuration of the service as a table, validated against the
+// optional ConfigSchema table declared by the script. Scripts only have
+// access to the base, table, string and math libraries, and their top level
+// and every call of their functions are stopped after scriptTimeout.
+type ScriptService struct {
+	dataChan    chan StateTuple
+	Name        string `json:"name"`
+	ServiceName string `json:"serviceName"`
+	Version     string `json:"version"`
+	topics      []string
+	schema      *schema.Schema
+	counter     updateCounter
+	mutex       sync.Mutex
+	state       *lua.LState
+	publisher   Publisher
+	stopChan    chan bool
+}
+
+// NewScriptService creates a new service by running the passed script file,
+// returning an error if there is no such file, if the script fails or if it
+// does not conform to the moody service interface
+func NewScriptService(filename string) (*ScriptService, error) {
+	state := newSandbox()
+	service := &ScriptService{
+		dataChan: make(chan StateTuple),
+		stopChan: make(chan bool),
+		Name:     filename,
+		state:    state,
+	}
+
+	moody := state.NewTable()
+	state.SetField(moody, "publish", state.NewFunction(service.luaPublish))
+	state.SetField(moody, "log", state.NewFunction(service.luaLog))
+	state.SetGlobal("moody", moody)
+
+	err := withTimeout(state, func() error {
+		return state.DoFile(filename)
+	})
+	if err != nil {
+		state.Close()
+		return nil, err
+	}
+
+	name, isName := state.GetGlobal("Name").(lua.LString)
+	if !isName {
+		state.Close()
+		return nil, ErrInvalidNameVar
+	}
+
+	version, isVersion := state.GetGlobal("Version").(lua.LString)
+	if !isVersion {
+		state.Close()
+		return nil, ErrInvalidVersionVar
+	}
+
+	topics, isTopics := state.GetGlobal("Topics").(*lua.LTable)
+	if !isTopics {
+		state.Close()
+		return nil, ErrInvalidTopicsVar
+	}
+
+	for idx := 1; idx <= topics.Len(); idx++ {
+		topic, isTopic := topics.RawGetInt(idx).(lua.LString)
+		if !isTopic {
+			state.Close()
+			return nil, ErrInvalidTopicsVar
+		}
+		service.topics = append(service.topics, serviceTopic(string(topic)))
+	}
+
+	if _, isInitFunc := state.GetGlobal("Init").(*lua.LFunction); !isInitFunc {
+		state.Close()
+		return nil, ErrInvalidInitFunc
+	}
+
+	if _, isActuateFunc := state.GetGlobal("Actuate").(*lua.LFunction); !isActuateFunc {
+		state.Close()
+		return nil, ErrActuateInitFunc
+	}
+
+	// the ConfigSchema table is optional, services without a
+	// configuration do not need to declare it
+	if configSchema := state.GetGlobal("ConfigSchema"); configSchema != lua.LNil {
+		schemaTable, isSchemaTable := configSchema.(*lua.LTable)
+		if !isSchemaTable {
+			state.Close()
+			return nil, ErrInvalidSchemaVar
+		}
+
+		if service.schema, err = schema.FromValue(fromLua(schemaTable)); err != nil {
+			state.Close()
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSchemaVar, err)
+		}
+	}
+
+	service.ServiceName = string(name)
+	service.Version = string(version)
+	return service, nil
+}
+
+// withTimeout runs the script code executed by run, stopping it with
+// ErrScriptTimeout if it does not return before scriptTimeout
+func withTimeout(state *lua.LState, run func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+
+	state.SetContext(ctx)
+	defer state.RemoveContext()
+	if err := run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %v", ErrScriptTimeout, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// newSandbox returns a Lua state that only opens the libraries without
+// access to the host, the scripts can't run commands nor access the files
+func newSandbox() *lua.LState {
+	state := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		state.Push(state.NewFunction(lib.open))
+		state.Push(lua.LString(lib.name))
+		state.Call(1, 0)
+	}
+
+	// the base library can still load and run other files and modules
+	for _, unsafe := range []string{"dofile", "loadfile", "require", "module"} {
+		state.SetGlobal(unsafe, lua.LNil)
+	}
+	return state
+}
+
+// validateScript checks that the passed script file can be parsed,
+// the script itself is not run
+func validateScript(filename string, _ *ServiceManifest) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = parse.Parse(file, filename)
+	return err
+}
+
+func loadScriptService(filename string) (MoodyService, error) {
+	service, err := NewScriptService(filename)
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// Init initializes the service by calling the Init function of the
+// script with the passed configuration
+func (service *ScriptService) Init(config ServiceConfig) error {
+	service.mutex.Lock()
+	if service.state == nil {
+		service.mutex.Unlock()
+		return ErrScriptStopped
+	}
+	luaConfig := toLua(service.state, config)
+	service.mutex.Unlock()
+
+	return service.call("Init", luaConfig)
+}
+
+// ConfigSchema returns the schema of the configuration declared by the
+// script, or nil if it does not declare one
+func (service *ScriptService) ConfigSchema() *schema.Schema {
+	return service.schema
+}
+
+// Topics returns a list of the topics that the service is
+// subscribed to
+func (service *ScriptService) Topics() []string {
+	return service.topics
+}
+
+// Actuate a (topic, state) tuple by calling the Actuate function of the script
+func (service *ScriptService) Actuate(topic string, state string) error {
+	return service.call("Actuate", lua.LString(topic), lua.LString(state))
+}
+
+// SetPublisher sets the publisher used by the moody.publish function
+func (service *ScriptService) SetPublisher(publisher Publisher) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.publisher = publisher
+}
+
+// Subscribe attaches the service to its topics, that can contain wildcards
+func (service *ScriptService) Subscribe(dataTable *DataTable) {
+	for _, topic := range service.Topics() {
+		dataTable.Subscribe(topic, service.dataChan)
+	}
+}
+
+// ListenForUpdates starts the event loop for the service, the
+// replays of retained states are not actuated
+func (service *ScriptService) ListenForUpdates() {
+	for {
+		select {
+		case data := <-service.dataChan:
+			if data.retained {
+				continue
+			}
+
+			err := service.Actuate(data.topic, data.state)
+			if err != nil {
+				log.Printf("error: service %s could not actuate, %v\n", service.ServiceName, err)
+			}
+			service.counter.count(err)
+		case <-service.stopChan:
+			return
+		}
+	}
+}
+
+// Stats returns the number of updates processed by the service
+func (service *ScriptService) Stats() ServiceStats {
+	return service.counter.stats(service.ServiceName, service.Version)
+}
+
+// Stop terminates the service and releases the interpreter, the data
+// channel is left open since the data table may still be notifying it
+func (service *ScriptService) Stop(dataTable *DataTable) {
+	for _, topic := range service.Topics() {
+		dataTable.Unsubscribe(topic, service.dataChan)
+	}
+	close(service.stopChan)
+
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.state.Close()
+	service.state = nil
+}
+
+// call runs a global function of the script, a script function signals
+// an error either by raising it or by returning a non-nil value
+func (service *ScriptService) call(function string, args ...lua.LValue) error {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	if service.state == nil {
+		return ErrScriptStopped
+	}
+
+	err := withTimeout(service.state, func() error {
+		return service.state.CallByParam(lua.P{
+			Fn:      service.state.GetGlobal(function),
+			NRet:    1,
+			Protect: true,
+		}, args...)
+	})
+	if err != nil {
+		return err
+	}
+
+	ret := service.state.Get(-1)
+	service.state.Pop(1)
+	if ret != lua.LNil && ret != lua.LFalse {
+		return fmt.Errorf("%s", ret.String())
+	}
+	return nil
+}
+
+// luaPublish implements moody.publish(topic, payload [, qos [, retained]]),
+// it is called by the interpreter while the service mutex is held
+func (service *ScriptService) luaPublish(state *lua.LState) int {
+	topic := state.CheckString(1)
+	payload := state.CheckString(2)
+	qos := state.OptInt(3, 0)
+	retained := state.OptBool(4, false)
+
+	if service.publisher == nil {
+		state.RaiseError("%v", ErrNotConnected)
+		return 0
+	}
+
+	if qos < 0 || qos > 2 {
+		state.RaiseError("%v", ErrInvalidQos)
+		return 0
+	}
+
+	if err := service.publisher.Publish(topic, payload, byte(qos), retained); err != nil {
+		state.RaiseError("%v", err)
+	}
+	return 0
+}
+
+// luaLog implements moody.log(message)
+func (service *ScriptService) luaLog(state *lua.LState) int {
+	log.Printf("[%s] %s\n", service.ServiceName, state.CheckString(1))
+	return 0
+}
+
+// toLua converts a decoded JSON document to the corresponding Lua value,
+// objects and arrays are both converted to tables
+func toLua(state *lua.LState, doc interface{}) lua.LValue {
+	switch typed := doc.(type) {
+	case bool:
+		return lua.LBool(typed)
+	case float64:
+		return lua.LNumber(typed)
+	case int:
+		return lua.LNumber(typed)
+	case string:
+		return lua.LString(typed)
+	case []interface{}:
+		table := state.NewTable()
+		for _, item := range typed {
+			table.Append(toLua(state, item))
+		}
+		return table
+	case map[string]interface{}:
+		table := state.NewTable()
+		for name, item := range typed {
+			table.RawSetString(name, toLua(state, item))
+		}
+		return table
+	}
+	return lua.LNil
+}
+
+// fromLua converts a Lua value to the corresponding JSON document, a table
+// with a sequence part is converted to an array, any other one to an object
+func fromLua(luaValue lua.LValue) interface{} {
+	switch typed := luaValue.(type) {
+	case lua.LBool:
+		return bool(typed)
+	case lua.LNumber:
+		return float64(typed)
+	case lua.LString:
+		return string(typed)
+	case *lua.LTable:
+		if typed.MaxN() > 0 {
+			array := make([]interface{}, 0, typed.MaxN())
+			for idx := 1; idx <= typed.MaxN(); idx++ {
+				array = append(array, fromLua(typed.RawGetInt(idx)))
+			}
+			return array
+		}
+
+		object := make(map[string]interface{})
+		typed.ForEach(func(key lua.LValue, item lua.LValue) {
+			if name, isName := key.(lua.LString); isName {
+				object[string(name)] = fromLua(item)
+			}
+		})
+		return object
+	}
+	return nil
+}
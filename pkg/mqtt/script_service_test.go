@@ -0,0 +1,181 @@
+package mqtt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockPublisher struct {
+	mutex    sync.Mutex
+	topics   []string
+	payloads []string
+}
+
+func (publisher *mockPublisher) Publish(topic string, payload string, qos byte, retained bool) error {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	publisher.topics = append(publisher.topics, topic)
+	publisher.payloads = append(publisher.payloads, payload)
+	return nil
+}
+
+// published returns the topics and payloads of the messages published so far
+func (publisher *mockPublisher) published() ([]string, []string) {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	return append([]string{}, publisher.topics...), append([]string{}, publisher.payloads...)
+}
+
+const testScript = `
+Name = "thermostat"
+Version = "1.0.0"
+Topics = {"kitchen/temperature"}
+
+local threshold
+
+function Init()
+	threshold = 25
+end
+
+function Actuate(topic, state)
+	if tonumber(state) == nil then
+		return "not a number: " .. state
+	end
+	if tonumber(state) > threshold then
+		moody.publish("moody/device/fan", "on", 1)
+	end
+end
+`
+
+func writeScript(t *testing.T, script string) string {
+	filename := filepath.Join(t.TempDir(), "service.lua")
+	if err := os.WriteFile(filename, []byte(script), 0644); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	return filename
+}
+
+func TestScriptService(t *testing.T) {
+	service, err := NewScriptService(writeScript(t, testScript))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer service.Stop(NewDataTable())
+
+	if service.ServiceName != "thermostat" || service.Version != "1.0.0" {
+		t.Errorf("expected thermostat v1.0.0, got %s v%s", service.ServiceName, service.Version)
+	}
+
+	topics := service.Topics()
+	if len(topics) != 1 || topics[0] != "moody/device/kitchen/temperature" {
+		t.Errorf("expected [moody/device/kitchen/temperature], got %v", topics)
+	}
+
+	publisher := &mockPublisher{}
+	service.SetPublisher(publisher)
+	if err := service.Init(nil); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	_ = service.Actuate(topics[0], "20")
+	_ = service.Actuate(topics[0], "30")
+	if len(publisher.payloads) != 1 || publisher.topics[0] != "moody/device/fan" || publisher.payloads[0] != "on" {
+		t.Errorf("expected one message to moody/device/fan, got %v %v", publisher.topics, publisher.payloads)
+	}
+
+	if err := service.Actuate(topics[0], "off"); err == nil || err.Error() != "not a number: off" {
+		t.Errorf("expected 'not a number: off' error, got %v", err)
+	}
+}
+
+func TestScriptService_Stop(t *testing.T) {
+	service, err := NewScriptService(writeScript(t, testScript))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// the update is being notified to the service when it stops
+	dataTable := NewDataTable()
+	service.Subscribe(dataTable)
+	dataTable.Add("moody/device/kitchen/temperature", "30")
+	service.Stop(dataTable)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		service.ListenForUpdates()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a stopped service not to listen for updates")
+	}
+
+	// a newer update releases the pending notification
+	dataTable.Add("moody/device/kitchen/temperature", "31")
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestScriptService_Timeout(t *testing.T) {
+	if _, err := NewScriptService(writeScript(t, "while true do end")); !errors.Is(err, ErrScriptTimeout) {
+		t.Errorf("expected %v, got %v", ErrScriptTimeout, err)
+	}
+
+	script := `Name = "x"; Version = "1"; Topics = {}; function Init() end; function Actuate() while true do end end`
+	service, err := NewScriptService(writeScript(t, script))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	defer service.Stop(NewDataTable())
+
+	if err := service.Actuate("moody/device/kitchen/temperature", "30"); !errors.Is(err, ErrScriptTimeout) {
+		t.Errorf("expected %v, got %v", ErrScriptTimeout, err)
+	}
+}
+
+func TestNewScriptService(t *testing.T) {
+	testCases := []struct {
+		Script   string
+		Expected error
+	}{
+		{`Version = "1"; Topics = {}; function Init() end; function Actuate() end`, ErrInvalidNameVar},
+		{`Name = "x"; Topics = {}; function Init() end; function Actuate() end`, ErrInvalidVersionVar},
+		{`Name = "x"; Version = "1"; Topics = {1}; function Init() end; function Actuate() end`, ErrInvalidTopicsVar},
+		{`Name = "x"; Version = "1"; Topics = {}; function Actuate() end`, ErrInvalidInitFunc},
+		{`Name = "x"; Version = "1"; Topics = {}; function Init() end`, ErrActuateInitFunc},
+	}
+
+	for _, test := range testCases {
+		if _, err := NewScriptService(writeScript(t, test.Script)); err != test.Expected {
+			t.Errorf("expected %v, got %v", test.Expected, err)
+		}
+	}
+}
+
+func TestNewScriptService_Sandbox(t *testing.T) {
+	for _, global := range []string{"os", "io", "package", "require", "module", "debug", "dofile", "loadfile"} {
+		script := `Name = "x"; Version = "1"; Topics = {}; function Init() end; function Actuate() end
+if ` + global + ` ~= nil then error("` + global + ` is available") end`
+		service, err := NewScriptService(writeScript(t, script))
+		if err != nil {
+			t.Errorf("expected %s not to be available, got %v", global, err)
+			continue
+		}
+		service.Stop(NewDataTable())
+	}
+
+	script := `Name = "x"; Version = "1"; Topics = {}; function Init() end; function Actuate() end
+local words = {}
+for word in string.gmatch("a b", "%a") do table.insert(words, word) end
+assert(#words == 2 and math.floor(1.5) == 1)`
+	service, err := NewScriptService(writeScript(t, script))
+	if err != nil {
+		t.Fatalf("expected the base, table, string and math libraries, got %v", err)
+	}
+	service.Stop(NewDataTable())
+}
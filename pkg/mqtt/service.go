@@ -1,107 +1,810 @@
 package mqtt
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/antima/moody-core/pkg/internal/fsutil"
+	"github.com/antima/moody-core/pkg/schema"
+	"github.com/antima/moody-core/pkg/value"
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	ErrInvalidNameVar     = fmt.Errorf("the Name variable defined in the service is not valid")
+	ErrInvalidVersionVar  = fmt.Errorf("the Version variable defined in the service is not valid")
+	ErrInvalidTopicsVar   = fmt.Errorf("the Topics array defined in the service is not valid")
+	ErrInvalidInitFunc    = fmt.Errorf("the init function defined in the service is not valid")
+	ErrActuateInitFunc    = fmt.Errorf("the actuate function defined in the service is not valid")
+	ErrInvalidSchemaVar   = fmt.Errorf("the ConfigSchema defined in the service is not valid")
+	ErrUnsupportedService = fmt.Errorf("the service file type is not supported")
+	ErrUnknownService     = fmt.Errorf("no such service in the service directory")
+	ErrServiceRunning     = fmt.Errorf("the service is already running")
+	ErrServiceNotRunning  = fmt.Errorf("the service is not running")
+	ErrInvalidServiceName = fmt.Errorf("the service file name is not valid")
+	ErrInvalidArtifact    = fmt.Errorf("the service artifact is not valid")
+	ErrInvalidConfig      = fmt.Errorf("the service configuration is not valid")
+	ErrInstallDisabled    = fmt.Errorf("the installation of services is not enabled")
 )
 
+// ServiceConfig is the configuration passed to the Init function of a service,
+// as decoded from a JSON object
+type ServiceConfig = map[string]interface{}
+
 type MoodyService interface {
-	Init() error
+	Init(config ServiceConfig) error
+	ConfigSchema() *schema.Schema
 	Topics() []string
 	Actuate(topic string, state string) error
+	SetPublisher(publisher Publisher)
+	Subscribe(dataTable *DataTable)
 	ListenForUpdates()
+	Stats() ServiceStats
 	Stop(dataTable *DataTable)
 }
 
-func StartServiceManager(serviceDir string, services *ServiceMap, dataTable *DataTable) {
-	log.Printf("Starting the service manager module, serving services from %s\n", serviceDir)
-	go func() {
-		serviceNames := getAllServices(serviceDir)
-		if serviceNames.Size() > 0 {
-			startupServices(serviceNames, services, dataTable)
+// A DeviceActuator sets the state of the device identified by the passed ip
+type DeviceActuator interface {
+	Actuate(ip string, state value.Value) error
+}
+
+// actuatorUser is implemented by the services that can actuate devices
+type actuatorUser interface {
+	SetActuator(actuator DeviceActuator)
+}
+
+// A ServiceLoader creates a service from a file in the service directory
+type ServiceLoader func(filename string) (MoodyService, error)
+
+// serviceLoaders maps the file extensions found in the service
+// directory to the loader for that kind of service
+var serviceLoaders = map[string]ServiceLoader{
+	scriptExt:  loadScriptService,
+	processExt: loadProcessService,
+}
+
+// An ArtifactValidator checks a service artifact before it is installed,
+// without running the code that it contains, along with its manifest, if any
+type ArtifactValidator func(filename string, manifest *ServiceManifest) error
+
+// artifactValidators maps the file extensions of the services
+// to the validator for that kind of service
+var artifactValidators = map[string]ArtifactValidator{
+	scriptExt:  validateScript,
+	processExt: validateProcess,
+}
+
+// serviceNamespace is the root of the topics that the services declare
+var serviceNamespace = DefaultNamespace
+
+// SetServiceNamespace changes the root of the topics declared by the
+// services loaded from then on
+func SetServiceNamespace(namespace string) {
+	serviceNamespace = strings.TrimSuffix(namespace, topicSeparator)
+}
+
+// serviceTopic returns the full name of a topic that a service
+// declared relatively to the service namespace
+func serviceTopic(topic string) string {
+	return fmt.Sprintf("%s%s%s", serviceNamespace, topicSeparator, topic)
+}
+
+// newService loads a service with the loader matching the file extension
+func newService(filename string) (MoodyService, error) {
+	loader, isSupported := serviceLoaders[filepath.Ext(filename)]
+	if !isSupported {
+		return nil, ErrUnsupportedService
+	}
+	return loader(filename)
+}
+
+type ServiceState string
+
+const (
+	// debounceDelay is the time a service file must stay unchanged
+	// before it is loaded, so that partially written files are skipped
+	debounceDelay = 500 * time.Millisecond
+	// rescanInterval is the interval of the full scans of the service
+	// directory, that catch the changes missed by the watcher
+	rescanInterval = 1 * time.Minute
+	// pollInterval is the interval of the scans of the service directory
+	// when it can't be watched
+	pollInterval = 1 * time.Second
+)
+
+// configExt is the extension of the sidecar files holding the
+// configuration of a service, next to the service file
+const configExt = ".json"
+
+const (
+	ServiceStarting ServiceState = "starting"
+	ServiceRunning  ServiceState = "running"
+	ServiceFailed   ServiceState = "failed"
+	ServiceStopped  ServiceState = "stopped"
+)
+
+// ServiceStats describes a service and the updates that it processed
+type ServiceStats struct {
+	ServiceName  string `json:"serviceName"`
+	Version      string `json:"version"`
+	Updates      uint64 `json:"updates"`
+	ActuateError string `json:"actuateError,omitempty"`
+}
+
+// ServiceStatus reports the state of a service found in the service directory,
+// Id is the name of the service file and the key used by the API,
+// Name is the name of the service file without its extension
+type ServiceStatus struct {
+	Id        string       `json:"id"`
+	Name      string       `json:"name"`
+	State     ServiceState `json:"state"`
+	InitError string       `json:"initError,omitempty"`
+	ServiceStats
+}
+
+// updateCounter counts the updates processed by a service, keeping
+// the last error returned by its Actuate function
+type updateCounter struct {
+	mutex      sync.Mutex
+	updates    uint64
+	actuateErr error
+}
+
+func (counter *updateCounter) count(err error) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.updates += 1
+	if err != nil {
+		counter.actuateErr = err
+	}
+}
+
+func (counter *updateCounter) stats(serviceName string, version string) ServiceStats {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	stats := ServiceStats{ServiceName: serviceName, Version: version, Updates: counter.updates}
+	if counter.actuateErr != nil {
+		stats.ActuateError = counter.actuateErr.Error()
+	}
+	return stats
+}
+
+// serviceEntry keeps the state of a file in the service directory
+type serviceEntry struct {
+	state   ServiceState
+	initErr error
+	service MoodyService
+	modTime time.Time
+	size    int64
+}
+
+// changed reports if the service file was modified since it was loaded
+func (entry *serviceEntry) changed(info fs.FileInfo) bool {
+	return !info.ModTime().Equal(entry.modTime) || info.Size() != entry.size
+}
+
+// ServiceManager loads the services found in the service directory,
+// keeping the running ones in a ServiceMap and allowing to stop, start
+// and reload each of them.
+//
+// The configuration of a service is read from its sidecar file, named
+// after the service file with the .json extension, or from the default
+// configurations passed to the manager, keyed by service id.
+type ServiceManager struct {
+	serviceDir string
+	services   *ServiceMap
+	dataTable  *DataTable
+	publisher  Publisher
+	actuator   DeviceActuator
+	configs    map[string]ServiceConfig
+	mutex      sync.Mutex
+	entries    map[string]*serviceEntry
+	stopped    bool
+	timerMutex sync.Mutex
+	timers     map[string]*time.Timer
+	stopChan   chan bool
+	stopOnce   sync.Once
+	install    bool
+}
+
+// NewServiceManager creates a new manager for the passed service directory
+func NewServiceManager(serviceDir string, services *ServiceMap, dataTable *DataTable, publisher Publisher, actuator DeviceActuator, configs map[string]ServiceConfig) *ServiceManager {
+	return &ServiceManager{
+		serviceDir: serviceDir,
+		services:   services,
+		dataTable:  dataTable,
+		publisher:  publisher,
+		actuator:   actuator,
+		configs:    configs,
+		entries:    make(map[string]*serviceEntry),
+		timers:     make(map[string]*time.Timer),
+		stopChan:   make(chan bool),
+	}
+}
+
+// StartServiceManager creates a service manager and starts it
+func StartServiceManager(serviceDir string, services *ServiceMap, dataTable *DataTable, publisher Publisher, actuator DeviceActuator, configs map[string]ServiceConfig) *ServiceManager {
+	manager := NewServiceManager(serviceDir, services, dataTable, publisher, actuator, configs)
+	manager.Start()
+	return manager
+}
+
+// SetInstallEnabled enables or disables the installation of services, that is
+// disabled by default since the installed services run with the core privileges
+func (manager *ServiceManager) SetInstallEnabled(enabled bool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.install = enabled
+}
+
+// Start starts the services in the service directory and watches it for
+// services that are added, replaced or removed, falling back to polling
+// the directory if it can't be watched
+func (manager *ServiceManager) Start() {
+	log.Printf("Starting the service manager module, serving services from %s\n", manager.serviceDir)
+	var events chan fsnotify.Event
+	var errs chan error
+	interval := rescanInterval
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(manager.serviceDir); err != nil {
+			_ = watcher.Close()
 		}
+	}
+
+	if err != nil {
+		log.Printf("error: could not watch %s, polling it instead, %v\n", manager.serviceDir, err)
+		watcher = nil
+		interval = pollInterval
+	} else {
+		events = watcher.Events
+		errs = watcher.Errors
+	}
 
+	manager.scan()
+	go func() {
 		for {
 			select {
-			case <-time.After(1 * time.Second):
-				currServiceNames := getAllServices(serviceDir)
-				toAdd := currServiceNames.Difference(serviceNames)
-				toDel := serviceNames.Difference(currServiceNames)
-
-				if toAdd.Size() > 0 {
-					startupServices(toAdd, services, dataTable)
-					iter := toAdd.Iterator()
-					for next, end := iter.Next(); !end; next, end = iter.Next() {
-						serviceNames.Add(next)
-					}
+			case event := <-events:
+				if _, isSupported := serviceLoaders[filepath.Ext(event.Name)]; isSupported {
+					manager.debounce(event.Name)
 				}
-				if toDel.Size() > 0 {
-					stopServices(toDel, services, dataTable)
-					iter := toAdd.Iterator()
-					for next, end := iter.Next(); !end; next, end = iter.Next() {
-						serviceNames.Remove(next)
-					}
+			case err := <-errs:
+				log.Printf("error: while watching %s, %v\n", manager.serviceDir, err)
+			case <-time.After(interval):
+				manager.scan()
+			case <-manager.stopChan:
+				if watcher != nil {
+					_ = watcher.Close()
 				}
+				return
 			}
 		}
 	}()
 }
 
-func startupServices(serviceNames *ConcurrentSet, services *ServiceMap, dataTable *DataTable) {
-	if serviceNames == nil || serviceNames.Size() == 0 {
-		return
+// Stop stops the manager and all the running services,
+// it can be called more than once and without calling Start
+func (manager *ServiceManager) Stop() {
+	manager.stopOnce.Do(func() {
+		close(manager.stopChan)
+	})
+
+	manager.timerMutex.Lock()
+	for _, timer := range manager.timers {
+		timer.Stop()
+	}
+	manager.timerMutex.Unlock()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.stopped = true
+	for name := range manager.entries {
+		manager.unload(name)
+	}
+}
+
+// Statuses returns the status of all the services found in the
+// service directory, sorted by id
+func (manager *ServiceManager) Statuses() []ServiceStatus {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	statuses := make([]ServiceStatus, 0, len(manager.entries))
+	for name := range manager.entries {
+		statuses = append(statuses, manager.status(name))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Id < statuses[j].Id
+	})
+	return statuses
+}
+
+// Status returns the status of the service identified by id
+func (manager *ServiceManager) Status(id string) (ServiceStatus, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	name, err := manager.lookup(id)
+	if err != nil {
+		return ServiceStatus{}, err
+	}
+	return manager.status(name), nil
+}
+
+// StartService loads and starts a stopped or failed service
+func (manager *ServiceManager) StartService(id string) (ServiceStatus, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	name, err := manager.lookup(id)
+	if err != nil {
+		return ServiceStatus{}, err
+	}
+
+	if state := manager.entries[name].state; state == ServiceRunning || state == ServiceStarting {
+		return manager.status(name), ErrServiceRunning
+	}
+	manager.load(name)
+	return manager.status(name), nil
+}
+
+// StopService stops a running service, that is not started again
+// until it is explicitly asked to
+func (manager *ServiceManager) StopService(id string) (ServiceStatus, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	name, err := manager.lookup(id)
+	if err != nil {
+		return ServiceStatus{}, err
+	}
+
+	if state := manager.entries[name].state; state != ServiceRunning && state != ServiceStarting {
+		return manager.status(name), ErrServiceNotRunning
+	}
+	manager.unload(name)
+	return manager.status(name), nil
+}
+
+// ReloadService stops the service, if running, and loads it again from its file
+func (manager *ServiceManager) ReloadService(id string) (ServiceStatus, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	name, err := manager.lookup(id)
+	if err != nil {
+		return ServiceStatus{}, err
+	}
+
+	manager.unload(name)
+	manager.load(name)
+	return manager.status(name), nil
+}
+
+// Install validates the passed service artifact without running it, along
+// with its manifest, required by the process services, then moves it atomically
+// into the service directory as id and starts it, replacing the service with
+// the same id, if any
+func (manager *ServiceManager) Install(id string, artifact io.Reader, manifest *ServiceManifest) (ServiceStatus, error) {
+	manager.mutex.Lock()
+	install := manager.install
+	manager.mutex.Unlock()
+	if !install {
+		return ServiceStatus{}, ErrInstallDisabled
+	}
+
+	if id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return ServiceStatus{}, ErrInvalidServiceName
+	}
+
+	validate, isSupported := artifactValidators[filepath.Ext(id)]
+	if !isSupported {
+		return ServiceStatus{}, ErrUnsupportedService
+	}
+
+	if err := os.MkdirAll(manager.serviceDir, 0755); err != nil {
+		return ServiceStatus{}, err
+	}
+
+	// the temporary file is hidden from the directory scan by its extension,
+	// and it lives in the service directory so that the rename is atomic
+	tmpFile, err := os.CreateTemp(manager.serviceDir, ".upload-*")
+	if err != nil {
+		return ServiceStatus{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = io.Copy(tmpFile, artifact)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ServiceStatus{}, err
+	}
+
+	var mode fs.FileMode = 0644
+	if filepath.Ext(id) == processExt {
+		mode = 0755
+	}
+	if err := os.Chmod(tmpFile.Name(), mode); err != nil {
+		return ServiceStatus{}, err
+	}
+
+	if err := validate(tmpFile.Name(), manifest); err != nil {
+		return ServiceStatus{}, fmt.Errorf("%w: %v", ErrInvalidArtifact, err)
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	name := manager.servicePath(id)
+	manager.unload(name)
+	if err := writeManifest(name, manifest); err != nil {
+		return ServiceStatus{}, err
+	}
+	if err := os.Rename(tmpFile.Name(), name); err != nil {
+		return ServiceStatus{}, err
+	}
+
+	log.Printf("service %s installed\n", name)
+	manager.load(name)
+	return manager.status(name), nil
+}
+
+// Uninstall stops the service identified by id and removes
+// its file from the service directory
+func (manager *ServiceManager) Uninstall(id string) error {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	name, err := manager.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	manager.unload(name)
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(name + configExt); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(name + manifestExt); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	delete(manager.entries, name)
+	log.Printf("service %s uninstalled\n", name)
+	return nil
+}
+
+// Config returns the configuration of the service identified by id, along
+// with the schema declared by the service, nil if it does not declare one
+// or if it could not be loaded
+func (manager *ServiceManager) Config(id string) (ServiceConfig, *schema.Schema, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	name, err := manager.lookup(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config, err := manager.config(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, manager.schema(name), nil
+}
+
+// SetConfig validates the passed configuration against the schema declared
+// by the service identified by id and stores it in the sidecar file of the
+// service, reloading the service unless it was stopped
+func (manager *ServiceManager) SetConfig(id string, config ServiceConfig) (ServiceStatus, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	name, err := manager.lookup(id)
+	if err != nil {
+		return ServiceStatus{}, err
+	}
+
+	if config == nil {
+		config = ServiceConfig{}
+	}
+
+	// the configuration is stored without the defaults, that are applied on load
+	if configSchema := manager.schema(name); configSchema != nil {
+		if err := configSchema.Validate(configSchema.ApplyDefaults(config)); err != nil {
+			return ServiceStatus{}, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+	}
+
+	encoded, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return ServiceStatus{}, err
+	}
+
+	if err := fsutil.WriteFileAtomic(name+configExt, encoded); err != nil {
+		return ServiceStatus{}, err
+	}
+
+	if manager.entries[name].state != ServiceStopped {
+		manager.unload(name)
+		manager.load(name)
 	}
-	servIter := serviceNames.Iterator()
-	for next, end := servIter.Next(); !end; next, end = servIter.Next() {
-		serviceName := next.(string)
-		service, err := NewPluginService(serviceName)
-		if err != nil {
-			log.Printf("error: could not initialize service '%s', %v", serviceName, err)
-			continue
+	return manager.status(name), nil
+}
+
+// scan starts the services added to the service directory and
+// stops the ones removed from it
+func (manager *ServiceManager) scan() {
+	serviceNames := getAllServices(manager.serviceDir)
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	iter := serviceNames.Iterator()
+	for next, end := iter.Next(); !end; next, end = iter.Next() {
+		manager.refresh(next.(string))
+	}
+
+	for name := range manager.entries {
+		if !serviceNames.Contains(name) {
+			manager.refresh(name)
 		}
+	}
+}
+
+// debounce refreshes the named service once its file stops changing
+func (manager *ServiceManager) debounce(name string) {
+	if absName, err := filepath.Abs(name); err == nil {
+		name = absName
+	}
+
+	manager.timerMutex.Lock()
+	defer manager.timerMutex.Unlock()
+	if timer, isPending := manager.timers[name]; isPending {
+		timer.Reset(debounceDelay)
+		return
+	}
+
+	manager.timers[name] = time.AfterFunc(debounceDelay, func() {
+		manager.timerMutex.Lock()
+		delete(manager.timers, name)
+		manager.timerMutex.Unlock()
+
+		manager.mutex.Lock()
+		defer manager.mutex.Unlock()
+		manager.refresh(name)
+	})
+}
+
+// refresh loads the named service if its file was added, reloads it if the
+// file was replaced and unloads it if the file was removed, a stopped service
+// is not started again, the manager mutex must be held by the caller
+func (manager *ServiceManager) refresh(name string) {
+	if manager.stopped {
+		return
+	}
+
+	info, err := os.Stat(name)
+	entry, isKnown := manager.entries[name]
+	switch {
+	case err != nil && isKnown:
+		manager.unload(name)
+		delete(manager.entries, name)
+	case err != nil:
+		return
+	case !isKnown:
+		log.Printf("found service %s\n", name)
+		manager.load(name)
+	case entry.changed(info) && entry.state != ServiceStopped:
+		log.Printf("service %s changed, reloading it\n", name)
+		manager.unload(name)
+		manager.load(name)
+	}
+}
+
+// load creates and starts the service contained in the named file, the
+// manager mutex must be held by the caller and it is released while the
+// service is created and initializes, a service unloaded meanwhile is
+// stopped once initialized
+func (manager *ServiceManager) load(name string) {
+	entry := &serviceEntry{state: ServiceStarting}
+	manager.entries[name] = entry
+	if info, err := os.Stat(name); err == nil {
+		entry.modTime = info.ModTime()
+		entry.size = info.Size()
+	}
 
-		log.Printf("found service %s\n", service.ServiceName)
-		services.Add(next.(string), service)
+	manager.mutex.Unlock()
+	service, err := newService(name)
+	manager.mutex.Lock()
 
-		err = service.Init()
-		if err != nil {
-			log.Printf("error: could not initialize service '%s', %v", service.ServiceName, err)
-			return
+	if manager.unloaded(name, entry) {
+		log.Printf("service %s was unloaded while loading\n", name)
+		if err == nil {
+			service.Stop(manager.dataTable)
 		}
+		return
+	}
 
-		for _, topic := range service.topics {
-			mgr := dataTable.getManagerRef(topic)
-			mgr.Attach(service.dataChan)
+	if err != nil {
+		log.Printf("error: could not initialize service '%s', %v", name, err)
+		entry.state = ServiceFailed
+		entry.initErr = err
+		return
+	}
+
+	entry.service = service
+	config, err := manager.config(name)
+	if err == nil && service.ConfigSchema() != nil {
+		if withDefaults, isObject := service.ConfigSchema().ApplyDefaults(config).(ServiceConfig); isObject {
+			config = withDefaults
+		}
+		if err = service.ConfigSchema().Validate(config); err != nil {
+			err = fmt.Errorf("%w: %v", ErrInvalidConfig, err)
 		}
-		log.Printf("service %s starting\n", service.ServiceName)
-		go service.ListenForUpdates()
+	}
 
+	if err != nil {
+		log.Printf("error: could not configure service '%s', %v", name, err)
+		entry.state = ServiceFailed
+		entry.initErr = err
+		service.Stop(manager.dataTable)
+		return
+	}
+
+	service.SetPublisher(manager.publisher)
+	if user, isActuatorUser := service.(actuatorUser); isActuatorUser {
+		user.SetActuator(manager.actuator)
+	}
+
+	manager.mutex.Unlock()
+	err = service.Init(config)
+	manager.mutex.Lock()
+
+	if manager.unloaded(name, entry) {
+		log.Printf("service %s was unloaded while initializing\n", name)
+		service.Stop(manager.dataTable)
+		return
 	}
+
+	if err != nil {
+		log.Printf("error: could not initialize service '%s', %v", name, err)
+		entry.state = ServiceFailed
+		entry.initErr = err
+		service.Stop(manager.dataTable)
+		return
+	}
+
+	service.Subscribe(manager.dataTable)
+	manager.services.Add(name, service)
+	entry.state = ServiceRunning
+	log.Printf("service %s starting\n", name)
+	go service.ListenForUpdates()
+}
+
+// unloaded reports whether the entry of a starting service was unloaded or
+// replaced while the manager mutex was released, or the manager stopped,
+// the manager mutex must be held by the caller
+func (manager *ServiceManager) unloaded(name string, entry *serviceEntry) bool {
+	return manager.stopped || manager.entries[name] != entry || entry.state != ServiceStarting
 }
 
-func stopServices(serviceNames *ConcurrentSet, services *ServiceMap, dataTable *DataTable) {
-	if serviceNames == nil || serviceNames.Size() == 0 {
+// unload stops the service contained in the named file, if it is running,
+// the manager mutex must be held by the caller
+func (manager *ServiceManager) unload(name string) {
+	entry, isKnown := manager.entries[name]
+	if isKnown && entry.state == ServiceStarting {
+		// the service is stopped by load once initialized
+		entry.state = ServiceStopped
 		return
 	}
-	servIter := serviceNames.Iterator()
-	for next, end := servIter.Next(); !end; next, end = servIter.Next() {
-		serviceName := next.(string)
-		service, isContained := services.Get(serviceName)
-		if isContained {
-			log.Printf("service %s stopping\n", serviceName)
-			service.Stop(dataTable)
-			services.Remove(serviceName)
+
+	if !isKnown || entry.state != ServiceRunning {
+		return
+	}
+
+	if service, isRunning := manager.services.Remove(name); isRunning {
+		log.Printf("service %s stopping\n", name)
+		service.Stop(manager.dataTable)
+	}
+	entry.state = ServiceStopped
+}
+
+// lookup returns the file name of the service identified by id,
+// the manager mutex must be held by the caller
+func (manager *ServiceManager) lookup(id string) (string, error) {
+	name := manager.servicePath(id)
+	if _, isKnown := manager.entries[name]; !isKnown || filepath.Base(name) != id {
+		return "", ErrUnknownService
+	}
+	return name, nil
+}
+
+// config returns the configuration of the named service, read from its
+// sidecar file or from the default ones,
+// the manager mutex must be held by the caller
+func (manager *ServiceManager) config(name string) (ServiceConfig, error) {
+	encoded, err := os.ReadFile(name + configExt)
+	if errors.Is(err, fs.ErrNotExist) {
+		config := ServiceConfig{}
+		for key, item := range manager.configs[filepath.Base(name)] {
+			config[key] = item
 		}
+		return config, nil
+	} else if err != nil {
+		return nil, err
 	}
+
+	config := ServiceConfig{}
+	if err := json.Unmarshal(encoded, &config); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return config, nil
+}
+
+// schema returns the configuration schema declared by the named service,
+// the manager mutex must be held by the caller
+func (manager *ServiceManager) schema(name string) *schema.Schema {
+	if service := manager.entries[name].service; service != nil {
+		return service.ConfigSchema()
+	}
+	return nil
+}
+
+// servicePath returns the absolute name of the file of the service identified by id
+func (manager *ServiceManager) servicePath(id string) string {
+	name := filepath.Join(manager.serviceDir, id)
+	if absName, err := filepath.Abs(name); err == nil {
+		return absName
+	}
+	return name
+}
+
+// status returns the status of the named service,
+// the manager mutex must be held by the caller
+func (manager *ServiceManager) status(name string) ServiceStatus {
+	entry := manager.entries[name]
+	status := ServiceStatus{
+		Id:    filepath.Base(name),
+		Name:  strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)),
+		State: entry.state,
+	}
+
+	if entry.initErr != nil {
+		status.InitError = entry.initErr.Error()
+	}
+
+	// a stopped service keeps reporting the stats of its last run
+	if entry.service != nil {
+		status.ServiceStats = entry.service.Stats()
+	}
+	return status
 }
 
 func getAllServices(serviceDir string) *ConcurrentSet {
 	serviceNames := NewConcurrentSet()
 	_ = filepath.WalkDir(serviceDir, func(path string, d fs.DirEntry, err error) error {
-		if d != nil && !d.IsDir() && filepath.Ext(d.Name()) == ".so" {
+		// the services are only loaded from the top of the service directory
+		if d != nil && d.IsDir() && path != serviceDir {
+			return fs.SkipDir
+		}
+
+		if _, isSupported := serviceLoaders[filepath.Ext(path)]; d != nil && !d.IsDir() && isSupported {
 			currName := fmt.Sprintf("%s/%s", serviceDir, d.Name())
 			name, err := filepath.Abs(currName)
 			if err == nil {
@@ -0,0 +1,412 @@
+package mqtt
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const failingScript = `
+Name = "broken"
+Version = "1.0.0"
+Topics = {}
+
+function Init()
+	return "missing configuration"
+end
+
+function Actuate(topic, state)
+end
+`
+
+func TestServiceManager(t *testing.T) {
+	serviceDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(serviceDir, "thermostat.lua"), []byte(testScript), 0644); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(serviceDir, "broken.lua"), []byte(failingScript), 0644); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	dataTable := NewDataTable()
+	services := NewServiceMap()
+	manager := NewServiceManager(serviceDir, services, dataTable, &mockPublisher{}, nil, nil)
+	manager.scan()
+
+	statuses := manager.Statuses()
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 services, got %v", statuses)
+	}
+
+	if statuses[0].Id != "broken.lua" || statuses[0].State != ServiceFailed || statuses[0].InitError != "missing configuration" {
+		t.Errorf("expected broken.lua to be failed, got %+v", statuses[0])
+	}
+
+	if statuses[1].Id != "thermostat.lua" || statuses[1].Name != "thermostat" || statuses[1].State != ServiceRunning || statuses[1].ServiceName != "thermostat" {
+		t.Errorf("expected thermostat.lua to be running, got %+v", statuses[1])
+	}
+
+	dataTable.Add("moody/device/kitchen/temperature", "off")
+	deadline := time.Now().Add(time.Second)
+	status, _ := manager.Status("thermostat.lua")
+	for status.Updates != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		status, _ = manager.Status("thermostat.lua")
+	}
+
+	if status.Updates != 1 || status.ActuateError != "not a number: off" {
+		t.Errorf("expected one update with an actuate error, got %+v", status)
+	}
+
+	if status, err := manager.StopService("thermostat.lua"); err != nil || status.State != ServiceStopped || status.Updates != 1 {
+		t.Errorf("expected stopped service with 1 update, got %+v, %v", status, err)
+	}
+
+	if _, isRunning := services.Get(manager.servicePath(status.Id)); isRunning {
+		t.Errorf("expected the stopped service to be removed from the service map")
+	}
+
+	if _, err := manager.StopService("thermostat.lua"); err != ErrServiceNotRunning {
+		t.Errorf("expected %v, got %v", ErrServiceNotRunning, err)
+	}
+
+	// stopped services are not started again by the directory scan
+	manager.scan()
+	if status, _ := manager.Status("thermostat.lua"); status.State != ServiceStopped {
+		t.Errorf("expected the service to stay stopped, got %s", status.State)
+	}
+
+	if status, err := manager.StartService("thermostat.lua"); err != nil || status.State != ServiceRunning || status.Updates != 0 {
+		t.Errorf("expected running service with 0 updates, got %+v, %v", status, err)
+	}
+
+	if _, err := manager.StartService("thermostat.lua"); err != ErrServiceRunning {
+		t.Errorf("expected %v, got %v", ErrServiceRunning, err)
+	}
+
+	if status, err := manager.ReloadService("thermostat.lua"); err != nil || status.State != ServiceRunning {
+		t.Errorf("expected running service, got %+v, %v", status, err)
+	}
+
+	if _, err := manager.Status("../thermostat.lua"); err != ErrUnknownService {
+		t.Errorf("expected %v, got %v", ErrUnknownService, err)
+	}
+
+	if err := os.Remove(filepath.Join(serviceDir, "thermostat.lua")); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	manager.scan()
+	if statuses := manager.Statuses(); len(statuses) != 1 || len(services.List()) != 0 {
+		t.Errorf("expected only the failed service to be left, got %v", statuses)
+	}
+}
+
+func TestServiceManager_Install(t *testing.T) {
+	serviceDir := t.TempDir()
+	services := NewServiceMap()
+	manager := NewServiceManager(serviceDir, services, NewDataTable(), &mockPublisher{}, nil, nil)
+
+	if _, err := manager.Install("thermostat.lua", strings.NewReader(testScript), nil); err != ErrInstallDisabled {
+		t.Errorf("expected %v, got %v", ErrInstallDisabled, err)
+	}
+	manager.SetInstallEnabled(true)
+
+	testCases := []struct {
+		Id       string
+		Script   string
+		Expected error
+	}{
+		{"../thermostat.lua", testScript, ErrInvalidServiceName},
+		{".thermostat.lua", testScript, ErrInvalidServiceName},
+		{"thermostat.txt", testScript, ErrUnsupportedService},
+		{"thermostat.lua", `Name = `, ErrInvalidArtifact},
+		{"fan.svc", "#!/bin/sh\n", ErrInvalidArtifact},
+	}
+
+	for _, test := range testCases {
+		if _, err := manager.Install(test.Id, strings.NewReader(test.Script), nil); !errors.Is(err, test.Expected) {
+			t.Errorf("expected %v, got %v", test.Expected, err)
+		}
+	}
+
+	if entries, _ := os.ReadDir(serviceDir); len(entries) != 0 {
+		t.Errorf("expected no file in the service directory, got %d", len(entries))
+	}
+
+	// the artifact is validated without being run, the script fails once loaded
+	failing := "error(\"the script was run\")\n" + testScript
+	status, err := manager.Install("failing.lua", strings.NewReader(failing), nil)
+	if err != nil || status.State != ServiceFailed || !strings.Contains(status.InitError, "the script was run") {
+		t.Errorf("expected failed service, got %+v, %v", status, err)
+	}
+	if err := manager.Uninstall("failing.lua"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	if entries, _ := os.ReadDir(serviceDir); len(entries) != 0 {
+		t.Errorf("expected no file in the service directory, got %d", len(entries))
+	}
+
+	status, err = manager.Install("thermostat.lua", strings.NewReader(testScript), nil)
+	if err != nil || status.State != ServiceRunning || status.ServiceName != "thermostat" {
+		t.Fatalf("expected running service, got %+v, %v", status, err)
+	}
+
+	if _, isRunning := services.Get(manager.servicePath(status.Id)); !isRunning {
+		t.Errorf("expected the installed service to be in the service map")
+	}
+
+	// installing again replaces the running service
+	if status, err := manager.Install("thermostat.lua", strings.NewReader(testScript), nil); err != nil || status.State != ServiceRunning {
+		t.Errorf("expected running service, got %+v, %v", status, err)
+	}
+
+	if err := manager.Uninstall("thermostat.lua"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	if _, err := os.Stat(manager.servicePath(status.Id)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the service file to be removed, got %v", err)
+	}
+
+	if err := manager.Uninstall("thermostat.lua"); err != ErrUnknownService {
+		t.Errorf("expected %v, got %v", ErrUnknownService, err)
+	}
+}
+
+const configurableScript = `
+Name = "thermostat"
+Version = "1.0.0"
+Topics = {"kitchen/temperature"}
+ConfigSchema = {
+	type = "object",
+	required = {"threshold"},
+	properties = {
+		threshold = {type = "number", minimum = 0},
+		fan = {type = "string", default = "kitchen/fan"},
+	},
+}
+
+local config
+
+function Init(conf)
+	config = conf
+end
+
+function Actuate(topic, state)
+	if tonumber(state) > config.threshold then
+		moody.publish("moody/device/" .. config.fan, "on")
+	end
+end
+`
+
+func TestServiceManager_SetConfig(t *testing.T) {
+	serviceDir := t.TempDir()
+	filename := filepath.Join(serviceDir, "thermostat.lua")
+	if err := os.WriteFile(filename, []byte(configurableScript), 0644); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	defaults := map[string]ServiceConfig{"thermostat.lua": {"threshold": 30.0, "fan": "kitchen/fan"}}
+	services := NewServiceMap()
+	publisher := &mockPublisher{}
+	manager := NewServiceManager(serviceDir, services, NewDataTable(), publisher, nil, defaults)
+	manager.scan()
+
+	config, configSchema, err := manager.Config("thermostat.lua")
+	if err != nil || configSchema == nil || config["threshold"] != 30.0 {
+		t.Fatalf("expected the default configuration and a schema, got %v, %v, %v", config, configSchema, err)
+	}
+
+	if status, _ := manager.Status("thermostat.lua"); status.State != ServiceRunning {
+		t.Errorf("expected running service, got %+v", status)
+	}
+
+	if _, err := manager.SetConfig("thermostat.lua", ServiceConfig{"threshold": -1.0}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("expected %v, got %v", ErrInvalidConfig, err)
+	}
+
+	status, err := manager.SetConfig("thermostat.lua", ServiceConfig{"threshold": 20.0, "fan": "living/fan"})
+	if err != nil || status.State != ServiceRunning {
+		t.Fatalf("expected running service, got %+v, %v", status, err)
+	}
+
+	// the service is initialized with the new configuration
+	service, _ := services.Get(manager.servicePath(status.Id))
+	if err := service.Actuate("moody/device/kitchen/temperature", "25"); err != nil || len(publisher.topics) != 1 || publisher.topics[0] != "moody/device/living/fan" {
+		t.Errorf("expected one message to moody/device/living/fan, got %v, %v", publisher.topics, err)
+	}
+
+	// the sidecar file takes precedence over the defaults
+	if config, _, _ := manager.Config("thermostat.lua"); config["threshold"] != 20.0 {
+		t.Errorf("expected the stored configuration, got %v", config)
+	}
+
+	// the defaults declared by the schema are applied on load, not stored
+	status, err = manager.SetConfig("thermostat.lua", ServiceConfig{"threshold": 20.0})
+	if err != nil || status.State != ServiceRunning {
+		t.Fatalf("expected running service, got %+v, %v", status, err)
+	}
+
+	service, _ = services.Get(manager.servicePath(status.Id))
+	if err := service.Actuate("moody/device/kitchen/temperature", "25"); err != nil || len(publisher.topics) != 2 || publisher.topics[1] != "moody/device/kitchen/fan" {
+		t.Errorf("expected a message to moody/device/kitchen/fan, got %v, %v", publisher.topics, err)
+	}
+
+	if config, _, _ := manager.Config("thermostat.lua"); len(config) != 1 {
+		t.Errorf("expected the stored configuration without defaults, got %v", config)
+	}
+
+	if _, err := os.Stat(filename + configExt); err != nil {
+		t.Errorf("expected the sidecar file to be written, got %v", err)
+	}
+
+	// an invalid sidecar file makes the service fail on reload
+	if err := os.WriteFile(filename+configExt, []byte(`{"fan": "living/fan"}`), 0644); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if status, _ := manager.ReloadService("thermostat.lua"); status.State != ServiceFailed || !strings.Contains(status.InitError, "threshold") {
+		t.Errorf("expected failed service, got %+v", status)
+	}
+
+	if err := manager.Uninstall("thermostat.lua"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if _, err := os.Stat(filename + configExt); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the sidecar file to be removed, got %v", err)
+	}
+}
+
+func TestServiceManager_Watch(t *testing.T) {
+	serviceDir := t.TempDir()
+	filename := filepath.Join(serviceDir, "thermostat.lua")
+	manager := NewServiceManager(serviceDir, NewServiceMap(), NewDataTable(), &mockPublisher{}, nil, nil)
+	manager.Start()
+	defer manager.Stop()
+
+	waitFor := func(condition func([]ServiceStatus) bool) []ServiceStatus {
+		deadline := time.Now().Add(5 * time.Second)
+		statuses := manager.Statuses()
+		for !condition(statuses) && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+			statuses = manager.Statuses()
+		}
+		return statuses
+	}
+
+	if err := os.WriteFile(filename, []byte(testScript), 0644); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	statuses := waitFor(func(statuses []ServiceStatus) bool {
+		return len(statuses) == 1 && statuses[0].State == ServiceRunning
+	})
+	if len(statuses) != 1 || statuses[0].Version != "1.0.0" {
+		t.Fatalf("expected the added service to be running, got %v", statuses)
+	}
+
+	// a replaced file with the same name is reloaded
+	replaced := strings.Replace(testScript, `Version = "1.0.0"`, `Version = "1.1.0"`, 1)
+	if err := os.WriteFile(filename, []byte(replaced), 0644); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	statuses = waitFor(func(statuses []ServiceStatus) bool {
+		return len(statuses) == 1 && statuses[0].Version == "1.1.0"
+	})
+	if len(statuses) != 1 || statuses[0].Version != "1.1.0" || statuses[0].State != ServiceRunning {
+		t.Errorf("expected the replaced service to be reloaded, got %v", statuses)
+	}
+
+	if err := os.Remove(filename); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	statuses = waitFor(func(statuses []ServiceStatus) bool {
+		return len(statuses) == 0
+	})
+	if len(statuses) != 0 {
+		t.Errorf("expected the removed service to be unloaded, got %v", statuses)
+	}
+}
+
+func TestServiceManager_Stop(t *testing.T) {
+	manager := NewServiceManager(t.TempDir(), NewServiceMap(), NewDataTable(), &mockPublisher{}, nil, nil)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		// the manager was never started, and is stopped twice
+		manager.Stop()
+		manager.Stop()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the manager to stop")
+	}
+}
+
+// slowService is a script service whose Init waits to be released
+type slowService struct {
+	*ScriptService
+	release chan bool
+}
+
+func (service *slowService) Init(config ServiceConfig) error {
+	<-service.release
+	return service.ScriptService.Init(config)
+}
+
+func TestServiceManager_SlowInit(t *testing.T) {
+	const slowExt = ".slow"
+	created, release := make(chan bool), make(chan bool)
+	serviceLoaders[slowExt] = func(filename string) (MoodyService, error) {
+		<-created
+		service, err := loadScriptService(filename)
+		if err != nil {
+			return nil, err
+		}
+		return &slowService{ScriptService: service.(*ScriptService), release: release}, nil
+	}
+	artifactValidators[slowExt] = validateScript
+	defer delete(serviceLoaders, slowExt)
+	defer delete(artifactValidators, slowExt)
+
+	serviceDir := t.TempDir()
+	config := ServiceConfig{"threshold": 30.0, "fan": "kitchen/fan"}
+	manager := NewServiceManager(serviceDir, NewServiceMap(), NewDataTable(), &mockPublisher{}, nil, map[string]ServiceConfig{"thermostat.slow": config})
+	manager.SetInstallEnabled(true)
+	defer manager.Stop()
+
+	done := make(chan ServiceStatus)
+	go func() {
+		status, _ := manager.Install("thermostat.slow", strings.NewReader(testScript), nil)
+		done <- status
+	}()
+
+	// the manager keeps answering while the service is created and initializes
+	for _, step := range []chan bool{created, release} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if status, err := manager.Status("thermostat.slow"); err == nil {
+				if status.State != ServiceStarting {
+					t.Fatalf("expected starting service, got %+v", status)
+				}
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the service to be starting")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(step)
+	}
+
+	if status := <-done; status.State != ServiceRunning {
+		t.Errorf("expected running service, got %+v", status)
+	}
+}
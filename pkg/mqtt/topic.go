@@ -0,0 +1,176 @@
+package mqtt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	topicSeparator  = "/"
+	singleLevelWild = "+"
+	multiLevelWild  = "#"
+)
+
+var (
+	ErrInvalidAlias  = fmt.Errorf("the topic alias is not valid")
+	ErrInvalidFilter = fmt.Errorf("the topic filter is not valid")
+)
+
+// TopicMatches reports whether the passed topic name matches the
+// filter, following the MQTT wildcard rules: '+' matches exactly one
+// level and '#', only allowed as the last level, matches any number
+// of levels, including the parent one
+func TopicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, topicSeparator)
+	topicLevels := strings.Split(topic, topicSeparator)
+
+	// topics starting with $ are reserved and never matched by a
+	// filter starting with a wildcard
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == singleLevelWild || filterLevels[0] == multiLevelWild) {
+		return false
+	}
+
+	for idx, level := range filterLevels {
+		if level == multiLevelWild {
+			return idx == len(filterLevels)-1
+		}
+		if idx >= len(topicLevels) {
+			return false
+		}
+		if level != singleLevelWild && level != topicLevels[idx] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// ValidateFilter checks that the passed topic filter is not empty and
+// that its wildcards occupy whole levels, with '#' only as the last one
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return ErrInvalidFilter
+	}
+
+	levels := strings.Split(filter, topicSeparator)
+	for idx, level := range levels {
+		if level == multiLevelWild && idx != len(levels)-1 {
+			return fmt.Errorf("%w: %s", ErrInvalidFilter, filter)
+		}
+		if level != multiLevelWild && level != singleLevelWild && strings.ContainsAny(level, singleLevelWild+multiLevelWild) {
+			return fmt.Errorf("%w: %s", ErrInvalidFilter, filter)
+		}
+	}
+	return nil
+}
+
+// IsWildcard reports whether the passed topic filter contains
+// any wildcard level
+func IsWildcard(filter string) bool {
+	for _, level := range strings.Split(filter, topicSeparator) {
+		if level == singleLevelWild || level == multiLevelWild {
+			return true
+		}
+	}
+	return false
+}
+
+// topicAlias maps the topics under a source tree to a target tree, or a
+// single source topic to a single target topic
+type topicAlias struct {
+	source string
+	target string
+	prefix bool
+}
+
+// TopicAliases rewrites the topics of external trees, such as the ones of
+// Zigbee2MQTT or Tasmota devices, into the moody namespace and back
+type TopicAliases struct {
+	aliases []topicAlias
+}
+
+// NewTopicAliases creates the aliases from a map of source topics to target
+// topics. A source ending with the '#' wildcard maps the whole tree under it
+// to the tree under the target, that must end with '#' as well; no other
+// wildcard is allowed.
+func NewTopicAliases(aliases map[string]string) (*TopicAliases, error) {
+	topicAliases := &TopicAliases{}
+	for source, target := range aliases {
+		alias := topicAlias{source: source, target: target}
+		sourceTree := strings.HasSuffix(source, topicSeparator+multiLevelWild)
+		targetTree := strings.HasSuffix(target, topicSeparator+multiLevelWild)
+		if sourceTree != targetTree {
+			return nil, fmt.Errorf("%w: %s and %s must both end with a wildcard or neither", ErrInvalidAlias, source, target)
+		}
+
+		if sourceTree {
+			alias.source = strings.TrimSuffix(source, multiLevelWild)
+			alias.target = strings.TrimSuffix(target, multiLevelWild)
+			alias.prefix = true
+		}
+
+		if alias.source == "" || alias.target == "" || IsWildcard(alias.source) || IsWildcard(alias.target) {
+			return nil, fmt.Errorf("%w: %s -> %s", ErrInvalidAlias, source, target)
+		}
+		topicAliases.aliases = append(topicAliases.aliases, alias)
+	}
+
+	// the most specific aliases take precedence
+	sort.Slice(topicAliases.aliases, func(i, j int) bool {
+		first, second := topicAliases.aliases[i], topicAliases.aliases[j]
+		if first.prefix != second.prefix {
+			return !first.prefix
+		}
+		if len(first.source) != len(second.source) {
+			return len(first.source) > len(second.source)
+		}
+		return first.source < second.source
+	})
+	return topicAliases, nil
+}
+
+// Resolve rewrites a topic received from the broker to its alias, topics
+// without an alias are returned unchanged
+func (topicAliases *TopicAliases) Resolve(topic string) string {
+	if topicAliases == nil {
+		return topic
+	}
+
+	for _, alias := range topicAliases.aliases {
+		if rewritten, isRewritten := rewriteTopic(topic, alias.source, alias.target, alias.prefix); isRewritten {
+			return rewritten
+		}
+	}
+	return topic
+}
+
+// Reverse rewrites an aliased topic back to the topic used on the broker,
+// so that messages published to an alias reach the original devices
+func (topicAliases *TopicAliases) Reverse(topic string) string {
+	if topicAliases == nil {
+		return topic
+	}
+
+	for _, alias := range topicAliases.aliases {
+		if rewritten, isRewritten := rewriteTopic(topic, alias.target, alias.source, alias.prefix); isRewritten {
+			return rewritten
+		}
+	}
+	return topic
+}
+
+func rewriteTopic(topic string, from string, to string, prefix bool) (string, bool) {
+	if !prefix {
+		return to, topic == from
+	}
+
+	// a tree alias also covers its parent level, like the '#' wildcard
+	if topic == strings.TrimSuffix(from, topicSeparator) {
+		return strings.TrimSuffix(to, topicSeparator), true
+	}
+
+	if strings.HasPrefix(topic, from) {
+		return to + strings.TrimPrefix(topic, from), true
+	}
+	return "", false
+}
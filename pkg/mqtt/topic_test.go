@@ -0,0 +1,95 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTopicMatches(t *testing.T) {
+	testCases := []struct {
+		Filter   string
+		Topic    string
+		Expected bool
+	}{
+		{"moody/device/temp", "moody/device/temp", true},
+		{"moody/device/temp", "moody/device/hum", false},
+		{"moody/device/+", "moody/device/temp", true},
+		{"moody/device/+", "moody/device/kitchen/temp", false},
+		{"moody/+/temp", "moody/device/temp", true},
+		{"+/temperature", "kitchen/temperature", true},
+		{"moody/device/#", "moody/device/kitchen/temp", true},
+		{"moody/device/#", "moody/device", true},
+		{"moody/device/#", "moody/other/temp", false},
+		{"kitchen/#", "kitchen", true},
+		{"#", "moody/device/temp", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"moody/#/temp", "moody/device/temp", false},
+		{"moody/device/temp/+", "moody/device/temp", false},
+	}
+
+	for _, test := range testCases {
+		if matches := TopicMatches(test.Filter, test.Topic); matches != test.Expected {
+			t.Errorf("TopicMatches(%s, %s): expected %v, got %v", test.Filter, test.Topic, test.Expected, matches)
+		}
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	for _, filter := range []string{"moody/device/#", "#", "+/temperature", "zigbee2mqtt/+/set"} {
+		if err := ValidateFilter(filter); err != nil {
+			t.Errorf("expected %s to be valid, got %v", filter, err)
+		}
+	}
+
+	for _, filter := range []string{"", "moody/#/temp", "moody/dev+/temp", "moody/device#"} {
+		if err := ValidateFilter(filter); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("expected %s to be invalid, got %v", filter, err)
+		}
+	}
+}
+
+func TestTopicAliases(t *testing.T) {
+	aliases, err := NewTopicAliases(map[string]string{
+		"zigbee2mqtt/#":            "moody/device/zigbee/#",
+		"zigbee2mqtt/kitchen_plug": "moody/device/kitchen/plug",
+		"tele/tasmota_1/SENSOR":    "moody/device/garage/sensor",
+		"shellies/shelly1-ab12/#":  "moody/device/living/#",
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	testCases := []struct {
+		Topic    string
+		Expected string
+	}{
+		{"zigbee2mqtt/bedroom_sensor", "moody/device/zigbee/bedroom_sensor"},
+		{"zigbee2mqtt/kitchen_plug", "moody/device/kitchen/plug"},
+		{"zigbee2mqtt", "moody/device/zigbee"},
+		{"tele/tasmota_1/SENSOR", "moody/device/garage/sensor"},
+		{"tele/tasmota_1/STATE", "tele/tasmota_1/STATE"},
+		{"shellies/shelly1-ab12/relay/0", "moody/device/living/relay/0"},
+		{"moody/device/kitchen/temp", "moody/device/kitchen/temp"},
+	}
+
+	for _, test := range testCases {
+		if resolved := aliases.Resolve(test.Topic); resolved != test.Expected {
+			t.Errorf("expected %s to resolve to %s, got %s", test.Topic, test.Expected, resolved)
+		}
+		if reversed := aliases.Reverse(test.Expected); reversed != test.Topic {
+			t.Errorf("expected %s to reverse to %s, got %s", test.Expected, test.Topic, reversed)
+		}
+	}
+
+	for _, invalid := range []map[string]string{
+		{"zigbee2mqtt/#": "moody/device/zigbee"},
+		{"zigbee2mqtt/+/set": "moody/device/zigbee/set"},
+		{"#": "#"},
+	} {
+		if _, err := NewTopicAliases(invalid); !errors.Is(err, ErrInvalidAlias) {
+			t.Errorf("expected %v for %v, got %v", ErrInvalidAlias, invalid, err)
+		}
+	}
+}
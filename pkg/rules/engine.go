@@ -0,0 +1,477 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	httpIfc "github.com/antima/moody-core/pkg/http"
+	"github.com/antima/moody-core/pkg/internal/fsutil"
+	"github.com/antima/moody-core/pkg/mqtt"
+	"github.com/antima/moody-core/pkg/value"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ruleExt        = ".json"
+	yamlExt        = ".yaml"
+	ymlExt         = ".yml"
+	webhookTimeout = 5 * time.Second
+)
+
+var (
+	ErrEmptyRuleDir  = errors.New("the rule directory can't be empty")
+	ErrRuleNotFound  = errors.New("no rule with such name")
+	ErrRuleExists    = errors.New("a rule with such name already exists")
+	ErrNoPublisher   = errors.New("no mqtt publisher is available")
+	ErrWebhookFailed = errors.New("the webhook returned an error status")
+)
+
+// WebhookPacket is the body sent by webhook actions
+type WebhookPacket struct {
+	Rule  string      `json:"rule"`
+	Topic string      `json:"topic,omitempty"`
+	State string      `json:"state"`
+	Value value.Value `json:"value"`
+	Time  time.Time   `json:"time"`
+}
+
+// Engine evaluates the rules stored as json or yaml files in its directory
+// against the updates of the data table and the readings of the sensors. The
+// rules stored through the engine are written as json.
+type Engine struct {
+	mutex     sync.Mutex
+	ruleDir   string
+	runners   map[string]*runner
+	dataTable *mqtt.DataTable
+	devices   *httpIfc.DeviceList
+	publisher mqtt.Publisher
+	stateChan chan mqtt.StateTuple
+	stopChan  chan bool
+}
+
+// runner keeps the evaluation state of a single rule
+type runner struct {
+	rule      Rule
+	path      string
+	mutex     sync.Mutex
+	streaks   map[string]*streak
+	lastFired time.Time
+	stopPoll  chan bool
+}
+
+// streak tracks a period of time in which the conditions of a rule
+// kept holding for a given source, a topic or a device
+type streak struct {
+	timer *time.Timer
+	fired bool
+}
+
+// NewEngine creates an engine loading the rules from the passed directory,
+// creating it if it does not exist. The rules that can't be loaded are
+// logged and skipped.
+func NewEngine(ruleDir string, dataTable *mqtt.DataTable, devices *httpIfc.DeviceList, publisher mqtt.Publisher) (*Engine, error) {
+	if ruleDir == "" {
+		return nil, ErrEmptyRuleDir
+	}
+
+	if err := os.MkdirAll(ruleDir, 0755); err != nil {
+		return nil, err
+	}
+
+	engine := &Engine{
+		ruleDir:   ruleDir,
+		runners:   make(map[string]*runner),
+		dataTable: dataTable,
+		devices:   devices,
+		publisher: publisher,
+		stateChan: make(chan mqtt.StateTuple),
+		stopChan:  make(chan bool),
+	}
+
+	_ = filepath.WalkDir(ruleDir, func(path string, d fs.DirEntry, err error) error {
+		if d == nil || d.IsDir() || !isRuleExt(filepath.Ext(d.Name())) {
+			return nil
+		}
+		ext := filepath.Ext(d.Name())
+		rule, err := loadRule(path)
+		if err != nil {
+			log.Printf("error: could not load rule %s, %v\n", path, err)
+			return nil
+		}
+		if rule.Name+ext != d.Name() {
+			log.Printf("error: the rule in %s must be named %s\n", path, strings.TrimSuffix(d.Name(), ext))
+			return nil
+		}
+		if loaded, exists := engine.runners[rule.Name]; exists {
+			log.Printf("error: the rule %s in %s is already defined in %s\n", rule.Name, path, loaded.path)
+			return nil
+		}
+		engine.runners[rule.Name] = &runner{rule: *rule, path: path, streaks: make(map[string]*streak)}
+		return nil
+	})
+	return engine, nil
+}
+
+// Start evaluating the rules
+func (engine *Engine) Start() {
+	log.Printf("starting the rule engine, serving rules from %s\n", engine.ruleDir)
+	engine.mutex.Lock()
+	for _, ruleRunner := range engine.runners {
+		engine.startRunner(ruleRunner)
+	}
+	engine.mutex.Unlock()
+
+	engine.dataTable.Attach(engine.stateChan)
+	go func() {
+		for {
+			select {
+			case tuple := <-engine.stateChan:
+				engine.dispatch(tuple)
+			case <-engine.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop evaluating the rules
+func (engine *Engine) Stop() {
+	log.Println("stopping the rule engine")
+	engine.dataTable.Detach(engine.stateChan)
+	close(engine.stopChan)
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	for _, ruleRunner := range engine.runners {
+		ruleRunner.stop()
+	}
+}
+
+// Rules returns the list of the rules in the engine, sorted by name
+func (engine *Engine) Rules() []Rule {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	rules := make([]Rule, 0, len(engine.runners))
+	for _, ruleRunner := range engine.runners {
+		rules = append(rules, ruleRunner.rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Name < rules[j].Name
+	})
+	return rules
+}
+
+// Get a rule by name, the second return value is false if there
+// is no such rule
+func (engine *Engine) Get(name string) (Rule, bool) {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	ruleRunner, exists := engine.runners[name]
+	if !exists {
+		return Rule{}, false
+	}
+	return ruleRunner.rule, true
+}
+
+// Create validates and stores a new rule and starts evaluating it,
+// returning an error if a rule with the same name exists
+func (engine *Engine) Create(rule Rule) error {
+	return engine.store(rule, false)
+}
+
+// Put validates and stores a rule, replacing the rule with the same
+// name if it exists, and starts evaluating it
+func (engine *Engine) Put(rule Rule) error {
+	return engine.store(rule, true)
+}
+
+func (engine *Engine) store(rule Rule, replace bool) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+
+	encoded, err := json.MarshalIndent(&rule, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	old, exists := engine.runners[rule.Name]
+	if exists && !replace {
+		return ErrRuleExists
+	}
+
+	path := engine.rulePath(rule.Name)
+	if err := fsutil.WriteFileAtomic(path, encoded); err != nil {
+		return err
+	}
+
+	if exists {
+		old.stop()
+		// a rule written in yaml is replaced by its json version
+		if old.path != path {
+			if err := os.Remove(old.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("error: could not remove the replaced rule %s, %v\n", old.path, err)
+			}
+		}
+	}
+	ruleRunner := &runner{rule: rule, path: path, streaks: make(map[string]*streak)}
+	engine.runners[rule.Name] = ruleRunner
+	engine.startRunner(ruleRunner)
+	return nil
+}
+
+// Delete stops a rule and removes it from the rule directory
+func (engine *Engine) Delete(name string) error {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	ruleRunner, exists := engine.runners[name]
+	if !exists {
+		return ErrRuleNotFound
+	}
+
+	if err := os.Remove(ruleRunner.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	ruleRunner.stop()
+	delete(engine.runners, name)
+	return nil
+}
+
+func (engine *Engine) rulePath(name string) string {
+	return filepath.Join(engine.ruleDir, name+ruleExt)
+}
+
+// startRunner starts polling the sensor of a device triggered rule,
+// topic triggered rules are evaluated by dispatch
+func (engine *Engine) startRunner(ruleRunner *runner) {
+	if !ruleRunner.rule.Enabled || ruleRunner.rule.Trigger.Device == "" {
+		return
+	}
+
+	ruleRunner.stopPoll = make(chan bool)
+	go func(ruleRunner *runner, stopPoll chan bool) {
+		ip := ruleRunner.rule.Trigger.Device
+		for {
+			select {
+			case <-time.After(ruleRunner.rule.pollInterval()):
+				reading, err := engine.devices.Read(ip)
+				if errors.Is(err, httpIfc.UnknownDeviceError) {
+					// the device is not connected yet
+					continue
+				}
+				if err != nil {
+					log.Printf("error: rule %s could not read %s, %v\n", ruleRunner.rule.Name, ip, err)
+					continue
+				}
+				engine.evaluate(ruleRunner, ip, "", reading.Raw(), reading)
+			case <-stopPoll:
+				return
+			}
+		}
+	}(ruleRunner, ruleRunner.stopPoll)
+}
+
+// dispatch evaluates the rules triggered by a state update, the
+// replays of retained states do not trigger any rule
+func (engine *Engine) dispatch(tuple mqtt.StateTuple) {
+	if tuple.Retained() {
+		return
+	}
+
+	engine.mutex.Lock()
+	var matching []*runner
+	for _, ruleRunner := range engine.runners {
+		topic := ruleRunner.rule.Trigger.Topic
+		if ruleRunner.rule.Enabled && topic != "" && mqtt.TopicMatches(topic, tuple.Topic()) {
+			matching = append(matching, ruleRunner)
+		}
+	}
+	engine.mutex.Unlock()
+
+	for _, ruleRunner := range matching {
+		engine.evaluate(ruleRunner, tuple.Topic(), tuple.Topic(), tuple.State(), tuple.Value())
+	}
+}
+
+// evaluate a rule for a new value received from the passed source
+func (engine *Engine) evaluate(ruleRunner *runner, source string, topic string, state string, triggerValue value.Value) {
+	ruleRunner.mutex.Lock()
+	defer ruleRunner.mutex.Unlock()
+
+	current, inStreak := ruleRunner.streaks[source]
+	if !ruleRunner.rule.matches(triggerValue) {
+		if inStreak {
+			if current.timer != nil {
+				current.timer.Stop()
+			}
+			delete(ruleRunner.streaks, source)
+		}
+		return
+	}
+
+	if inStreak {
+		return
+	}
+
+	packet := WebhookPacket{
+		Rule:  ruleRunner.rule.Name,
+		Topic: topic,
+		State: state,
+		Value: triggerValue,
+	}
+
+	current = &streak{}
+	ruleRunner.streaks[source] = current
+	if ruleRunner.rule.Debounce == 0 {
+		engine.fire(ruleRunner, current, packet)
+		return
+	}
+
+	current.timer = time.AfterFunc(time.Duration(ruleRunner.rule.Debounce), func() {
+		ruleRunner.mutex.Lock()
+		defer ruleRunner.mutex.Unlock()
+		// the streak may have been interrupted while the timer expired
+		if ruleRunner.streaks[source] == current {
+			engine.fire(ruleRunner, current, packet)
+		}
+	})
+}
+
+// fire runs the actions of a rule, unless it is still cooling down.
+// The caller must hold the runner mutex.
+func (engine *Engine) fire(ruleRunner *runner, current *streak, packet WebhookPacket) {
+	now := time.Now()
+	cooldown := time.Duration(ruleRunner.rule.Cooldown)
+	if current.fired || (!ruleRunner.lastFired.IsZero() && now.Sub(ruleRunner.lastFired) < cooldown) {
+		return
+	}
+
+	current.fired = true
+	ruleRunner.lastFired = now
+	packet.Time = now
+	log.Printf("rule %s fired\n", ruleRunner.rule.Name)
+
+	actions := ruleRunner.rule.Actions
+	go func() {
+		for _, action := range actions {
+			if err := engine.run(action, packet); err != nil {
+				log.Printf("error: rule %s could not run a %s action, %v\n", packet.Rule, action.Type, err)
+			}
+		}
+	}()
+}
+
+func (engine *Engine) run(action Action, packet WebhookPacket) error {
+	switch action.Type {
+	case ActionActuate:
+		return engine.devices.Actuate(action.Device, *action.Value)
+	case ActionPublish:
+		if engine.publisher == nil {
+			return ErrNoPublisher
+		}
+		payload := strings.NewReplacer("${topic}", packet.Topic, "${state}", packet.State).Replace(action.Payload)
+		return engine.publisher.Publish(action.Topic, payload, action.Qos, action.Retain)
+	case ActionWebhook:
+		return callWebhook(action, packet)
+	default:
+		return ErrUnknownActionType
+	}
+}
+
+func (ruleRunner *runner) stop() {
+	if ruleRunner.stopPoll != nil {
+		close(ruleRunner.stopPoll)
+		ruleRunner.stopPoll = nil
+	}
+
+	ruleRunner.mutex.Lock()
+	defer ruleRunner.mutex.Unlock()
+	for source, current := range ruleRunner.streaks {
+		if current.timer != nil {
+			current.timer.Stop()
+		}
+		delete(ruleRunner.streaks, source)
+	}
+}
+
+func callWebhook(action Action, packet WebhookPacket) error {
+	body, err := json.Marshal(&packet)
+	if err != nil {
+		return err
+	}
+
+	method := action.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	req, err := http.NewRequest(method, action.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return ErrWebhookFailed
+	}
+	return nil
+}
+
+func isRuleExt(ext string) bool {
+	return ext == ruleExt || ext == yamlExt || ext == ymlExt
+}
+
+// YamlToJson converts a rule written in yaml to its json encoding
+func YamlToJson(data []byte) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func loadRule(path string) (*Rule, error) {
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if filepath.Ext(path) != ruleExt {
+		if fileBytes, err = YamlToJson(fileBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	var rule Rule
+	if err := json.Unmarshal(fileBytes, &rule); err != nil {
+		return nil, err
+	}
+
+	if err := rule.Validate(); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
@@ -0,0 +1,223 @@
+package rules
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	httpIfc "github.com/antima/moody-core/pkg/http"
+	"github.com/antima/moody-core/pkg/mqtt"
+	"github.com/antima/moody-core/pkg/value"
+)
+
+type mockPublisher struct {
+	mutex    sync.Mutex
+	payloads []string
+}
+
+func (publisher *mockPublisher) Publish(topic string, payload string, qos byte, retained bool) error {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	publisher.payloads = append(publisher.payloads, payload)
+	return nil
+}
+
+func (publisher *mockPublisher) published() []string {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	return append([]string{}, publisher.payloads...)
+}
+
+func newTestEngine(t *testing.T, rule Rule) (*Engine, *mqtt.DataTable, *mockPublisher) {
+	dataTable := mqtt.NewDataTable()
+	publisher := &mockPublisher{}
+	engine, err := NewEngine(t.TempDir(), dataTable, httpIfc.NewDeviceList(), publisher)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	engine.Start()
+	if err := engine.Put(rule); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	return engine, dataTable, publisher
+}
+
+func TestRule_Validate(t *testing.T) {
+	on := value.NewString("on")
+	testCases := []struct {
+		Rule     Rule
+		Expected error
+	}{
+		{Rule{Name: "../x"}, ErrInvalidRuleName},
+		{Rule{Name: "x"}, ErrInvalidTrigger},
+		{Rule{Name: "x", Trigger: Trigger{Topic: "a", Device: "b"}}, ErrInvalidTrigger},
+		{Rule{Name: "x", Trigger: Trigger{Topic: "a"}}, ErrNoActions},
+		{Rule{Name: "x", Trigger: Trigger{Topic: "a"}, Conditions: []Condition{{Operator: "~"}}}, ErrUnknownOperator},
+		{Rule{Name: "x", Trigger: Trigger{Topic: "a"}, Actions: []Action{{Type: "mail"}}}, ErrUnknownActionType},
+		{Rule{Name: "x", Trigger: Trigger{Topic: "a"}, Actions: []Action{{Type: ActionActuate, Device: "b"}}}, ErrInvalidAction},
+		{Rule{Name: "x", Trigger: Trigger{Topic: "a"}, Actions: []Action{{Type: ActionPublish, Topic: "b", Qos: 3}}}, ErrInvalidQos},
+		{Rule{Name: "x", Trigger: Trigger{Device: "a"}, Actions: []Action{{Type: ActionActuate, Device: "b", Value: &on}}}, nil},
+	}
+
+	for _, test := range testCases {
+		if err := test.Rule.Validate(); err != test.Expected {
+			t.Errorf("expected %v, got %v", test.Expected, err)
+		}
+	}
+}
+
+func TestEngine_TopicRule(t *testing.T) {
+	engine, dataTable, publisher := newTestEngine(t, Rule{
+		Name:       "fan",
+		Enabled:    true,
+		Trigger:    Trigger{Topic: "moody/device/+/temperature"},
+		Conditions: []Condition{{Operator: OpGreater, Value: value.NewNumber(25)}},
+		Actions:    []Action{{Type: ActionPublish, Topic: "moody/device/fan", Payload: "${topic}=${state}"}},
+		Cooldown:   Duration(time.Hour),
+	})
+	defer engine.Stop()
+
+	dataTable.Add("moody/device/kitchen/temperature", "20")
+	// retained replays do not trigger the rule
+	dataTable.AddFrom("local", "moody/device/kitchen/temperature", "40", true)
+	dataTable.Add("moody/device/kitchen/temperature", "26")
+	// the conditions keep holding, the rule fires only once per streak
+	dataTable.Add("moody/device/kitchen/temperature", "27")
+	dataTable.Add("moody/device/kitchen/temperature", "20")
+	// new streak, but the rule is cooling down
+	dataTable.Add("moody/device/kitchen/temperature", "30")
+	time.Sleep(50 * time.Millisecond)
+
+	published := publisher.published()
+	if len(published) != 1 || published[0] != "moody/device/kitchen/temperature=26" {
+		t.Errorf("expected [moody/device/kitchen/temperature=26], got %v", published)
+	}
+}
+
+// thermometer is a sensor type registered by a user of the http package
+type thermometer struct {
+	httpIfc.Node
+}
+
+func (th *thermometer) Sync() bool {
+	return true
+}
+
+func (th *thermometer) LastReading() value.Value {
+	return value.NewNumber(30)
+}
+
+func TestEngine_DeviceRule(t *testing.T) {
+	engine, _, publisher := newTestEngine(t, Rule{
+		Name:       "fan",
+		Enabled:    true,
+		Trigger:    Trigger{Device: "10.0.0.1", Interval: Duration(time.Second)},
+		Conditions: []Condition{{Operator: OpGreater, Value: value.NewNumber(25)}},
+		Actions:    []Action{{Type: ActionPublish, Topic: "moody/device/fan", Payload: "${state}"}},
+	})
+	defer engine.Stop()
+
+	engine.devices.Add("10.0.0.1", &thermometer{Node: httpIfc.Node{IpAddress: "10.0.0.1"}})
+	time.Sleep(1500 * time.Millisecond)
+
+	published := publisher.published()
+	if len(published) != 1 || published[0] != "30" {
+		t.Errorf("expected [30], got %v", published)
+	}
+}
+
+func TestEngine_Debounce(t *testing.T) {
+	engine, dataTable, publisher := newTestEngine(t, Rule{
+		Name:       "door",
+		Enabled:    true,
+		Trigger:    Trigger{Topic: "moody/device/door"},
+		Conditions: []Condition{{Field: "open", Operator: OpEqual, Value: value.NewBool(true)}},
+		Actions:    []Action{{Type: ActionPublish, Topic: "moody/device/alarm", Payload: "on"}},
+		Debounce:   Duration(100 * time.Millisecond),
+	})
+	defer engine.Stop()
+
+	// the door is closed again before the debounce elapses
+	dataTable.Add("moody/device/door", `{"open": true}`)
+	time.Sleep(20 * time.Millisecond)
+	dataTable.Add("moody/device/door", `{"open": false}`)
+	time.Sleep(150 * time.Millisecond)
+	if published := publisher.published(); len(published) != 0 {
+		t.Errorf("expected no messages, got %v", published)
+	}
+
+	dataTable.Add("moody/device/door", `{"open": true}`)
+	time.Sleep(150 * time.Millisecond)
+	if published := publisher.published(); len(published) != 1 {
+		t.Errorf("expected one message, got %v", published)
+	}
+}
+
+const yamlRule = `
+name: alarm
+enabled: true
+trigger:
+  topic: moody/device/door
+conditions:
+  - field: open
+    op: "=="
+    value: true
+actions:
+  - type: publish
+    topic: moody/device/alarm
+    payload: "on"
+cooldown: 1m
+`
+
+func TestEngine_YamlRule(t *testing.T) {
+	ruleDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(ruleDir, "alarm.yaml"), []byte(yamlRule), 0644); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(ruleDir, "alarm.yml"), []byte(yamlRule), 0644); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	engine, err := NewEngine(ruleDir, mqtt.NewDataTable(), httpIfc.NewDeviceList(), &mockPublisher{})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	rule, exists := engine.Get("alarm")
+	if !exists || len(rule.Actions) != 1 || rule.Cooldown != Duration(time.Minute) {
+		t.Fatalf("expected the yaml rule to be loaded, got %+v", rule)
+	}
+
+	if err := engine.Create(rule); err != ErrRuleExists {
+		t.Errorf("expected %v, got %v", ErrRuleExists, err)
+	}
+
+	// the replaced rule is stored as json, in place of the yaml file
+	rule.Enabled = false
+	if err := engine.Put(rule); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	entries, _ := os.ReadDir(ruleDir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 2 {
+		t.Errorf("expected alarm.json to replace the loaded yaml file, got %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(ruleDir, "alarm.json")); err != nil {
+		t.Errorf("expected alarm.json, got %v", err)
+	}
+
+	if err := engine.Delete("alarm"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(ruleDir, "alarm.json")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected alarm.json to be removed, got %v", err)
+	}
+}
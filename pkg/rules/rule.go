@@ -0,0 +1,236 @@
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/antima/moody-core/pkg/value"
+)
+
+const (
+	defaultPollInterval = 10 * time.Second
+	minPollInterval     = 1 * time.Second
+)
+
+var (
+	ErrInvalidRuleName   = errors.New("the rule name can only contain letters, digits, '-' and '_'")
+	ErrInvalidTrigger    = errors.New("a rule must be triggered either by a topic or by a device")
+	ErrInvalidInterval   = errors.New("the polling interval of a device trigger must be at least 1s")
+	ErrNoActions         = errors.New("a rule must define at least one action")
+	ErrUnknownOperator   = errors.New("unknown condition operator")
+	ErrUnknownActionType = errors.New("unknown action type")
+	ErrInvalidAction     = errors.New("the action is missing a required field")
+	ErrInvalidQos        = errors.New("the QoS level must be 0, 1 or 2")
+	ErrInvalidDuration   = errors.New("durations can't be negative")
+
+	ruleNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// Duration is a time.Duration represented in JSON as a string, such as "1m30s"
+type Duration time.Duration
+
+// MarshalJSON implements the json.Marshaler interface
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// A Trigger selects the events that evaluate a rule: either the updates of
+// the MQTT topics matching Topic, or the readings of the sensor at Device,
+// polled every Interval
+type Trigger struct {
+	Topic    string   `json:"topic,omitempty"`
+	Device   string   `json:"device,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+}
+
+// Operator compares the triggering value with the value of a condition
+type Operator string
+
+const (
+	OpEqual        Operator = "=="
+	OpNotEqual     Operator = "!="
+	OpGreater      Operator = ">"
+	OpGreaterEqual Operator = ">="
+	OpLess         Operator = "<"
+	OpLessEqual    Operator = "<="
+)
+
+// A Condition compares the triggering value, or one of its fields if the
+// value is an object, with a constant value
+type Condition struct {
+	Field    string      `json:"field,omitempty"`
+	Operator Operator    `json:"op"`
+	Value    value.Value `json:"value"`
+}
+
+type ActionType string
+
+const (
+	ActionActuate ActionType = "actuate"
+	ActionPublish ActionType = "publish"
+	ActionWebhook ActionType = "webhook"
+)
+
+// An Action is executed when a rule fires. Actuate actions use Device and
+// Value, publish actions use Topic, Payload, Qos and Retain, webhook actions
+// use Url and Method. The ${topic} and ${state} placeholders in a Payload are
+// replaced with the triggering topic and state.
+type Action struct {
+	Type    ActionType   `json:"type"`
+	Device  string       `json:"device,omitempty"`
+	Value   *value.Value `json:"value,omitempty"`
+	Topic   string       `json:"topic,omitempty"`
+	Payload string       `json:"payload,omitempty"`
+	Qos     byte         `json:"qos,omitempty"`
+	Retain  bool         `json:"retain,omitempty"`
+	Url     string       `json:"url,omitempty"`
+	Method  string       `json:"method,omitempty"`
+}
+
+// A Rule runs its actions when all of its conditions hold for the triggering
+// value. The conditions must hold for at least Debounce before the rule fires,
+// and the rule does not fire again before Cooldown elapsed. A rule fires only
+// once until its conditions stop holding.
+type Rule struct {
+	Name       string      `json:"name"`
+	Enabled    bool        `json:"enabled"`
+	Trigger    Trigger     `json:"trigger"`
+	Conditions []Condition `json:"conditions"`
+	Actions    []Action    `json:"actions"`
+	Debounce   Duration    `json:"debounce,omitempty"`
+	Cooldown   Duration    `json:"cooldown,omitempty"`
+}
+
+// Validate returns an error if the rule is not well formed
+func (rule *Rule) Validate() error {
+	if !ruleNameRegexp.MatchString(rule.Name) {
+		return ErrInvalidRuleName
+	}
+
+	if (rule.Trigger.Topic == "") == (rule.Trigger.Device == "") {
+		return ErrInvalidTrigger
+	}
+
+	if rule.Trigger.Device != "" && rule.Trigger.Interval != 0 && time.Duration(rule.Trigger.Interval) < minPollInterval {
+		return ErrInvalidInterval
+	}
+
+	if rule.Debounce < 0 || rule.Cooldown < 0 {
+		return ErrInvalidDuration
+	}
+
+	for _, condition := range rule.Conditions {
+		switch condition.Operator {
+		case OpEqual, OpNotEqual, OpGreater, OpGreaterEqual, OpLess, OpLessEqual:
+		default:
+			return ErrUnknownOperator
+		}
+	}
+
+	if len(rule.Actions) == 0 {
+		return ErrNoActions
+	}
+
+	for _, action := range rule.Actions {
+		if err := action.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (action *Action) validate() error {
+	switch action.Type {
+	case ActionActuate:
+		if action.Device == "" || action.Value == nil {
+			return ErrInvalidAction
+		}
+	case ActionPublish:
+		if action.Topic == "" {
+			return ErrInvalidAction
+		}
+		if action.Qos > 2 {
+			return ErrInvalidQos
+		}
+	case ActionWebhook:
+		if action.Url == "" {
+			return ErrInvalidAction
+		}
+	default:
+		return ErrUnknownActionType
+	}
+	return nil
+}
+
+// matches returns true if every condition of the rule holds for the passed value
+func (rule *Rule) matches(triggerValue value.Value) bool {
+	for _, condition := range rule.Conditions {
+		if !condition.holds(triggerValue) {
+			return false
+		}
+	}
+	return true
+}
+
+func (condition *Condition) holds(triggerValue value.Value) bool {
+	if condition.Field != "" {
+		field, exists := triggerValue.Object[condition.Field]
+		if triggerValue.Kind != value.Object || !exists {
+			return false
+		}
+		triggerValue = field
+	}
+
+	// numbers are compared numerically, any other value can only be
+	// compared for equality with its raw representation
+	current, isNumber := triggerValue.Float()
+	expected, isExpectedNumber := condition.Value.Float()
+	if isNumber && isExpectedNumber && condition.Value.Kind == value.Number {
+		switch condition.Operator {
+		case OpEqual:
+			return current == expected
+		case OpNotEqual:
+			return current != expected
+		case OpGreater:
+			return current > expected
+		case OpGreaterEqual:
+			return current >= expected
+		case OpLess:
+			return current < expected
+		case OpLessEqual:
+			return current <= expected
+		}
+	}
+
+	switch condition.Operator {
+	case OpEqual:
+		return triggerValue.Raw() == condition.Value.Raw()
+	case OpNotEqual:
+		return triggerValue.Raw() != condition.Value.Raw()
+	default:
+		return false
+	}
+}
+
+func (rule *Rule) pollInterval() time.Duration {
+	if rule.Trigger.Interval == 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(rule.Trigger.Interval)
+}
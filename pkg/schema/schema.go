@@ -0,0 +1,284 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidSchema   = errors.New("invalid schema")
+	ErrInvalidDocument = errors.New("invalid document")
+)
+
+// the types that a schema can declare
+var types = map[string]bool{
+	"":        true,
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+// Schema is the subset of JSON Schema used to describe and validate the
+// configuration of a service: types, object properties, required and
+// additional properties, array items, enums, numeric and length bounds.
+// The default values of the properties are set by ApplyDefaults.
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Default              interface{}        `json:"default,omitempty"`
+}
+
+// Parse decodes a schema from its JSON representation
+func Parse(data []byte) (*Schema, error) {
+	schema := &Schema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+
+	if err := schema.check(""); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// FromValue converts a decoded JSON document, as returned by json.Unmarshal
+// into an interface{}, to a schema
+func FromValue(doc interface{}) (*Schema, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	return Parse(data)
+}
+
+// check verifies that the schema only declares known types
+// and that the default values are valid
+func (schema *Schema) check(path string) error {
+	if !types[schema.Type] {
+		return fmt.Errorf("%w: unknown type %s at %s", ErrInvalidSchema, schema.Type, pathName(path))
+	}
+
+	if schema.Default != nil {
+		if err := schema.validate(path, normalize(schema.Default)); err != nil {
+			return fmt.Errorf("%w: invalid default, %v", ErrInvalidSchema, err)
+		}
+	}
+
+	for name, property := range schema.Properties {
+		if property == nil {
+			return fmt.Errorf("%w: empty property %s", ErrInvalidSchema, joinPath(path, name))
+		}
+		if err := property.check(joinPath(path, name)); err != nil {
+			return err
+		}
+	}
+
+	if schema.Items != nil {
+		return schema.Items.check(path + "[]")
+	}
+	return nil
+}
+
+// Validate checks a decoded JSON document against the schema, returning
+// an ErrInvalidDocument error describing the first violation found
+func (schema *Schema) Validate(doc interface{}) error {
+	return schema.validate("", normalize(doc))
+}
+
+// ApplyDefaults returns a copy of the passed decoded JSON document, where the
+// missing properties of the objects are set to their default value, if any
+func (schema *Schema) ApplyDefaults(doc interface{}) interface{} {
+	return schema.applyDefaults(normalize(doc))
+}
+
+// applyDefaults sets the default values in a normalized document, that
+// is modified in place
+func (schema *Schema) applyDefaults(doc interface{}) interface{} {
+	switch typed := doc.(type) {
+	case []interface{}:
+		if schema.Items != nil {
+			for idx, item := range typed {
+				typed[idx] = schema.Items.applyDefaults(item)
+			}
+		}
+	case map[string]interface{}:
+		for name, property := range schema.Properties {
+			item, isPresent := typed[name]
+			if !isPresent && property.Default == nil {
+				continue
+			}
+
+			// the default is copied, so that it is not shared between documents
+			if !isPresent {
+				item = normalize(property.Default)
+			}
+			typed[name] = property.applyDefaults(item)
+		}
+	}
+	return doc
+}
+
+func (schema *Schema) validate(path string, doc interface{}) error {
+	if !matchesType(schema.Type, doc) {
+		return invalid(path, "expected %s", schema.Type)
+	}
+
+	if len(schema.Enum) > 0 && !schema.inEnum(doc) {
+		return invalid(path, "not one of the allowed values")
+	}
+
+	switch typed := doc.(type) {
+	case float64:
+		if schema.Minimum != nil && typed < *schema.Minimum {
+			return invalid(path, "less than %v", *schema.Minimum)
+		}
+		if schema.Maximum != nil && typed > *schema.Maximum {
+			return invalid(path, "greater than %v", *schema.Maximum)
+		}
+	case string:
+		if schema.MinLength != nil && len(typed) < *schema.MinLength {
+			return invalid(path, "shorter than %d", *schema.MinLength)
+		}
+		if schema.MaxLength != nil && len(typed) > *schema.MaxLength {
+			return invalid(path, "longer than %d", *schema.MaxLength)
+		}
+	case []interface{}:
+		if schema.Items != nil {
+			for idx, item := range typed {
+				if err := schema.Items.validate(fmt.Sprintf("%s[%d]", path, idx), item); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		return schema.validateObject(path, typed)
+	}
+	return nil
+}
+
+func (schema *Schema) validateObject(path string, object map[string]interface{}) error {
+	for _, name := range schema.Required {
+		if _, isPresent := object[name]; !isPresent {
+			return invalid(joinPath(path, name), "required")
+		}
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		property, isDeclared := schema.Properties[name]
+		if !isDeclared {
+			if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				return invalid(joinPath(path, name), "unknown property")
+			}
+			continue
+		}
+
+		if err := property.validate(joinPath(path, name), object[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (schema *Schema) inEnum(doc interface{}) bool {
+	for _, allowed := range schema.Enum {
+		if reflect.DeepEqual(normalize(allowed), doc) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesType(schemaType string, doc interface{}) bool {
+	switch schemaType {
+	case "":
+		return true
+	case "object":
+		_, isObject := doc.(map[string]interface{})
+		return isObject
+	case "array":
+		_, isArray := doc.([]interface{})
+		return isArray
+	case "string":
+		_, isString := doc.(string)
+		return isString
+	case "number":
+		_, isNumber := doc.(float64)
+		return isNumber
+	case "integer":
+		number, isNumber := doc.(float64)
+		return isNumber && number == float64(int64(number))
+	case "boolean":
+		_, isBool := doc.(bool)
+		return isBool
+	case "null":
+		return doc == nil
+	}
+	return false
+}
+
+// normalize converts the numbers of a document to float64, as
+// returned by json.Unmarshal, so that they can be compared
+func normalize(doc interface{}) interface{} {
+	switch typed := doc.(type) {
+	case int:
+		return float64(typed)
+	case int64:
+		return float64(typed)
+	case float32:
+		return float64(typed)
+	case []interface{}:
+		normalized := make([]interface{}, len(typed))
+		for idx, item := range typed {
+			normalized[idx] = normalize(item)
+		}
+		return normalized
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(typed))
+		for name, item := range typed {
+			normalized[name] = normalize(item)
+		}
+		return normalized
+	}
+	return doc
+}
+
+func invalid(path string, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s %s", ErrInvalidDocument, pathName(path), fmt.Sprintf(format, args...))
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return strings.Join([]string{path, name}, ".")
+}
+
+func pathName(path string) string {
+	if path == "" {
+		return "document"
+	}
+	return path
+}
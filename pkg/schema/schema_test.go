@@ -0,0 +1,120 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["threshold"],
+	"additionalProperties": false,
+	"properties": {
+		"threshold": {"type": "number", "minimum": 0, "maximum": 50},
+		"mode": {"type": "string", "enum": ["heat", "cool"]},
+		"fans": {"type": "array", "items": {"type": "integer"}},
+		"name": {"type": "string", "minLength": 1},
+		"limits": {
+			"type": "object",
+			"properties": {
+				"low": {"type": "number", "default": 10},
+				"high": {"type": "number", "default": 40}
+			},
+			"default": {}
+		}
+	}
+}`
+
+func TestParse(t *testing.T) {
+	if _, err := Parse([]byte(testSchema)); err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+
+	for _, data := range []string{`[]`, `{"type": "date"}`, `{"properties": {"x": {"items": {"type": "float"}}}}`, `{"properties": {"x": {"type": "string", "default": 1}}}`} {
+		if _, err := Parse([]byte(data)); !errors.Is(err, ErrInvalidSchema) {
+			t.Errorf("expected %v for %s, got %v", ErrInvalidSchema, data, err)
+		}
+	}
+}
+
+func TestSchema_Validate(t *testing.T) {
+	schema, err := Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	testCases := []struct {
+		Document string
+		Valid    bool
+	}{
+		{`{"threshold": 25}`, true},
+		{`{"threshold": 25, "mode": "cool", "fans": [1, 2], "name": "kitchen"}`, true},
+		{`{}`, false},
+		{`[]`, false},
+		{`{"threshold": "25"}`, false},
+		{`{"threshold": 60}`, false},
+		{`{"threshold": -1}`, false},
+		{`{"threshold": 25, "mode": "dry"}`, false},
+		{`{"threshold": 25, "fans": [1.5]}`, false},
+		{`{"threshold": 25, "name": ""}`, false},
+		{`{"threshold": 25, "unknown": true}`, false},
+	}
+
+	for _, test := range testCases {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(test.Document), &doc); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		err := schema.Validate(doc)
+		if test.Valid && err != nil {
+			t.Errorf("expected %s to be valid, got %v", test.Document, err)
+		}
+		if !test.Valid && !errors.Is(err, ErrInvalidDocument) {
+			t.Errorf("expected %s to be invalid, got %v", test.Document, err)
+		}
+	}
+
+	if err := schema.Validate(map[string]interface{}{"threshold": 10, "fans": []interface{}{3}}); err != nil {
+		t.Errorf("expected go numbers to be accepted, got %v", err)
+	}
+}
+
+func TestSchema_ApplyDefaults(t *testing.T) {
+	schema, err := Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	testCases := []struct {
+		Document string
+		Expected string
+	}{
+		{`{"threshold": 25}`, `{"threshold": 25, "limits": {"low": 10, "high": 40}}`},
+		{`{"threshold": 25, "limits": {"low": 5}}`, `{"threshold": 25, "limits": {"low": 5, "high": 40}}`},
+		{`[]`, `[]`},
+	}
+
+	for _, test := range testCases {
+		var doc, expected interface{}
+		if err := json.Unmarshal([]byte(test.Document), &doc); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if err := json.Unmarshal([]byte(test.Expected), &expected); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		if applied := schema.ApplyDefaults(doc); !reflect.DeepEqual(applied, expected) {
+			t.Errorf("expected %v, got %v", expected, applied)
+		}
+	}
+
+	// the passed document is not modified
+	doc := map[string]interface{}{"threshold": 25}
+	schema.ApplyDefaults(doc)
+	if len(doc) != 1 {
+		t.Errorf("expected the document to be left unchanged, got %v", doc)
+	}
+}
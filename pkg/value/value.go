@@ -0,0 +1,232 @@
+package value
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+)
+
+// Kind identifies the type of data held by a Value
+type Kind string
+
+const (
+	Null   Kind = ""
+	Number Kind = "number"
+	Bool   Kind = "bool"
+	String Kind = "string"
+	Object Kind = "object"
+	Vector Kind = "vector"
+)
+
+var (
+	ErrUnsupportedValue = errors.New("unsupported value, arrays can only contain numbers")
+)
+
+// Value is a typed reading or state exchanged with the nodes, it can be a
+// number, a boolean, a string, a vector of numbers or an object grouping
+// other values by name, optionally with a unit of measurement.
+//
+// In JSON a Value is represented by the corresponding JSON type, values
+// with a unit are wrapped in a {"value": ..., "unit": ...} object.
+type Value struct {
+	Kind   Kind
+	Number float64
+	Bool   bool
+	String string
+	Vector []float64
+	Object map[string]Value
+	Unit   string
+}
+
+// unitValue is the JSON representation of a value with a unit
+type unitValue struct {
+	Value json.RawMessage `json:"value"`
+	Unit  string          `json:"unit"`
+}
+
+// NewNumber returns a Value holding the passed number
+func NewNumber(number float64) Value {
+	return Value{Kind: Number, Number: number}
+}
+
+// NewBool returns a Value holding the passed boolean
+func NewBool(boolean bool) Value {
+	return Value{Kind: Bool, Bool: boolean}
+}
+
+// NewString returns a Value holding the passed string
+func NewString(str string) Value {
+	return Value{Kind: String, String: str}
+}
+
+// NewVector returns a Value holding the passed numbers
+func NewVector(vector ...float64) Value {
+	return Value{Kind: Vector, Vector: vector}
+}
+
+// NewObject returns a Value grouping the passed values by name
+func NewObject(object map[string]Value) Value {
+	return Value{Kind: Object, Object: object}
+}
+
+// Parse interprets a raw payload, such as an MQTT state, as a Value.
+// A payload that is not valid JSON is returned as a String value.
+func Parse(payload string) Value {
+	var parsed Value
+	if err := json.Unmarshal([]byte(payload), &parsed); err != nil {
+		return NewString(payload)
+	}
+	return parsed
+}
+
+// WithUnit returns a copy of the value with the passed unit
+func (v Value) WithUnit(unit string) Value {
+	v.Unit = unit
+	return v
+}
+
+// Float returns the value as a number, booleans are converted to 0 or 1
+// and strings are parsed. The second return value is false if the value
+// can't be represented as a single number.
+func (v Value) Float() (float64, bool) {
+	switch v.Kind {
+	case Number:
+		return v.Number, true
+	case Bool:
+		if v.Bool {
+			return 1, true
+		}
+		return 0, true
+	case String:
+		number, err := strconv.ParseFloat(v.String, 64)
+		return number, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// Equal reports whether the two values hold the same data and unit
+func (v Value) Equal(other Value) bool {
+	return reflect.DeepEqual(v, other)
+}
+
+// Raw returns the representation of the value in the same
+// format accepted by Parse
+func (v Value) Raw() string {
+	if v.Kind == String && v.Unit == "" {
+		return v.String
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (v Value) MarshalJSON() ([]byte, error) {
+	var data interface{}
+	switch v.Kind {
+	case Number:
+		data = v.Number
+	case Bool:
+		data = v.Bool
+	case String:
+		data = v.String
+	case Vector:
+		if v.Vector == nil {
+			data = []float64{}
+		} else {
+			data = v.Vector
+		}
+	case Object:
+		data = v.Object
+	default:
+		data = nil
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil || v.Unit == "" {
+		return encoded, err
+	}
+	return json.Marshal(&unitValue{Value: encoded, Unit: v.Unit})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (v *Value) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var raw interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+
+	if object, isObject := raw.(map[string]interface{}); isObject && len(object) == 2 {
+		_, hasValue := object["value"]
+		unit, hasUnit := object["unit"].(string)
+		if hasValue && hasUnit {
+			var wrapped unitValue
+			if err := json.Unmarshal(data, &wrapped); err != nil {
+				return err
+			}
+			if err := v.UnmarshalJSON(wrapped.Value); err != nil {
+				return err
+			}
+			v.Unit = unit
+			return nil
+		}
+	}
+
+	parsed, err := fromInterface(raw)
+	if err != nil {
+		return err
+	}
+	*v = parsed
+	return nil
+}
+
+func fromInterface(raw interface{}) (Value, error) {
+	switch typed := raw.(type) {
+	case nil:
+		return Value{}, nil
+	case json.Number:
+		number, err := typed.Float64()
+		return NewNumber(number), err
+	case bool:
+		return NewBool(typed), nil
+	case string:
+		return NewString(typed), nil
+	case []interface{}:
+		vector := make([]float64, len(typed))
+		for idx, elem := range typed {
+			number, isNumber := elem.(json.Number)
+			if !isNumber {
+				return Value{}, ErrUnsupportedValue
+			}
+			parsed, err := number.Float64()
+			if err != nil {
+				return Value{}, err
+			}
+			vector[idx] = parsed
+		}
+		return NewVector(vector...), nil
+	case map[string]interface{}:
+		object := make(map[string]Value, len(typed))
+		for key, elem := range typed {
+			encoded, err := json.Marshal(elem)
+			if err != nil {
+				return Value{}, err
+			}
+			var parsed Value
+			if err := parsed.UnmarshalJSON(encoded); err != nil {
+				return Value{}, err
+			}
+			object[key] = parsed
+		}
+		return NewObject(object), nil
+	default:
+		return Value{}, ErrUnsupportedValue
+	}
+}
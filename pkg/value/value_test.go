@@ -0,0 +1,64 @@
+package value
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		Payload  string
+		Expected Value
+	}{
+		{"21.5", NewNumber(21.5)},
+		{"true", NewBool(true)},
+		{"on", NewString("on")},
+		{`"on"`, NewString("on")},
+		{"[255, 128, 0]", NewVector(255, 128, 0)},
+		{`{"value": 21.5, "unit": "°C"}`, NewNumber(21.5).WithUnit("°C")},
+		{`{"temperature": {"value": 21.5, "unit": "°C"}, "humidity": 40}`, NewObject(map[string]Value{
+			"temperature": NewNumber(21.5).WithUnit("°C"),
+			"humidity":    NewNumber(40),
+		})},
+		{`["a", "b"]`, NewString(`["a", "b"]`)},
+	}
+
+	for _, test := range testCases {
+		if parsed := Parse(test.Payload); !parsed.Equal(test.Expected) {
+			t.Errorf("Parse(%s): expected %v, got %v", test.Payload, test.Expected, parsed)
+		}
+	}
+}
+
+func TestValue_MarshalJSON(t *testing.T) {
+	testCases := []struct {
+		Value    Value
+		Expected string
+	}{
+		{NewNumber(1500), `1500`},
+		{NewBool(false), `false`},
+		{NewString("off"), `"off"`},
+		{NewVector(255, 128, 0), `[255,128,0]`},
+		{NewNumber(21.5).WithUnit("°C"), `{"value":21.5,"unit":"°C"}`},
+		{NewObject(map[string]Value{"humidity": NewNumber(40)}), `{"humidity":40}`},
+		{Value{}, `null`},
+	}
+
+	for _, test := range testCases {
+		encoded, err := json.Marshal(test.Value)
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if string(encoded) != test.Expected {
+			t.Errorf("expected %s, got %s", test.Expected, encoded)
+		}
+
+		var decoded Value
+		if err := json.Unmarshal(encoded, &decoded); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if !decoded.Equal(test.Value) {
+			t.Errorf("expected %v, got %v", test.Value, decoded)
+		}
+	}
+}